@@ -0,0 +1,166 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"satomempool/logger"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Check 依赖检查，返回nil表示可用
+type Check func(ctx context.Context) error
+
+// Server 管理接口: /healthz 存活，/readyz 就绪，/debug/pprof/ 需要token
+type Server struct {
+	Addr         string
+	PprofToken   string        // 为空时不提供pprof
+	CheckTimeout time.Duration // 就绪检查的超时时间
+
+	Synced         func() bool          // 是否已完成首次全量同步
+	SinceLastTx    func() time.Duration // 距最近收到tx的时间，-1为尚未收到
+	SinceLastBlock func() time.Duration // 距最近收到新块通知的时间，-1为尚未收到
+	Checks         map[string]Check     // 名称 -> 依赖检查
+}
+
+// Status 存活检查结果
+type Status struct {
+	Synced         bool    `json:"synced"`
+	SinceLastTx    float64 `json:"since_last_tx"`    // 秒，-1为尚未收到
+	SinceLastBlock float64 `json:"since_last_block"` // 秒，-1为尚未收到
+}
+
+// ReadyStatus 就绪检查结果
+type ReadyStatus struct {
+	Ready bool `json:"ready"`
+	*Status
+	Checks map[string]string `json:"checks"` // 名称 -> ok或错误
+}
+
+func (s *Server) Serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	if s.PprofToken != "" {
+		mux.Handle("/debug/pprof/", s.protect(http.HandlerFunc(pprof.Index)))
+		mux.Handle("/debug/pprof/cmdline", s.protect(http.HandlerFunc(pprof.Cmdline)))
+		mux.Handle("/debug/pprof/profile", s.protect(http.HandlerFunc(pprof.Profile)))
+		mux.Handle("/debug/pprof/symbol", s.protect(http.HandlerFunc(pprof.Symbol)))
+		mux.Handle("/debug/pprof/trace", s.protect(http.HandlerFunc(pprof.Trace)))
+	}
+
+	logger.Log.Info("admin listen", zap.String("addr", s.Addr), zap.Bool("pprof", s.PprofToken != ""))
+	if err := http.ListenAndServe(s.Addr, mux); err != nil {
+		logger.Log.Info("admin server failed", zap.Error(err))
+	}
+}
+
+// protect 要求请求带有token，支持Authorization: Bearer <token>或?token=<token>
+func (s *Server) protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.PprofToken)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) status() *Status {
+	return &Status{
+		Synced:         s.Synced(),
+		SinceLastTx:    seconds(s.SinceLastTx()),
+		SinceLastBlock: seconds(s.SinceLastBlock()),
+	}
+}
+
+func seconds(d time.Duration) float64 {
+	if d < 0 {
+		return -1
+	}
+	return d.Seconds()
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := &ReadyStatus{
+		Status: s.status(),
+		Checks: s.runChecks(r.Context()),
+	}
+	status.Ready = status.Synced
+	for _, result := range status.Checks {
+		if result != "ok" {
+			status.Ready = false
+		}
+	}
+
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// runChecks 并行执行所有依赖检查，超时未返回的视为不可用
+func (s *Server) runChecks(ctx context.Context) map[string]string {
+	timeout := s.CheckTimeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var m sync.Mutex
+	results := make(map[string]string, len(s.Checks))
+	for name := range s.Checks {
+		results[name] = "timeout"
+	}
+
+	done := make(chan struct{}, len(s.Checks))
+	for name, check := range s.Checks {
+		go func(name string, check Check) {
+			result := "ok"
+			if err := check(ctx); err != nil {
+				result = err.Error()
+			}
+			m.Lock()
+			results[name] = result
+			m.Unlock()
+			done <- struct{}{}
+		}(name, check)
+	}
+	for i := 0; i < len(s.Checks); i++ {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			i = len(s.Checks)
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	copied := make(map[string]string, len(results))
+	for name, result := range results {
+		copied[name] = result
+	}
+	return copied
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,251 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix 环境变量前缀。每个配置项都可用 SATOMEMPOOL_<文件名>_<配置项> 覆盖，如 SATOMEMPOOL_CHAIN_ZMQ、SATOMEMPOOL_REDIS_ADDRS
+const EnvPrefix = "SATOMEMPOOL"
+
+// Config 全部配置，启动时加载一次后传给各模块
+type Config struct {
+	Chain *ChainConfig // chain.yaml
+	Redis *RedisConfig // redis.yaml
+	DB    *DBConfig    // db.yaml
+}
+
+// ChainConfig 节点、tx来源和同步行为
+type ChainConfig struct {
+	ChainProfile string
+
+	Sinks []string // 同步结果写入的存储: redis、clickhouse
+
+	Source          string
+	RpcPollInterval time.Duration
+	SourceFile      string
+	ReplaySpeed     float64
+	RecordFile      string
+	QuarantineFile  string
+
+	BlockConfirm    string
+	BlockConfirmMax int
+
+	ReconcileInterval time.Duration
+	EvictedRetention  time.Duration
+	OrphanExpire      time.Duration
+	NonFinalExpire    time.Duration
+
+	FeeStatsInterval time.Duration
+	FeeHistoryBlocks int
+
+	RiskLowFeeRate   float64
+	RiskMaxAncestors int
+
+	ShutdownTimeout time.Duration
+	MetricsListen   string
+	AdminListen     string
+	AdminPprofToken string
+
+	Zmq           string
+	ZmqHeartbeat  time.Duration
+	ZmqBackoffMin time.Duration
+	ZmqBackoffMax time.Duration
+
+	Rpc          string
+	RpcAuth      string
+	RpcBatchSize int
+	RpcWorkers   int
+	RpcRetry     int
+}
+
+// RedisConfig redis连接
+type RedisConfig struct {
+	Addrs        []string
+	Password     string
+	Database     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolSize     int
+}
+
+// DBConfig clickhouse连接
+type DBConfig struct {
+	Address         string
+	Database        string
+	Username        string
+	Password        string
+	MaxIdleConns    int
+	MaxOpenConns    int
+	ConnMaxLifetime time.Duration
+
+	ReadTimeout            int // 秒
+	WriteTimeout           int // 秒
+	SendTimeout            int // 秒
+	ReceiveTimeout         int // 秒
+	NoDelay                bool
+	ConnectionOpenStrategy string
+	BlockSize              int
+	PoolSize               int
+	Debug                  bool
+}
+
+// HasSink 是否写入该存储
+func (c *ChainConfig) HasSink(name string) bool {
+	for _, sink := range c.Sinks {
+		if sink == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Load 从dir目录读取chain.yaml、redis.yaml、db.yaml，环境变量优先
+func Load(dir string) (cfg *Config, err error) {
+	cfg = &Config{}
+	if cfg.Chain, err = loadChain(filepath.Join(dir, "chain.yaml")); err != nil {
+		return nil, err
+	}
+	if cfg.Redis, err = loadRedis(filepath.Join(dir, "redis.yaml")); err != nil {
+		return nil, err
+	}
+	if cfg.DB, err = loadDB(filepath.Join(dir, "db.yaml")); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// newViper 读取单个配置文件，name用于环境变量前缀
+func newViper(path, name string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetEnvPrefix(EnvPrefix + "_" + name)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("read config file %s: %w", path, err)
+	}
+	return v, nil
+}
+
+// getStringSlice 兼容环境变量中用逗号或空格分隔的多个值
+func getStringSlice(v *viper.Viper, key string) []string {
+	values := make([]string, 0)
+	for _, item := range v.GetStringSlice(key) {
+		for _, value := range strings.Split(item, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func loadChain(path string) (*ChainConfig, error) {
+	v, err := newViper(path, "CHAIN")
+	if err != nil {
+		return nil, err
+	}
+	v.SetDefault("chain_profile", "bsv-main")
+	v.SetDefault("sinks", []string{"redis", "clickhouse"})
+	v.SetDefault("source", "zmq")
+	v.SetDefault("rpc_poll_interval", "1s")
+	v.SetDefault("replay_speed", 1)
+	v.SetDefault("block_confirm", "full")
+	v.SetDefault("block_confirm_max", 6)
+	v.SetDefault("evicted_retention", "24h")
+	v.SetDefault("shutdown_timeout", "30s")
+	v.SetDefault("rpc_batch_size", 500)
+	v.SetDefault("rpc_workers", 8)
+	v.SetDefault("rpc_retry", 3)
+
+	return &ChainConfig{
+		ChainProfile: v.GetString("chain_profile"),
+
+		Sinks: getStringSlice(v, "sinks"),
+
+		Source:          v.GetString("source"),
+		RpcPollInterval: v.GetDuration("rpc_poll_interval"),
+		SourceFile:      v.GetString("source_file"),
+		ReplaySpeed:     v.GetFloat64("replay_speed"),
+		RecordFile:      v.GetString("record_file"),
+		QuarantineFile:  v.GetString("quarantine_file"),
+
+		BlockConfirm:    v.GetString("block_confirm"),
+		BlockConfirmMax: v.GetInt("block_confirm_max"),
+
+		ReconcileInterval: v.GetDuration("reconcile_interval"),
+		EvictedRetention:  v.GetDuration("evicted_retention"),
+		OrphanExpire:      v.GetDuration("orphan_expire"),
+		NonFinalExpire:    v.GetDuration("nonfinal_expire"),
+
+		FeeStatsInterval: v.GetDuration("fee_stats_interval"),
+		FeeHistoryBlocks: v.GetInt("fee_history_blocks"),
+
+		RiskLowFeeRate:   v.GetFloat64("risk_low_feerate"),
+		RiskMaxAncestors: v.GetInt("risk_max_ancestors"),
+
+		ShutdownTimeout: v.GetDuration("shutdown_timeout"),
+		MetricsListen:   v.GetString("metrics_listen"),
+		AdminListen:     v.GetString("admin_listen"),
+		AdminPprofToken: v.GetString("admin_pprof_token"),
+
+		Zmq:           v.GetString("zmq"),
+		ZmqHeartbeat:  v.GetDuration("zmq_heartbeat"),
+		ZmqBackoffMin: v.GetDuration("zmq_backoff_min"),
+		ZmqBackoffMax: v.GetDuration("zmq_backoff_max"),
+
+		Rpc:          v.GetString("rpc"),
+		RpcAuth:      v.GetString("rpc_auth"),
+		RpcBatchSize: v.GetInt("rpc_batch_size"),
+		RpcWorkers:   v.GetInt("rpc_workers"),
+		RpcRetry:     v.GetInt("rpc_retry"),
+	}, nil
+}
+
+func loadRedis(path string) (*RedisConfig, error) {
+	v, err := newViper(path, "REDIS")
+	if err != nil {
+		return nil, err
+	}
+	return &RedisConfig{
+		Addrs:        getStringSlice(v, "addrs"),
+		Password:     v.GetString("password"),
+		Database:     v.GetInt("database"),
+		DialTimeout:  v.GetDuration("dialTimeout"),
+		ReadTimeout:  v.GetDuration("readTimeout"),
+		WriteTimeout: v.GetDuration("writeTimeout"),
+		PoolSize:     v.GetInt("poolSize"),
+	}, nil
+}
+
+func loadDB(path string) (*DBConfig, error) {
+	v, err := newViper(path, "DB")
+	if err != nil {
+		return nil, err
+	}
+	return &DBConfig{
+		Address:         v.GetString("address"),
+		Database:        v.GetString("database"),
+		Username:        v.GetString("username"),
+		Password:        v.GetString("password"),
+		MaxIdleConns:    v.GetInt("maxIdleConns"),
+		MaxOpenConns:    v.GetInt("maxOpenConns"),
+		ConnMaxLifetime: v.GetDuration("connMaxLifetime"),
+
+		ReadTimeout:            v.GetInt("read_timeout"),
+		WriteTimeout:           v.GetInt("write_timeout"),
+		SendTimeout:            v.GetInt("send_timeout"),
+		ReceiveTimeout:         v.GetInt("receive_timeout"),
+		NoDelay:                v.GetBool("no_delay"),
+		ConnectionOpenStrategy: v.GetString("connection_open_strategy"),
+		BlockSize:              v.GetInt("block_size"),
+		PoolSize:               v.GetInt("pool_size"),
+		Debug:                  v.GetBool("debug"),
+	}, nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"satomempool/utils"
+	"strings"
+	"time"
+)
+
+// ValidationError 所有不合法的配置项
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate 检查配置，返回所有问题
+func (c *Config) Validate() error {
+	var errs ValidationError
+	fail := func(file, key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s: %s: ", file, key)+fmt.Sprintf(format, args...))
+	}
+	nonNegative := func(file, key string, d time.Duration) {
+		if d < 0 {
+			fail(file, key, "must not be negative, got %s", d)
+		}
+	}
+
+	chain := c.Chain
+	if !utils.HasChainProfile(chain.ChainProfile) {
+		fail("chain.yaml", "chain_profile", "unknown profile %q (%s)", chain.ChainProfile, strings.Join(utils.ChainProfileNames(), "/"))
+	}
+	if len(chain.Sinks) == 0 {
+		fail("chain.yaml", "sinks", "required")
+	}
+	for _, sink := range chain.Sinks {
+		if sink != "redis" && sink != "clickhouse" {
+			fail("chain.yaml", "sinks", "unknown sink %q (redis/clickhouse)", sink)
+		}
+	}
+	switch chain.Source {
+	case "zmq":
+		if chain.Zmq == "" {
+			fail("chain.yaml", "zmq", "required when source is zmq")
+		}
+	case "rpc":
+		if chain.RpcPollInterval <= 0 {
+			fail("chain.yaml", "rpc_poll_interval", "must be positive when source is rpc, got %s", chain.RpcPollInterval)
+		}
+	case "file", "capture":
+		if chain.SourceFile == "" {
+			fail("chain.yaml", "source_file", "required when source is %s", chain.Source)
+		}
+	default:
+		fail("chain.yaml", "source", "unknown tx source %q (zmq/rpc/file/capture)", chain.Source)
+	}
+	if chain.ReplaySpeed < 0 {
+		fail("chain.yaml", "replay_speed", "must not be negative, got %v", chain.ReplaySpeed)
+	}
+	if chain.BlockConfirm != "full" && chain.BlockConfirm != "incremental" {
+		fail("chain.yaml", "block_confirm", "unknown mode %q (full/incremental)", chain.BlockConfirm)
+	}
+	if chain.BlockConfirmMax <= 0 {
+		fail("chain.yaml", "block_confirm_max", "must be positive, got %d", chain.BlockConfirmMax)
+	}
+	nonNegative("chain.yaml", "reconcile_interval", chain.ReconcileInterval)
+	nonNegative("chain.yaml", "evicted_retention", chain.EvictedRetention)
+	nonNegative("chain.yaml", "orphan_expire", chain.OrphanExpire)
+	nonNegative("chain.yaml", "nonfinal_expire", chain.NonFinalExpire)
+	nonNegative("chain.yaml", "fee_stats_interval", chain.FeeStatsInterval)
+	if chain.FeeHistoryBlocks < 0 {
+		fail("chain.yaml", "fee_history_blocks", "must not be negative, got %d", chain.FeeHistoryBlocks)
+	}
+	if chain.RiskLowFeeRate < 0 {
+		fail("chain.yaml", "risk_low_feerate", "must not be negative, got %v", chain.RiskLowFeeRate)
+	}
+	if chain.RiskMaxAncestors < 0 {
+		fail("chain.yaml", "risk_max_ancestors", "must not be negative, got %d", chain.RiskMaxAncestors)
+	}
+	nonNegative("chain.yaml", "shutdown_timeout", chain.ShutdownTimeout)
+	nonNegative("chain.yaml", "zmq_heartbeat", chain.ZmqHeartbeat)
+	nonNegative("chain.yaml", "zmq_backoff_min", chain.ZmqBackoffMin)
+	nonNegative("chain.yaml", "zmq_backoff_max", chain.ZmqBackoffMax)
+	if chain.Rpc == "" {
+		fail("chain.yaml", "rpc", "required")
+	}
+	if chain.RpcBatchSize <= 0 {
+		fail("chain.yaml", "rpc_batch_size", "must be positive, got %d", chain.RpcBatchSize)
+	}
+	if chain.RpcWorkers <= 0 {
+		fail("chain.yaml", "rpc_workers", "must be positive, got %d", chain.RpcWorkers)
+	}
+	// 0为只请求一次，不重试
+	if chain.RpcRetry < 0 {
+		fail("chain.yaml", "rpc_retry", "must not be negative, got %d", chain.RpcRetry)
+	}
+
+	if len(c.Redis.Addrs) == 0 {
+		fail("redis.yaml", "addrs", "required")
+	}
+	if c.Redis.Database < 0 {
+		fail("redis.yaml", "database", "must not be negative, got %d", c.Redis.Database)
+	}
+
+	// 不写入clickhouse时不连接
+	if chain.HasSink("clickhouse") {
+		if c.DB.Address == "" {
+			fail("db.yaml", "address", "required when sinks include clickhouse")
+		}
+		if c.DB.Database == "" {
+			fail("db.yaml", "database", "required when sinks include clickhouse")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package harness
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Expect 同步后应有的redis和clickhouse数据。
+// mp:*键必须与Strings、ZSets、Hashes、Keys中列出的完全一致(mp:keys除外)，其他键只检查列出的值
+type Expect struct {
+	Strings map[string]string             // key -> value，如余额
+	ZSets   map[string]map[string]float64 // key -> member -> score
+	Hashes  map[string]map[string]string  // key -> field -> value
+	Keys    []string                      // 只检查存在的mp:*键
+
+	Txs    []TxRow
+	TxOuts []TxOutRow
+	TxIns  []TxInRow
+}
+
+// Check 返回实际数据与预期的所有差异
+func (e *Env) Check(expect *Expect) (diffs []string) {
+	fail := func(format string, args ...interface{}) {
+		diffs = append(diffs, fmt.Sprintf(format, args...))
+	}
+
+	expectKeys := make(map[string]bool, 0)
+	for key := range expect.Strings {
+		expectKeys[key] = true
+	}
+	for key := range expect.ZSets {
+		expectKeys[key] = true
+	}
+	for key := range expect.Hashes {
+		expectKeys[key] = true
+	}
+	for _, key := range expect.Keys {
+		expectKeys[key] = true
+	}
+
+	// mp:*键完全一致，且都登记在mp:keys中以便全量同步时删除
+	tracked := make(map[string]bool, 0)
+	if members, err := e.Redis.Members("mp:keys"); err == nil {
+		for _, member := range members {
+			tracked[member] = true
+		}
+	}
+	actualKeys := make(map[string]bool, 0)
+	for _, key := range e.Redis.Keys() {
+		if !strings.HasPrefix(key, "mp:") || key == "mp:keys" {
+			continue
+		}
+		actualKeys[key] = true
+		if !expectKeys[key] {
+			fail("unexpected key %s", ReadableKey(key))
+		}
+		if !tracked[key] {
+			fail("key %s not in mp:keys", ReadableKey(key))
+		}
+	}
+	for key := range expectKeys {
+		if strings.HasPrefix(key, "mp:") && !actualKeys[key] {
+			fail("missing key %s", ReadableKey(key))
+		}
+	}
+
+	for _, key := range sortedKeys(expect.Strings) {
+		value, err := e.Redis.Get(key)
+		if err != nil {
+			fail("get %s: %v", ReadableKey(key), err)
+		} else if value != expect.Strings[key] {
+			fail("%s = %s, want %s", ReadableKey(key), value, expect.Strings[key])
+		}
+	}
+
+	for _, key := range sortedKeys(expect.ZSets) {
+		members, err := e.Redis.ZMembers(key)
+		if err != nil {
+			fail("zset %s: %v", ReadableKey(key), err)
+			continue
+		}
+		want := expect.ZSets[key]
+		for _, member := range members {
+			if _, ok := want[member]; !ok {
+				fail("%s has unexpected member %s", ReadableKey(key), ReadableKey(member))
+			}
+		}
+		for member, score := range want {
+			actual, err := e.Redis.ZScore(key, member)
+			if err != nil {
+				fail("%s missing member %s", ReadableKey(key), ReadableKey(member))
+			} else if actual != score {
+				fail("%s[%s] = %v, want %v", ReadableKey(key), ReadableKey(member), actual, score)
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(expect.Hashes) {
+		for field, value := range expect.Hashes[key] {
+			if actual := e.Redis.HGet(key, field); actual != value {
+				fail("%s[%s] = %s, want %s", ReadableKey(key), field, ReadableKey(actual), ReadableKey(value))
+			}
+		}
+	}
+
+	for _, err := range e.CK.Errors() {
+		fail("clickhouse: %s", err)
+	}
+	if txs := e.CK.TxRows(); !rowsEqual(txs, expect.Txs) {
+		fail("tx rows:\n  got  %+v\n  want %+v", txs, expect.Txs)
+	}
+	if txOuts := e.CK.TxOutRows(); !rowsEqual(txOuts, expect.TxOuts) {
+		fail("txout rows:\n  got  %+v\n  want %+v", txOuts, expect.TxOuts)
+	}
+	if txIns := e.CK.TxInRows(); !rowsEqual(txIns, expect.TxIns) {
+		fail("txin rows:\n  got  %+v\n  want %+v", txIns, expect.TxIns)
+	}
+	return diffs
+}
+
+// ReadableKey 键中含二进制地址、codehash等，按go字符串转义输出
+func ReadableKey(key string) string {
+	return strconv.Quote(key)
+}
+
+// rowsEqual 比较两组行，nil与空切片视为相同
+func rowsEqual(a, b interface{}) bool {
+	if reflect.ValueOf(a).Len() == 0 && reflect.ValueOf(b).Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,454 @@
+package harness
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"satomempool/model"
+	"satomempool/utils"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// satoblock创建的基础表，列顺序与store中的insert语句一致
+var fakeBaseTables = map[string][]string{
+	"blktx_height": {"txid", "nin", "nout", "txsize", "locktime", "invalue", "outvalue", "rawtx", "height", "blkid", "txidx"},
+	"txout":        {"utxid", "vout", "address", "codehash", "genesis", "code_type", "data_value", "satoshi", "script_type", "script_pk", "height", "utxidx"},
+	"txin":         {"height", "txidx", "txid", "idx", "script_sig", "nsequence", "height_txo", "utxidx", "utxid", "vout", "address", "codehash", "genesis", "code_type", "data_value", "satoshi", "script_type", "script_pk"},
+	"txin_spent":   {"height", "txid", "idx", "utxid", "vout"},
+}
+
+var (
+	reCreateAs     = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) AS (\w+)$`)
+	reCreate       = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\) ENGINE=`)
+	reAddColumn    = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+) \w+$`)
+	reDeleteWhere  = regexp.MustCompile(`^ALTER TABLE (\w+) DELETE WHERE (\w+) >= (\d+)(?: AND (\w+) IN \((.*)\))?$`)
+	reUnhex        = regexp.MustCompile(`^unhex\('([0-9a-f]*)'\)$`)
+	reTruncate     = regexp.MustCompile(`^TRUNCATE TABLE IF EXISTS (\w+)$`)
+	reDrop         = regexp.MustCompile(`^DROP TABLE IF EXISTS (\w+)$`)
+	reInsertValues = regexp.MustCompile(`^INSERT INTO (\w+) \(([\w, ]+)\) VALUES \([?, ]+\)$`)
+	reInsertSelect = regexp.MustCompile(`^INSERT INTO (\w+) SELECT ([\w*, ]+) FROM (\w+);?$`)
+)
+
+type fakeTable struct {
+	columns []string
+	rows    []map[string]interface{}
+}
+
+// FakeClickHouse 内存中的clickhouse替身，作为database/sql驱动执行store中的语句。
+// 事务中的insert在提交时写入，回滚时丢弃，其他语句立即执行
+type FakeClickHouse struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+	errs   []string // 执行失败的语句，store只记录日志，由Check报告
+
+	failBegins int // 之后开始事务失败的次数
+}
+
+func NewFakeClickHouse() *FakeClickHouse {
+	ck := &FakeClickHouse{tables: make(map[string]*fakeTable, 0)}
+	for name, columns := range fakeBaseTables {
+		ck.tables[name] = &fakeTable{columns: columns}
+	}
+	return ck
+}
+
+// Connect 实现driver.Connector，用sql.OpenDB打开
+func (ck *FakeClickHouse) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{ck: ck}, nil
+}
+
+func (ck *FakeClickHouse) Driver() driver.Driver { return fakeDriver{ck} }
+
+type fakeDriver struct{ ck *FakeClickHouse }
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{ck: d.ck}, nil }
+
+// Rows 返回表中所有行的副本，按写入顺序
+func (ck *FakeClickHouse) Rows(table string) []map[string]interface{} {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	t, ok := ck.tables[table]
+	if !ok {
+		return nil
+	}
+	rows := make([]map[string]interface{}, 0, len(t.rows))
+	for _, row := range t.rows {
+		copied := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			copied[k] = v
+		}
+		rows = append(rows, copied)
+	}
+	return rows
+}
+
+// FailBegins 之后的n次开始事务返回错误，模拟clickhouse不可用
+func (ck *FakeClickHouse) FailBegins(n int) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.failBegins = n
+}
+
+// Errors 返回执行失败的语句及原因
+func (ck *FakeClickHouse) Errors() []string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return append([]string{}, ck.errs...)
+}
+
+// exec 执行一条语句，insert的行追加到pending时暂不写入
+func (ck *FakeClickHouse) exec(query string, args []driver.NamedValue, pending *[]func()) error {
+	query = strings.TrimSpace(query)
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+
+	if m := reInsertValues.FindStringSubmatch(query); m != nil {
+		t, ok := ck.tables[m[1]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[1])
+		}
+		columns := strings.Split(m[2], ", ")
+		if len(columns) != len(args) {
+			return fmt.Errorf("insert %s: %d columns, %d args", m[1], len(columns), len(args))
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			row[column] = args[i].Value
+		}
+		insert := func() { t.rows = append(t.rows, row) }
+		if pending != nil {
+			*pending = append(*pending, insert)
+		} else {
+			insert()
+		}
+		return nil
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected args: %s", query)
+	}
+
+	if m := reCreateAs.FindStringSubmatch(query); m != nil {
+		src, ok := ck.tables[m[2]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[2])
+		}
+		if _, ok := ck.tables[m[1]]; !ok {
+			ck.tables[m[1]] = &fakeTable{columns: append([]string{}, src.columns...)}
+		}
+	} else if m := reCreate.FindStringSubmatch(query); m != nil {
+		if _, ok := ck.tables[m[1]]; !ok {
+			t := &fakeTable{}
+			for _, def := range strings.Split(m[2], ", ") {
+				t.columns = append(t.columns, strings.Fields(def)[0])
+			}
+			ck.tables[m[1]] = t
+		}
+	} else if m := reAddColumn.FindStringSubmatch(query); m != nil {
+		t, ok := ck.tables[m[1]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[1])
+		}
+		for _, column := range t.columns {
+			if column == m[2] {
+				return nil
+			}
+		}
+		t.columns = append(t.columns, m[2])
+	} else if m := reDeleteWhere.FindStringSubmatch(query); m != nil {
+		t, ok := ck.tables[m[1]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[1])
+		}
+		bound, _ := strconv.ParseUint(m[3], 10, 64)
+		// 带IN条件时只删除列出的值
+		var values map[string]bool
+		if m[4] != "" {
+			values = make(map[string]bool, 0)
+			for _, value := range strings.Split(m[5], ",") {
+				u := reUnhex.FindStringSubmatch(value)
+				if u == nil {
+					return fmt.Errorf("unsupported value %s: %s", value, query)
+				}
+				raw, _ := hex.DecodeString(u[1])
+				values[string(raw)] = true
+			}
+		}
+		rows := t.rows[:0]
+		for _, row := range t.rows {
+			if uintValue(row[m[2]]) < bound || (values != nil && !values[stringValue(row[m[4]])]) {
+				rows = append(rows, row)
+			}
+		}
+		t.rows = rows
+	} else if m := reTruncate.FindStringSubmatch(query); m != nil {
+		if t, ok := ck.tables[m[1]]; ok {
+			t.rows = nil
+		}
+	} else if m := reDrop.FindStringSubmatch(query); m != nil {
+		delete(ck.tables, m[1])
+	} else if m := reInsertSelect.FindStringSubmatch(query); m != nil {
+		dst, ok := ck.tables[m[1]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[1])
+		}
+		src, ok := ck.tables[m[3]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[3])
+		}
+		columns := src.columns
+		if m[2] != "*" {
+			columns = strings.Split(m[2], ", ")
+		}
+		if len(columns) != len(dst.columns) {
+			return fmt.Errorf("insert %s: %d columns, select %d", m[1], len(dst.columns), len(columns))
+		}
+		// 与clickhouse相同按位置对应
+		for _, srcRow := range src.rows {
+			row := make(map[string]interface{}, len(columns))
+			for i, column := range columns {
+				row[dst.columns[i]] = srcRow[column]
+			}
+			dst.rows = append(dst.rows, row)
+		}
+	} else {
+		return fmt.Errorf("unsupported sql: %s", query)
+	}
+	return nil
+}
+
+type fakeConn struct {
+	ck *FakeClickHouse
+	tx *fakeTx
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("already in transaction")
+	}
+	c.ck.mu.Lock()
+	defer c.ck.mu.Unlock()
+	if c.ck.failBegins > 0 {
+		c.ck.failBegins--
+		return nil, errors.New("begin failed")
+	}
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error { return nil }
+
+// CheckNamedValue 参数保持原类型写入
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type fakeTx struct {
+	conn    *fakeConn
+	pending []func()
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.conn.tx = nil
+	tx.conn.ck.mu.Lock()
+	defer tx.conn.ck.mu.Unlock()
+	for _, insert := range tx.pending {
+		insert()
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return s.ExecContext(context.Background(), named)
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var pending *[]func()
+	if s.conn.tx != nil {
+		pending = &s.conn.tx.pending
+	}
+	if err := s.conn.ck.exec(s.query, args, pending); err != nil {
+		s.conn.ck.mu.Lock()
+		s.conn.ck.errs = append(s.conn.ck.errs, err.Error())
+		s.conn.ck.mu.Unlock()
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("query not supported")
+}
+
+func uintValue(v interface{}) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case uint32:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case int:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	}
+	return 0
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// TxRow 对应clickhouse blktx_height和blktx_fee中的一行
+type TxRow struct {
+	Txid          string
+	Wtxid         string
+	TxIdx         uint64
+	InCnt         uint32
+	OutCnt        uint32
+	VSize         uint32
+	InputsValue   uint64
+	OutputsValue  uint64
+	Fee           uint64
+	FeeUnresolved bool
+}
+
+// TxOutRow 对应clickhouse txout中的一行
+type TxOutRow struct {
+	Txid     string
+	Vout     uint32
+	Address  string // hex
+	CodeType uint32
+	Value    uint64 // ft为amount，nft为tokenIndex
+	Satoshi  uint64
+}
+
+// TxInRow 对应clickhouse txin中的一行
+type TxInRow struct {
+	Txid     string
+	Vin      uint32
+	UTxid    string
+	UVout    uint32
+	UHeight  uint32
+	Address  string // hex
+	CodeType uint32
+	Value    uint64
+	Satoshi  uint64
+}
+
+// mempoolRows 查询mempool数据: 主表中height为mempool高度的行
+func (ck *FakeClickHouse) mempoolRows(table string) (rows []map[string]interface{}) {
+	for _, row := range ck.Rows(table) {
+		if uintValue(row["height"]) != model.MEMPOOL_HEIGHT {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// MempoolRowsOf 各主表中txid(hex)残留的mempool行数，txout按utxid
+func (ck *FakeClickHouse) MempoolRowsOf(txid string) map[string]int {
+	counts := make(map[string]int, 0)
+	for _, table := range []string{"blktx_height", "blktx_fee", "txin", "txin_spent", "txout"} {
+		column := "txid"
+		if table == "txout" {
+			column = "utxid"
+		}
+		for _, row := range ck.mempoolRows(table) {
+			if utils.HashString([]byte(stringValue(row[column]))) == txid {
+				counts[table]++
+			}
+		}
+	}
+	return counts
+}
+
+// TxRows blktx_fee与blktx_height按txid关联后的mempool tx
+func (ck *FakeClickHouse) TxRows() (rows []TxRow) {
+	txs := make(map[string]map[string]interface{}, 0)
+	for _, row := range ck.mempoolRows("blktx_height") {
+		txs[stringValue(row["txid"])] = row
+	}
+	for _, fee := range ck.mempoolRows("blktx_fee") {
+		txid := stringValue(fee["txid"])
+		tx := txs[txid]
+		rows = append(rows, TxRow{
+			Txid:          utils.HashString([]byte(txid)),
+			Wtxid:         utils.HashString([]byte(stringValue(fee["wtxid"]))),
+			TxIdx:         uintValue(fee["txidx"]),
+			InCnt:         uint32(uintValue(tx["nin"])),
+			OutCnt:        uint32(uintValue(tx["nout"])),
+			VSize:         uint32(uintValue(fee["vsize"])),
+			InputsValue:   uintValue(tx["invalue"]),
+			OutputsValue:  uintValue(tx["outvalue"]),
+			Fee:           uintValue(fee["fee"]),
+			FeeUnresolved: fee["unresolved"] == true,
+		})
+	}
+	return rows
+}
+
+// TxOutRows txout中的mempool输出
+func (ck *FakeClickHouse) TxOutRows() (rows []TxOutRow) {
+	for _, row := range ck.mempoolRows("txout") {
+		rows = append(rows, TxOutRow{
+			Txid:     utils.HashString([]byte(stringValue(row["utxid"]))),
+			Vout:     uint32(uintValue(row["vout"])),
+			Address:  hexString(row["address"]),
+			CodeType: uint32(uintValue(row["code_type"])),
+			Value:    uintValue(row["data_value"]),
+			Satoshi:  uintValue(row["satoshi"]),
+		})
+	}
+	return rows
+}
+
+// TxInRows txin中的mempool输入
+func (ck *FakeClickHouse) TxInRows() (rows []TxInRow) {
+	for _, row := range ck.mempoolRows("txin") {
+		rows = append(rows, TxInRow{
+			Txid:     utils.HashString([]byte(stringValue(row["txid"]))),
+			Vin:      uint32(uintValue(row["idx"])),
+			UTxid:    utils.HashString([]byte(stringValue(row["utxid"]))),
+			UVout:    uint32(uintValue(row["vout"])),
+			UHeight:  uint32(uintValue(row["height_txo"])),
+			Address:  hexString(row["address"]),
+			CodeType: uint32(uintValue(row["code_type"])),
+			Value:    uintValue(row["data_value"]),
+			Satoshi:  uintValue(row["satoshi"]),
+		})
+	}
+	return rows
+}
+
+func hexString(v interface{}) string {
+	return fmt.Sprintf("%x", stringValue(v))
+}
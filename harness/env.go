@@ -0,0 +1,144 @@
+package harness
+
+import (
+	"context"
+	"database/sql"
+	"satomempool/config"
+	"satomempool/loader"
+	"satomempool/loader/clickhouse"
+	"satomempool/model"
+	"satomempool/task"
+	"satomempool/task/serial"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// Env 内存redis、模拟节点和内存clickhouse替身。
+// loader、serial和clickhouse使用包级连接，同一时间只能有一个Env
+type Env struct {
+	Redis   *miniredis.Miniredis
+	Node    *FakeNode
+	CK      *FakeClickHouse
+	Mempool *task.Mempool
+
+	LoadRetries int // 全量同步时加载失败重试的次数
+	FullSyncs   int // 执行全量同步的次数
+
+	startIdx int
+}
+
+// NewEnv 启动内存redis和模拟节点，节点已有height个区块
+func NewEnv(height int) (*Env, error) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	e := &Env{
+		Redis: mr,
+		Node:  NewFakeNode(height),
+		CK:    NewFakeClickHouse(),
+	}
+
+	serial.Init(&config.RedisConfig{Addrs: []string{mr.Addr()}})
+	loader.Init(&config.ChainConfig{
+		Rpc:          e.Node.URL(),
+		RpcBatchSize: 100,
+		RpcWorkers:   2,
+		RpcRetry:     1,
+	})
+	clickhouse.InitDB(sql.OpenDB(e.CK))
+	serial.CleanUtxoMap()
+
+	if e.Mempool, err = task.NewMempool(); err != nil {
+		e.Close()
+		return nil, err
+	}
+	e.Mempool.Sinks = []task.Sink{&serial.RedisSink{}, &serial.ClickHouseSink{}}
+	e.Mempool.IncrementalConfirm = true
+	e.Mempool.MaxConfirmBlocks = 6
+	return e, nil
+}
+
+func (e *Env) Close() {
+	serial.CloseRedis()
+	clickhouse.CK.Close()
+	e.Node.Close()
+	e.Redis.Close()
+}
+
+// SeedUtxo 写入satoblock已同步的utxo
+func (e *Env) SeedUtxo(txid string, vout uint32, height uint32, txIdx uint64, out TxOut) {
+	d := &model.TxoData{
+		BlockHeight: height,
+		TxIdx:       txIdx,
+		Satoshi:     out.Satoshi,
+		Script:      out.Script,
+	}
+	buf := make([]byte, 20+len(d.Script))
+	d.Marshal(buf)
+	e.Redis.Set("u"+Outpoint(txid, vout), string(buf))
+}
+
+// FullSync 与main中的全量同步相同: 清空存储，从节点加载mempool后同步
+func (e *Env) FullSync() {
+	mp := e.Mempool
+	mp.Init()
+	e.FullSyncs++
+	e.startIdx = 0
+	serial.CleanUtxoMap()
+	mp.ResetSinks()
+	// 与main相同，节点最新区块未知时重试
+	for !mp.LoadFromMempool(context.Background()) {
+		e.LoadRetries++
+		mp.Init()
+	}
+	e.parse()
+	mp.SetSynced()
+}
+
+// Relay 节点收到txs并通过zmq推送，同步一个批次
+func (e *Env) Relay(txs ...*Tx) {
+	mp := e.Mempool
+	mp.Init()
+	for _, tx := range txs {
+		e.Node.AddMempoolTx(tx)
+		mp.RawTxNotify <- tx.Raw()
+	}
+	e.sync()
+}
+
+// Mine 节点将txs打包进新区块，通知mempool确认。txs可以是未转发过的双花tx
+func (e *Env) Mine(txs ...*Tx) *FakeBlock {
+	block := e.Node.MineTxs(txs...)
+
+	e.Mempool.Init()
+	e.Mempool.BlockNotify <- []byte(block.Hash)
+	e.sync()
+	return block
+}
+
+// Reconcile 按节点当前mempool对账
+func (e *Env) Reconcile() {
+	txids := e.Node.GetRawMemPool()
+	snapshot := &task.MempoolSnapshot{
+		Height: e.Node.Height(),
+		Txids:  make(map[string]bool, len(txids)),
+	}
+	for _, txid := range txids {
+		snapshot.Txids[txid] = true
+	}
+	e.Mempool.ReconcileMempool(snapshot)
+}
+
+func (e *Env) sync() {
+	if needFullSync := e.Mempool.SyncMempoolFromZmq(context.Background()); needFullSync {
+		e.FullSync()
+		return
+	}
+	e.parse()
+}
+
+func (e *Env) parse() {
+	e.Mempool.ParseMempool(context.Background(), e.startIdx)
+	e.startIdx += len(e.Mempool.BatchTxs)
+}
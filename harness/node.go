@@ -0,0 +1,306 @@
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// FakeNode 模拟节点json-rpc，提供mempool和区块查询
+type FakeNode struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	mempool []string          // 按到达顺序
+	rawtxs  map[string]string // txid -> hex
+	txs     map[string]*Tx    // txid -> tx，用于getblock返回输入
+	blocks  []*FakeBlock      // 下标为高度
+	fails   map[string]int    // method -> 接下来失败的次数
+}
+
+type FakeBlock struct {
+	Hash       string
+	Txids      []string
+	MedianTime int64
+}
+
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []interface{}   `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// NewFakeNode 创建已有height个区块的节点
+func NewFakeNode(height int) *FakeNode {
+	n := &FakeNode{
+		rawtxs: make(map[string]string, 0),
+		txs:    make(map[string]*Tx, 0),
+		blocks: make([]*FakeBlock, 0, height+1),
+		fails:  make(map[string]int, 0),
+	}
+	for h := 0; h <= height; h++ {
+		n.blocks = append(n.blocks, newFakeBlock(h, nil))
+	}
+	n.server = httptest.NewServer(n)
+	return n
+}
+
+func newFakeBlock(height int, txids []string) *FakeBlock {
+	// 首个tx模拟coinbase
+	coinbase := FakeTxid(fmt.Sprintf("coinbase-%d", height))
+	return &FakeBlock{
+		Hash:       FakeTxid(fmt.Sprintf("block-%d", height)),
+		Txids:      append([]string{coinbase}, txids...),
+		MedianTime: 1600000000 + int64(height)*600,
+	}
+}
+
+func (n *FakeNode) URL() string {
+	return n.server.URL
+}
+
+func (n *FakeNode) Close() {
+	n.server.Close()
+}
+
+// Height 最新区块高度
+func (n *FakeNode) Height() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.blocks) - 1
+}
+
+// AddMempoolTx 加入节点mempool
+func (n *FakeNode) AddMempoolTx(tx *Tx) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	txid := tx.Txid()
+	if _, ok := n.rawtxs[txid]; !ok {
+		n.mempool = append(n.mempool, txid)
+	}
+	n.rawtxs[txid] = tx.Hex()
+	n.txs[txid] = tx
+	return txid
+}
+
+// GetRawMemPool 节点mempool中的txid，按到达顺序
+func (n *FakeNode) GetRawMemPool() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	txids := make([]string, len(n.mempool))
+	copy(txids, n.mempool)
+	return txids
+}
+
+// FailRpc 接下来times次method调用返回错误
+func (n *FakeNode) FailRpc(method string, times int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fails[method] = times
+}
+
+// RemoveMempoolTx 从节点mempool中移除，模拟过期或被替换
+func (n *FakeNode) RemoveMempoolTx(txid string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	mempool := make([]string, 0, len(n.mempool))
+	for _, id := range n.mempool {
+		if id != txid {
+			mempool = append(mempool, id)
+		}
+	}
+	n.mempool = mempool
+}
+
+// MineTxs 将txs打包进新区块，txs可以不在mempool中(如双花tx)。mempool中与之双花的tx及其子tx一并移出
+func (n *FakeNode) MineTxs(txs ...*Tx) *FakeBlock {
+	n.mu.Lock()
+	txids := make([]string, 0, len(txs))
+	spent := make(map[string]string, 0) // outpoint -> txid
+	for _, tx := range txs {
+		txid := tx.Txid()
+		n.txs[txid] = tx
+		txids = append(txids, txid)
+		for _, in := range tx.Ins {
+			spent[Outpoint(in.Txid, in.Vout)] = txid
+		}
+	}
+
+	// mempool按到达顺序，父tx在子tx之前
+	removed := make(map[string]bool, 0)
+	mempool := make([]string, 0, len(n.mempool))
+	for _, txid := range n.mempool {
+		for _, in := range n.txs[txid].Ins {
+			if by, ok := spent[Outpoint(in.Txid, in.Vout)]; (ok && by != txid) || removed[in.Txid] {
+				removed[txid] = true
+				break
+			}
+		}
+		if !removed[txid] {
+			mempool = append(mempool, txid)
+		}
+	}
+	n.mempool = mempool
+	n.mu.Unlock()
+	return n.MineBlock(txids...)
+}
+
+// MineBlock 将txids打包进新区块并移出mempool，返回新区块
+func (n *FakeNode) MineBlock(txids ...string) *FakeBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	mined := make(map[string]bool, len(txids))
+	for _, txid := range txids {
+		mined[txid] = true
+	}
+	mempool := make([]string, 0, len(n.mempool))
+	for _, txid := range n.mempool {
+		if !mined[txid] {
+			mempool = append(mempool, txid)
+		}
+	}
+	n.mempool = mempool
+
+	block := newFakeBlock(len(n.blocks), txids)
+	n.blocks = append(n.blocks, block)
+	return block
+}
+
+// ServeHTTP 处理单个或批量json-rpc请求
+func (n *FakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	if len(body) > 0 && body[0] == '[' {
+		var requests []*rpcRequest
+		if err := json.Unmarshal(body, &requests); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		responses := make([]*rpcResponse, 0, len(requests))
+		for _, req := range requests {
+			responses = append(responses, n.handle(req))
+		}
+		result = responses
+	} else {
+		req := &rpcRequest{}
+		if err := json.Unmarshal(body, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = n.handle(req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (n *FakeNode) handle(req *rpcRequest) *rpcResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+	fail := func(code int, format string, args ...interface{}) *rpcResponse {
+		resp.Error = &rpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+		return resp
+	}
+
+	if n.fails[req.Method] > 0 {
+		n.fails[req.Method]--
+		return fail(-1, "%s failed", req.Method)
+	}
+
+	switch req.Method {
+	case "getrawmempool":
+		txids := make([]string, len(n.mempool))
+		copy(txids, n.mempool)
+		resp.Result = txids
+
+	case "getrawtransaction":
+		txid, _ := param(req, 0).(string)
+		rawtx, ok := n.rawtxs[txid]
+		if !ok {
+			return fail(-5, "No such mempool or blockchain transaction: %s", txid)
+		}
+		resp.Result = rawtx
+
+	case "getblockcount":
+		resp.Result = len(n.blocks) - 1
+
+	case "getblockhash":
+		height, _ := param(req, 0).(float64)
+		if int(height) < 0 || int(height) >= len(n.blocks) {
+			return fail(-8, "Block height out of range")
+		}
+		resp.Result = n.blocks[int(height)].Hash
+
+	case "getblock", "getblockheader":
+		hash, _ := param(req, 0).(string)
+		for height, block := range n.blocks {
+			if block.Hash != hash {
+				continue
+			}
+			header := map[string]interface{}{
+				"hash":       block.Hash,
+				"height":     height,
+				"mediantime": block.MedianTime,
+			}
+			if req.Method == "getblock" {
+				header["tx"] = block.Txids
+				if verbosity, _ := param(req, 1).(float64); verbosity >= 2 {
+					header["tx"] = n.blockTxs(block)
+				}
+			}
+			resp.Result = header
+			return resp
+		}
+		return fail(-5, "Block not found: %s", hash)
+
+	default:
+		return fail(-32601, "Method not found: %s", req.Method)
+	}
+	return resp
+}
+
+// blockTxs getblock verbosity=2时的tx列表，只包含txid和输入
+func (n *FakeNode) blockTxs(block *FakeBlock) []interface{} {
+	txs := make([]interface{}, 0, len(block.Txids))
+	for i, txid := range block.Txids {
+		vin := make([]interface{}, 0)
+		if i == 0 {
+			vin = append(vin, map[string]interface{}{"coinbase": "00"})
+		} else if tx, ok := n.txs[txid]; ok {
+			for _, in := range tx.Ins {
+				vin = append(vin, map[string]interface{}{"txid": in.Txid, "vout": in.Vout})
+			}
+		}
+		txs = append(txs, map[string]interface{}{"txid": txid, "vin": vin})
+	}
+	return txs
+}
+
+func param(req *rpcRequest, idx int) interface{} {
+	if idx >= len(req.Params) {
+		return nil
+	}
+	return req.Params[idx]
+}
@@ -0,0 +1,1175 @@
+package harness
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"os"
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/task"
+	"satomempool/utils"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	scriptDecoder "github.com/sensible-contract/sensible-script-decoder"
+	"go.uber.org/zap"
+)
+
+// scenario 一组同步操作，返回操作后应有的数据
+type scenario struct {
+	name  string
+	chain string // 链参数，为空时为bsv-main
+	run   func(t *testing.T, e *Env) *Expect
+}
+
+var scenarios = []*scenario{
+	{name: "chained spends", run: chainedSpends},
+	{name: "chained spends confirmed", run: chainedSpendsConfirmed},
+	{name: "ft transfer", run: ftTransfer},
+	{name: "nft transfer", run: nftTransfer},
+	{name: "segwit spends", chain: "btc-main", run: segwitSpends},
+	{name: "non-pkh scripts", run: nonPkhScripts},
+	{name: "block conflict", run: blockConflict},
+	{name: "evict pool descendants", run: evictPoolDescendants},
+	{name: "conflict confirmed", run: conflictConfirmed},
+	{name: "orphan conflict", run: orphanConflict},
+	{name: "conflict before sorting", run: conflictBeforeSorting},
+	{name: "best block retry", run: bestBlockRetry},
+	{name: "dependency sorting", run: dependencySorting},
+	{name: "orphan chain resolved", run: orphanChainResolved},
+	{name: "non final promoted", run: nonFinalPromoted},
+	{name: "sink failure resync", run: sinkFailureResync},
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// -v时输出同步日志
+	if !testing.Verbose() {
+		logger.Log = zap.NewNop()
+	}
+	os.Exit(m.Run())
+}
+
+// TestScenarios 每个场景在新的Env中执行，逐条报告与预期的差异
+func TestScenarios(t *testing.T) {
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			chain := s.chain
+			if chain == "" {
+				chain = "bsv-main"
+			}
+			if err := utils.SetChain(chain); err != nil {
+				t.Fatal(err)
+			}
+			e, err := NewEnv(100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			for _, diff := range e.Check(s.run(t, e)) {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+// 三个tx依次花费上一个tx的输出，首个tx在全量同步时从节点加载，其余从zmq收到
+func chainedSpends(t *testing.T, e *Env) *Expect {
+	alice, bob, carol, dave := Pkh("alice"), Pkh("bob"), Pkh("carol"), Pkh("dave")
+	funding := FakeTxid("funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	a := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 60000, Script: P2PKH(bob)}, {Satoshi: 39000, Script: P2PKH(alice)}},
+	}
+	b := &Tx{
+		Ins:  []TxIn{{Txid: a.Txid(), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 59500, Script: P2PKH(carol)}},
+	}
+	c := &Tx{
+		Ins:  []TxIn{{Txid: b.Txid(), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 59000, Script: P2PKH(dave)}},
+	}
+
+	e.Node.AddMempoolTx(a)
+	e.FullSync()
+	e.Relay(b)
+	e.Relay(c)
+
+	sizeA, sizeB, sizeC := uint64(a.VSize()), uint64(b.VSize()), uint64(c.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-61000",
+			"mp:bl" + string(bob):   "0",
+			"mp:bl" + string(carol): "0",
+			"mp:bl" + string(dave):  "59000",
+
+			sbKey(P2PKH(alice)): "-61000",
+			sbKey(P2PKH(bob)):   "0",
+			sbKey(P2PKH(carol)): "0",
+			sbKey(P2PKH(dave)):  "59000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(90, 3)},
+			"mp:{au" + string(alice) + "}":   {a.Outpoint(1): mempoolScore(0)},
+			"mp:{au" + string(dave) + "}":    {c.Outpoint(0): mempoolScore(2)},
+
+			spentSuKey(P2PKH(alice)): {Outpoint(funding, 0): confirmedScore(90, 3)},
+			suKey(P2PKH(alice)):      {a.Outpoint(1): mempoolScore(0)},
+			suKey(P2PKH(dave)):       {c.Outpoint(0): mempoolScore(2)},
+
+			"mp:feerate": {
+				a.Txid(): feeRate(1000, a),
+				b.Txid(): feeRate(500, b),
+				c.Txid(): feeRate(500, c),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + a.Txid(): packageFields(1, sizeA, 1000, 3, sizeA+sizeB+sizeC, 2000),
+			"mp:pk" + b.Txid(): packageFields(2, sizeA+sizeB, 1500, 2, sizeB+sizeC, 1000),
+			"mp:pk" + c.Txid(): packageFields(3, sizeA+sizeB+sizeC, 2000, 1, sizeC, 500),
+			"mp:rk" + a.Txid(): riskFields(0, ""),
+			"mp:rk" + b.Txid(): riskFields(0, ""),
+			"mp:rk" + c.Txid(): riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(a, 0, 100000),
+			txRow(b, 1, 60000),
+			txRow(c, 2, 59500),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: a.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 60000},
+			{Txid: a.Txid(), Vout: 1, Address: hex.EncodeToString(alice), Satoshi: 39000},
+			{Txid: b.Txid(), Vout: 0, Address: hex.EncodeToString(carol), Satoshi: 59500},
+			{Txid: c.Txid(), Vout: 0, Address: hex.EncodeToString(dave), Satoshi: 59000},
+		},
+		TxIns: []TxInRow{
+			{Txid: a.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+			{Txid: b.Txid(), Vin: 0, UTxid: a.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(bob), Satoshi: 60000},
+			{Txid: c.Txid(), Vin: 0, UTxid: b.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(carol), Satoshi: 59500},
+		},
+	}
+}
+
+// 全量同步时clickhouse写入失败，跳过该批次并请求全量同步，重新同步后与未失败时一致
+func sinkFailureResync(t *testing.T, e *Env) *Expect {
+	e.CK.FailBegins(1)
+	expect := chainedSpends(t, e)
+	if e.FullSyncs != 2 {
+		t.Fatalf("full syncs = %d, want 2", e.FullSyncs)
+	}
+	// 重新全量同步时a和b在同一批次，bob的余额未变化
+	bob := Pkh("bob")
+	delete(expect.Strings, "mp:bl"+string(bob))
+	delete(expect.Strings, sbKey(P2PKH(bob)))
+	return expect
+}
+
+// 链中首个tx被打包，子tx改为花费已确认utxo
+func chainedSpendsConfirmed(t *testing.T, e *Env) *Expect {
+	expect := chainedSpends(t, e)
+	alice, bob, carol, dave := Pkh("alice"), Pkh("bob"), Pkh("carol"), Pkh("dave")
+
+	a := e.CK.TxRows()[0].Txid
+	b, c := expect.Txs[1], expect.Txs[2]
+	block := e.Mine(&Tx{
+		Ins:  []TxIn{{Txid: FakeTxid("funding"), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 60000, Script: P2PKH(bob)}, {Satoshi: 39000, Script: P2PKH(alice)}},
+	})
+	if block.Txids[1] != a {
+		t.Fatal("confirmed tx mismatch")
+	}
+
+	bTx := &Tx{
+		Ins:  []TxIn{{Txid: a, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 59500, Script: P2PKH(carol)}},
+	}
+	cTx := &Tx{
+		Ins:  []TxIn{{Txid: b.Txid, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 59000, Script: P2PKH(dave)}},
+	}
+	sizeB, sizeC := uint64(bTx.VSize()), uint64(cTx.VSize())
+
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "0",
+			"mp:bl" + string(bob):   "-60000",
+			"mp:bl" + string(carol): "0",
+			"mp:bl" + string(dave):  "59000",
+
+			sbKey(P2PKH(alice)): "0",
+			sbKey(P2PKH(bob)):   "-60000",
+			sbKey(P2PKH(carol)): "0",
+			sbKey(P2PKH(dave)):  "59000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(bob) + "}": {Outpoint(a, 0): confirmedScore(101, 1)},
+			"mp:{au" + string(dave) + "}":  {Outpoint(c.Txid, 0): mempoolScore(2)},
+
+			spentSuKey(P2PKH(bob)): {Outpoint(a, 0): confirmedScore(101, 1)},
+			suKey(P2PKH(dave)):     {Outpoint(c.Txid, 0): mempoolScore(2)},
+
+			"mp:feerate": {
+				b.Txid: feeRate(500, bTx),
+				c.Txid: feeRate(500, cTx),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + b.Txid: packageFields(1, sizeB, 500, 2, sizeB+sizeC, 1000),
+			"mp:pk" + c.Txid: packageFields(2, sizeB+sizeC, 1000, 1, sizeC, 500),
+			"mp:rk" + b.Txid: riskFields(0, ""),
+			"mp:rk" + c.Txid: riskFields(0, ""),
+		},
+		Txs:    expect.Txs[1:],
+		TxOuts: expect.TxOuts[2:],
+		TxIns:  expect.TxIns[1:],
+	}
+}
+
+// ft转账: 花费已确认的ft和手续费utxo，转出部分ft并找零
+func ftTransfer(t *testing.T, e *Env) *Expect {
+	alice, bob := Pkh("alice"), Pkh("bob")
+	genesis := sensibleId("ft-genesis")
+	ftScript := func(pkh []byte, amount uint64) []byte {
+		return FTScript(pkh, genesis, amount, "Test Token", "TT", 8)
+	}
+	issue := FakeTxid("ft-issue")
+	e.SeedUtxo(issue, 0, 95, 1, TxOut{Satoshi: 1000, Script: ftScript(alice, 500)})
+	e.SeedUtxo(issue, 1, 95, 1, TxOut{Satoshi: 50000, Script: P2PKH(alice)})
+
+	tx := &Tx{
+		Ins: []TxIn{{Txid: issue, Vout: 0}, {Txid: issue, Vout: 1}},
+		Outs: []TxOut{
+			{Satoshi: 1000, Script: ftScript(bob, 300)},
+			{Satoshi: 1000, Script: ftScript(alice, 200)},
+			{Satoshi: 48000, Script: P2PKH(alice)},
+		},
+	}
+	e.FullSync()
+	e.Relay(tx)
+
+	codeGenesis := string(contractCodeHash()) + string(genesis)
+	genesisCode := string(genesis) + string(contractCodeHash())
+	size := uint64(tx.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-2000",
+			"mp:cb" + string(alice): "0",
+			"mp:cb" + string(bob):   "1000",
+
+			sbKey(P2PKH(alice)):         "-2000",
+			sbKey(ftScript(alice, 500)): "-1000",
+			sbKey(ftScript(alice, 200)): "1000",
+			sbKey(ftScript(bob, 300)):   "1000",
+		},
+		ZSets: map[string]map[string]float64{
+			spentSuKey(P2PKH(alice)):         {Outpoint(issue, 1): confirmedScore(95, 1)},
+			suKey(P2PKH(alice)):              {tx.Outpoint(2): mempoolScore(0)},
+			spentSuKey(ftScript(alice, 500)): {Outpoint(issue, 0): confirmedScore(95, 1)},
+			suKey(ftScript(alice, 200)):      {tx.Outpoint(1): mempoolScore(0)},
+			suKey(ftScript(bob, 300)):        {tx.Outpoint(0): mempoolScore(0)},
+
+			"mp:s:{au" + string(alice) + "}":               {Outpoint(issue, 1): confirmedScore(95, 1)},
+			"mp:{au" + string(alice) + "}":                 {tx.Outpoint(2): mempoolScore(0)},
+			"mp:s:{fu" + string(alice) + "}" + codeGenesis: {Outpoint(issue, 0): confirmedScore(95, 1)},
+			"mp:{fu" + string(alice) + "}" + codeGenesis:   {tx.Outpoint(1): mempoolScore(0)},
+			"mp:{fu" + string(bob) + "}" + codeGenesis:     {tx.Outpoint(0): mempoolScore(0)},
+			"mp:{fb" + genesisCode + "}":                   {string(alice): -300, string(bob): 300},
+			"mp:{fs" + string(alice) + "}":                 {codeGenesis: -300},
+			"mp:{fs" + string(bob) + "}":                   {codeGenesis: 300},
+			"mp:feerate":                                   {tx.Txid(): feeRate(1000, tx)},
+		},
+		Hashes: map[string]map[string]string{
+			"fi" + codeGenesis: {
+				"decimal":    "8",
+				"name":       "Test Token",
+				"symbol":     "TT",
+				"sensibleid": string(genesis),
+			},
+			"mp:pk" + tx.Txid(): packageFields(1, size, 1000, 1, size, 1000),
+			"mp:rk" + tx.Txid(): riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(tx, 0, 51000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: tx.Txid(), Vout: 0, Address: hex.EncodeToString(bob), CodeType: scriptDecoder.CodeType_FT, Value: 300, Satoshi: 1000},
+			{Txid: tx.Txid(), Vout: 1, Address: hex.EncodeToString(alice), CodeType: scriptDecoder.CodeType_FT, Value: 200, Satoshi: 1000},
+			{Txid: tx.Txid(), Vout: 2, Address: hex.EncodeToString(alice), Satoshi: 48000},
+		},
+		TxIns: []TxInRow{
+			{Txid: tx.Txid(), Vin: 0, UTxid: issue, UVout: 0, UHeight: 95, Address: hex.EncodeToString(alice), CodeType: scriptDecoder.CodeType_FT, Value: 500, Satoshi: 1000},
+			{Txid: tx.Txid(), Vin: 1, UTxid: issue, UVout: 1, UHeight: 95, Address: hex.EncodeToString(alice), Satoshi: 50000},
+		},
+	}
+}
+
+// nft转账: 花费已确认的nft和手续费utxo，nft转给他人并找零
+func nftTransfer(t *testing.T, e *Env) *Expect {
+	alice, bob := Pkh("alice"), Pkh("bob")
+	genesis := sensibleId("nft-genesis")
+	issue := FakeTxid("nft-issue")
+	e.SeedUtxo(issue, 0, 96, 2, TxOut{Satoshi: 1000, Script: NFTScript(alice, genesis, 7, 10)})
+	e.SeedUtxo(issue, 1, 96, 2, TxOut{Satoshi: 20000, Script: P2PKH(alice)})
+
+	tx := &Tx{
+		Ins: []TxIn{{Txid: issue, Vout: 0}, {Txid: issue, Vout: 1}},
+		Outs: []TxOut{
+			{Satoshi: 1000, Script: NFTScript(bob, genesis, 7, 10)},
+			{Satoshi: 18500, Script: P2PKH(alice)},
+		},
+	}
+	e.FullSync()
+	e.Relay(tx)
+
+	codeGenesis := string(contractCodeHash()) + string(genesis)
+	genesisCode := string(genesis) + string(contractCodeHash())
+	size := uint64(tx.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-1500",
+			"mp:cb" + string(alice): "-1000",
+			"mp:cb" + string(bob):   "1000",
+
+			sbKey(P2PKH(alice)):                     "-1500",
+			sbKey(NFTScript(alice, genesis, 7, 10)): "-1000",
+			sbKey(NFTScript(bob, genesis, 7, 10)):   "1000",
+		},
+		ZSets: map[string]map[string]float64{
+			spentSuKey(P2PKH(alice)):                     {Outpoint(issue, 1): confirmedScore(96, 2)},
+			suKey(P2PKH(alice)):                          {tx.Outpoint(1): mempoolScore(0)},
+			spentSuKey(NFTScript(alice, genesis, 7, 10)): {Outpoint(issue, 0): confirmedScore(96, 2)},
+			suKey(NFTScript(bob, genesis, 7, 10)):        {tx.Outpoint(0): mempoolScore(0)},
+
+			"mp:s:{au" + string(alice) + "}":               {Outpoint(issue, 1): confirmedScore(96, 2)},
+			"mp:{au" + string(alice) + "}":                 {tx.Outpoint(1): mempoolScore(0)},
+			"mp:s:{nu" + string(alice) + "}" + codeGenesis: {Outpoint(issue, 0): 7},
+			"mp:s:nd" + codeGenesis:                        {Outpoint(issue, 0): 7},
+			"mp:{nu" + string(bob) + "}" + codeGenesis:     {tx.Outpoint(0): 7},
+			"mp:nd" + codeGenesis:                          {tx.Outpoint(0): 7},
+			"mp:{no" + genesisCode + "}":                   {string(alice): -1, string(bob): 1},
+			"mp:{ns" + string(alice) + "}":                 {codeGenesis: -1},
+			"mp:{ns" + string(bob) + "}":                   {codeGenesis: 1},
+			"mp:feerate":                                   {tx.Txid(): feeRate(1500, tx)},
+		},
+		Hashes: map[string]map[string]string{
+			"ni" + codeGenesis: {
+				"metatxid":   string(make([]byte, 32)),
+				"metavout":   "0",
+				"supply":     "10",
+				"sensibleid": string(genesis),
+			},
+			"mp:pk" + tx.Txid(): packageFields(1, size, 1500, 1, size, 1500),
+			"mp:rk" + tx.Txid(): riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(tx, 0, 21000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: tx.Txid(), Vout: 0, Address: hex.EncodeToString(bob), CodeType: scriptDecoder.CodeType_NFT, Value: 7, Satoshi: 1000},
+			{Txid: tx.Txid(), Vout: 1, Address: hex.EncodeToString(alice), Satoshi: 18500},
+		},
+		TxIns: []TxInRow{
+			{Txid: tx.Txid(), Vin: 0, UTxid: issue, UVout: 0, UHeight: 96, Address: hex.EncodeToString(alice), CodeType: scriptDecoder.CodeType_NFT, Value: 7, Satoshi: 1000},
+			{Txid: tx.Txid(), Vin: 1, UTxid: issue, UVout: 1, UHeight: 96, Address: hex.EncodeToString(alice), Satoshi: 20000},
+		},
+	}
+}
+
+// segwit花费: txid不含见证数据，同一批次中子tx按txid花费父tx的输出
+func segwitSpends(t *testing.T, e *Env) *Expect {
+	alice, bob, carol := Pkh("alice"), Pkh("bob"), Pkh("carol")
+	funding := FakeTxid("segwit-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	witness := [][]byte{bytes.Repeat([]byte{0x30}, 71), bytes.Repeat([]byte{0x02}, 33)}
+	parent := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0, Witness: witness}},
+		Outs: []TxOut{{Satoshi: 90000, Script: P2PKH(bob)}, {Satoshi: 9000, Script: P2PKH(alice)}},
+	}
+	child := &Tx{
+		Ins:  []TxIn{{Txid: parent.Txid(), Vout: 0, Witness: witness}},
+		Outs: []TxOut{{Satoshi: 89500, Script: P2PKH(carol)}},
+	}
+	if parent.Txid() == parent.Wtxid() {
+		t.Fatal("segwit txid should differ from wtxid")
+	}
+
+	e.FullSync()
+	e.Relay(parent, child)
+
+	sizeP, sizeC := uint64(parent.VSize()), uint64(child.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-91000",
+			"mp:bl" + string(carol): "89500",
+
+			sbKey(P2PKH(alice)): "-91000",
+			sbKey(P2PKH(carol)): "89500",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(90, 3)},
+			"mp:{au" + string(alice) + "}":   {parent.Outpoint(1): mempoolScore(0)},
+			"mp:{au" + string(carol) + "}":   {child.Outpoint(0): mempoolScore(1)},
+
+			spentSuKey(P2PKH(alice)): {Outpoint(funding, 0): confirmedScore(90, 3)},
+			suKey(P2PKH(alice)):      {parent.Outpoint(1): mempoolScore(0)},
+			suKey(P2PKH(carol)):      {child.Outpoint(0): mempoolScore(1)},
+			"mp:feerate": {
+				parent.Txid(): feeRate(1000, parent),
+				child.Txid():  feeRate(500, child),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + parent.Txid(): packageFields(1, sizeP, 1000, 2, sizeP+sizeC, 1500),
+			"mp:pk" + child.Txid():  packageFields(2, sizeP+sizeC, 1500, 1, sizeC, 500),
+			"mp:rk" + parent.Txid(): riskFields(0, ""),
+			"mp:rk" + child.Txid():  riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(parent, 0, 100000),
+			txRow(child, 1, 90000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: parent.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 90000},
+			{Txid: parent.Txid(), Vout: 1, Address: hex.EncodeToString(alice), Satoshi: 9000},
+			{Txid: child.Txid(), Vout: 0, Address: hex.EncodeToString(carol), Satoshi: 89500},
+		},
+		TxIns: []TxInRow{
+			{Txid: parent.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+			{Txid: child.Txid(), Vin: 0, UTxid: parent.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(bob), Satoshi: 90000},
+		},
+	}
+}
+
+// 无法识别地址的脚本(裸多签、hash锁)只按脚本hash记录，OP_RETURN输出不记录。
+// p2pk由解码器按公钥hash识别为地址，同时按地址记录
+func nonPkhScripts(t *testing.T, e *Env) *Expect {
+	pubKey := func(name string) []byte {
+		return append([]byte{0x02}, hashBytes(FakeTxid(name))...)
+	}
+	p2pk := append(append([]byte{0x21}, pubKey("alice")...), 0xac)
+	multisig := append(append(append(append([]byte{0x51, 0x21}, pubKey("bob")...), 0x21), pubKey("carol")...), 0x52, 0xae)
+	preimage := sha256.Sum256([]byte("secret"))
+	hashLock := append(append([]byte{0xa8, 0x20}, preimage[:]...), 0x87)
+	opReturn := []byte{0x00, 0x6a, 0x04, 't', 'e', 's', 't'}
+
+	funding := FakeTxid("p2pk-funding")
+	e.SeedUtxo(funding, 0, 97, 4, TxOut{Satoshi: 30000, Script: p2pk})
+
+	tx := &Tx{
+		Ins: []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{
+			{Satoshi: 20000, Script: multisig},
+			{Satoshi: 9000, Script: hashLock},
+			{Satoshi: 0, Script: opReturn},
+		},
+	}
+	e.FullSync()
+	e.Relay(tx)
+
+	alice := scriptDecoder.GetHash160(pubKey("alice"))
+	size := uint64(tx.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-30000",
+
+			sbKey(p2pk):     "-30000",
+			sbKey(multisig): "20000",
+			sbKey(hashLock): "9000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(97, 4)},
+
+			spentSuKey(p2pk): {Outpoint(funding, 0): confirmedScore(97, 4)},
+			suKey(multisig):  {tx.Outpoint(0): mempoolScore(0)},
+			suKey(hashLock):  {tx.Outpoint(1): mempoolScore(0)},
+			"mp:feerate":     {tx.Txid(): feeRate(1000, tx)},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + tx.Txid(): packageFields(1, size, 1000, 1, size, 1000),
+			"mp:rk" + tx.Txid(): riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(tx, 0, 30000),
+		},
+		TxOuts: []TxOutRow{
+			// 无法识别的地址记为1字节0
+			{Txid: tx.Txid(), Vout: 0, Address: "00", Satoshi: 20000},
+			{Txid: tx.Txid(), Vout: 1, Address: "00", Satoshi: 9000},
+			{Txid: tx.Txid(), Vout: 2, Address: "00", Satoshi: 0},
+		},
+		TxIns: []TxInRow{
+			{Txid: tx.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 97, Address: hex.EncodeToString(alice), Satoshi: 30000},
+		},
+	}
+}
+
+// 区块中打包了未转发过的双花tx，mempool中的tx及其子tx在确认时被驱逐
+func blockConflict(t *testing.T, e *Env) *Expect {
+	alice, bob, carol, dave := Pkh("alice"), Pkh("bob"), Pkh("carol"), Pkh("dave")
+	funding := FakeTxid("block-conflict-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	a := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+	}
+	b := &Tx{
+		Ins:  []TxIn{{Txid: a.Txid(), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 98000, Script: P2PKH(carol)}},
+	}
+	mined := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99500, Script: P2PKH(dave)}},
+	}
+	e.FullSync()
+	e.Relay(a, b)
+	e.Mine(mined)
+	checkNoMempoolRows(t, e, a.Txid(), b.Txid())
+
+	return &Expect{
+		Strings: map[string]string{
+			// a的输出在同一批次中被b花费，bob的余额未变化
+			"mp:bl" + string(alice): "0",
+			"mp:bl" + string(carol): "0",
+
+			sbKey(P2PKH(alice)): "0",
+			sbKey(P2PKH(carol)): "0",
+		},
+		Hashes: map[string]map[string]string{
+			"mp:evicted": {
+				a.Txid(): task.EvictReasonBlockConflict,
+				b.Txid(): task.EvictReasonAncestor,
+			},
+		},
+		Keys: []string{"mp:evictedtime"},
+	}
+}
+
+// checkNoMempoolRows 被移除的tx在clickhouse各表中不应残留mempool行
+func checkNoMempoolRows(t *testing.T, e *Env, txids ...string) {
+	t.Helper()
+	for _, txid := range txids {
+		for table, n := range e.CK.MempoolRowsOf(txid) {
+			t.Errorf("%s: %d mempool rows left for removed tx %s", table, n, txid)
+		}
+	}
+}
+
+// tx从节点mempool消失后被驱逐，孤儿池和非final池中花费其输出的tx一并驱逐
+func evictPoolDescendants(t *testing.T, e *Env) *Expect {
+	alice, bob := Pkh("alice"), Pkh("bob")
+	funding := FakeTxid("evict-pool-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	a := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 50000, Script: P2PKH(bob)}, {Satoshi: 49000, Script: P2PKH(alice)}},
+	}
+	// 另一个输入的父tx未知
+	orphan := &Tx{
+		Ins:  []TxIn{{Txid: a.Txid(), Vout: 0}, {Txid: FakeTxid("evict-pool-missing"), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 49000, Script: P2PKH(bob)}},
+	}
+	// 锁定到远高于当前的高度
+	nonFinal := &Tx{
+		Ins:      []TxIn{{Txid: a.Txid(), Vout: 1, Sequence: 1}},
+		Outs:     []TxOut{{Satoshi: 48000, Script: P2PKH(alice)}},
+		LockTime: 10000,
+	}
+	e.FullSync()
+	e.Relay(a, orphan, nonFinal)
+	if len(e.Mempool.Orphans.Txs) != 1 || len(e.Mempool.NonFinal.Txs) != 1 {
+		t.Fatal("orphan or non final tx not pooled")
+	}
+
+	if len(e.CK.MempoolRowsOf(a.Txid())) == 0 {
+		t.Fatal("tx not synced to clickhouse")
+	}
+
+	e.Node.RemoveMempoolTx(a.Txid())
+	e.Reconcile()
+	e.Reconcile()
+	if len(e.Mempool.Orphans.Txs) != 0 || len(e.Mempool.NonFinal.Txs) != 0 {
+		t.Fatal("pooled descendants not evicted")
+	}
+	checkNoMempoolRows(t, e, a.Txid())
+
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "0",
+			"mp:bl" + string(bob):   "0",
+
+			sbKey(P2PKH(alice)): "0",
+			sbKey(P2PKH(bob)):   "0",
+		},
+		Hashes: map[string]map[string]string{
+			"mp:evicted": {
+				a.Txid():        task.EvictReasonVanished,
+				orphan.Txid():   task.EvictReasonAncestor,
+				nonFinal.Txid(): task.EvictReasonAncestor,
+			},
+		},
+		Keys: []string{"mp:evictedtime"},
+	}
+}
+
+// 双花tx只同步先收到的一个，被拒绝的tx同样记录风险。先收到的tx被打包后双方的记录一并删除
+func conflictConfirmed(t *testing.T, e *Env) *Expect {
+	alice, bob, carol := Pkh("alice"), Pkh("bob"), Pkh("carol")
+	funding := FakeTxid("conflict-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	a := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+	}
+	b := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99500, Script: P2PKH(carol)}},
+	}
+	e.FullSync()
+	e.Relay(a)
+	e.Relay(b)
+
+	outpoint := utils.OutpointString(Outpoint(funding, 0))
+	if e.Redis.HGet("mp:ds"+a.Txid(), outpoint) != b.Txid() || e.Redis.HGet("mp:ds"+b.Txid(), outpoint) != a.Txid() {
+		t.Fatal("conflict not recorded")
+	}
+	if e.Redis.HGet("mp:rk"+a.Txid(), "reasons") != task.RiskConflict || e.Redis.HGet("mp:rk"+b.Txid(), "score") != "100" {
+		t.Fatal("conflict risk not recorded")
+	}
+
+	e.Mine(a)
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "0",
+			"mp:bl" + string(bob):   "0",
+
+			sbKey(P2PKH(alice)): "0",
+			sbKey(P2PKH(bob)):   "0",
+		},
+	}
+}
+
+// 孤儿tx先收到，后收到的双花tx被拒绝。父tx到达后孤儿tx同步
+func orphanConflict(t *testing.T, e *Env) *Expect {
+	alice, bob, carol := Pkh("alice"), Pkh("bob"), Pkh("carol")
+	funding := FakeTxid("orphan-conflict-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+	e.SeedUtxo(funding, 1, 90, 3, TxOut{Satoshi: 50000, Script: P2PKH(alice)})
+
+	parent := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 1}},
+		Outs: []TxOut{{Satoshi: 49000, Script: P2PKH(bob)}},
+	}
+	orphan := &Tx{
+		Ins:  []TxIn{{Txid: parent.Txid(), Vout: 0}, {Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 148000, Script: P2PKH(carol)}},
+	}
+	second := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+	}
+	e.FullSync()
+	resolved := atomic.LoadUint64(&task.OrphanResolveCount)
+	e.Relay(orphan)
+	e.Relay(second)
+	if len(e.Mempool.Orphans.Txs) != 1 || len(e.Mempool.Index.Entries) != 0 {
+		t.Fatal("conflict with orphan not rejected")
+	}
+	e.Relay(parent)
+	if n := atomic.LoadUint64(&task.OrphanResolveCount) - resolved; n != 1 {
+		t.Fatalf("orphan resolved %d, want 1", n)
+	}
+
+	outpoint := utils.OutpointString(Outpoint(funding, 0))
+	sizeP, sizeO := uint64(parent.VSize()), uint64(orphan.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-150000",
+			"mp:bl" + string(carol): "148000",
+
+			sbKey(P2PKH(alice)): "-150000",
+			sbKey(P2PKH(carol)): "148000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {
+				Outpoint(funding, 0): confirmedScore(90, 3),
+				Outpoint(funding, 1): confirmedScore(90, 3),
+			},
+			"mp:{au" + string(carol) + "}": {orphan.Outpoint(0): mempoolScore(1)},
+
+			spentSuKey(P2PKH(alice)): {
+				Outpoint(funding, 0): confirmedScore(90, 3),
+				Outpoint(funding, 1): confirmedScore(90, 3),
+			},
+			suKey(P2PKH(carol)): {orphan.Outpoint(0): mempoolScore(1)},
+
+			"mp:feerate": {
+				parent.Txid(): feeRate(1000, parent),
+				orphan.Txid(): feeRate(1000, orphan),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:ds" + orphan.Txid(): {outpoint: second.Txid()},
+			"mp:ds" + second.Txid(): {outpoint: orphan.Txid()},
+			"mp:pk" + parent.Txid(): packageFields(1, sizeP, 1000, 2, sizeP+sizeO, 2000),
+			"mp:pk" + orphan.Txid(): packageFields(2, sizeP+sizeO, 2000, 1, sizeO, 1000),
+			"mp:rk" + parent.Txid(): riskFields(0, ""),
+			"mp:rk" + second.Txid(): riskFields(100, task.RiskConflict),
+		},
+		Keys: []string{"mp:rk" + orphan.Txid()},
+		Txs: []TxRow{
+			txRow(parent, 0, 50000),
+			txRow(orphan, 1, 149000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: parent.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 49000},
+			{Txid: orphan.Txid(), Vout: 0, Address: hex.EncodeToString(carol), Satoshi: 148000},
+		},
+		TxIns: []TxInRow{
+			{Txid: parent.Txid(), Vin: 0, UTxid: funding, UVout: 1, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 50000},
+			{Txid: orphan.Txid(), Vin: 0, UTxid: parent.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(bob), Satoshi: 49000},
+			{Txid: orphan.Txid(), Vin: 1, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+		},
+	}
+}
+
+// 同一批次中子tx先于双花tx到达，父tx最后到达。按到达顺序排除双花后再排序，子tx优先
+func conflictBeforeSorting(t *testing.T, e *Env) *Expect {
+	alice, bob, carol := Pkh("alice"), Pkh("bob"), Pkh("carol")
+	funding := FakeTxid("conflict-sorting-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+	e.SeedUtxo(funding, 1, 90, 3, TxOut{Satoshi: 50000, Script: P2PKH(alice)})
+
+	parent := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 1}},
+		Outs: []TxOut{{Satoshi: 49000, Script: P2PKH(bob)}},
+	}
+	child := &Tx{
+		Ins:  []TxIn{{Txid: parent.Txid(), Vout: 0}, {Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 148000, Script: P2PKH(carol)}},
+	}
+	// 排序时无依赖，会排在child之前
+	second := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+	}
+	e.FullSync()
+	e.Relay(child, second, parent)
+	if _, ok := e.Mempool.Index.Entries[second.Txid()]; ok {
+		t.Fatal("later double spend synced")
+	}
+
+	outpoint := utils.OutpointString(Outpoint(funding, 0))
+	sizeP, sizeC := uint64(parent.VSize()), uint64(child.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-150000",
+			"mp:bl" + string(carol): "148000",
+
+			sbKey(P2PKH(alice)): "-150000",
+			sbKey(P2PKH(carol)): "148000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {
+				Outpoint(funding, 0): confirmedScore(90, 3),
+				Outpoint(funding, 1): confirmedScore(90, 3),
+			},
+			"mp:{au" + string(carol) + "}": {child.Outpoint(0): mempoolScore(1)},
+
+			spentSuKey(P2PKH(alice)): {
+				Outpoint(funding, 0): confirmedScore(90, 3),
+				Outpoint(funding, 1): confirmedScore(90, 3),
+			},
+			suKey(P2PKH(carol)): {child.Outpoint(0): mempoolScore(1)},
+
+			"mp:feerate": {
+				parent.Txid(): feeRate(1000, parent),
+				child.Txid():  feeRate(1000, child),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:ds" + child.Txid():  {outpoint: second.Txid()},
+			"mp:ds" + second.Txid(): {outpoint: child.Txid()},
+			"mp:pk" + parent.Txid(): packageFields(1, sizeP, 1000, 2, sizeP+sizeC, 2000),
+			"mp:pk" + child.Txid():  packageFields(2, sizeP+sizeC, 2000, 1, sizeC, 1000),
+			"mp:rk" + parent.Txid(): riskFields(0, ""),
+			"mp:rk" + second.Txid(): riskFields(100, task.RiskConflict),
+		},
+		Keys: []string{"mp:rk" + child.Txid()},
+		Txs: []TxRow{
+			txRow(parent, 0, 50000),
+			txRow(child, 1, 149000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: parent.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 49000},
+			{Txid: child.Txid(), Vout: 0, Address: hex.EncodeToString(carol), Satoshi: 148000},
+		},
+		TxIns: []TxInRow{
+			{Txid: parent.Txid(), Vin: 0, UTxid: funding, UVout: 1, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 50000},
+			{Txid: child.Txid(), Vin: 0, UTxid: parent.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(bob), Satoshi: 49000},
+			{Txid: child.Txid(), Vin: 1, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+		},
+	}
+}
+
+// 全量同步时获取最新区块失败则重试，不按高度0判断tx是否final
+func bestBlockRetry(t *testing.T, e *Env) *Expect {
+	alice, bob := Pkh("alice"), Pkh("bob")
+	funding := FakeTxid("best-block-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	// 锁定到已过去的高度
+	tx := &Tx{
+		Ins:      []TxIn{{Txid: funding, Vout: 0, Sequence: 1}},
+		Outs:     []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+		LockTime: 50,
+	}
+	e.Node.AddMempoolTx(tx)
+	e.Node.FailRpc("getblockcount", 2)
+	e.FullSync()
+	if e.LoadRetries == 0 {
+		t.Fatal("load not retried")
+	}
+	if e.Mempool.BestHeight != e.Node.Height() || len(e.Mempool.NonFinal.Txs) != 0 {
+		t.Fatal("tx judged non final")
+	}
+
+	size := uint64(tx.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-100000",
+			"mp:bl" + string(bob):   "99000",
+
+			sbKey(P2PKH(alice)): "-100000",
+			sbKey(P2PKH(bob)):   "99000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(90, 3)},
+			"mp:{au" + string(bob) + "}":     {tx.Outpoint(0): mempoolScore(0)},
+
+			spentSuKey(P2PKH(alice)): {Outpoint(funding, 0): confirmedScore(90, 3)},
+			suKey(P2PKH(bob)):        {tx.Outpoint(0): mempoolScore(0)},
+
+			"mp:feerate": {tx.Txid(): feeRate(1000, tx)},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + tx.Txid(): packageFields(1, size, 1000, 1, size, 1000),
+			"mp:rk" + tx.Txid(): riskFields(0, ""),
+		},
+		Txs: []TxRow{txRow(tx, 0, 100000)},
+		TxOuts: []TxOutRow{
+			{Txid: tx.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 99000},
+		},
+		TxIns: []TxInRow{
+			{Txid: tx.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+		},
+	}
+}
+
+// 同一批次中子tx先于父tx到达，父tx排在子tx之前，无依赖的tx保持到达顺序
+func dependencySorting(t *testing.T, e *Env) *Expect {
+	alice, bob, carol := Pkh("alice"), Pkh("bob"), Pkh("carol")
+	funding := FakeTxid("sorting-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+	e.SeedUtxo(funding, 1, 90, 3, TxOut{Satoshi: 30000, Script: P2PKH(carol)})
+
+	parent := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+	}
+	child := &Tx{
+		Ins:  []TxIn{{Txid: parent.Txid(), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 98000, Script: P2PKH(carol)}},
+	}
+	other := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 1}},
+		Outs: []TxOut{{Satoshi: 29000, Script: P2PKH(alice)}},
+	}
+	e.FullSync()
+	e.Relay(child, other, parent)
+	if len(e.Mempool.Orphans.Txs) != 0 {
+		t.Fatal("child in the same batch treated as orphan")
+	}
+
+	sizeP, sizeC, sizeO := uint64(parent.VSize()), uint64(child.VSize()), uint64(other.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-71000",
+			"mp:bl" + string(carol): "68000",
+
+			sbKey(P2PKH(alice)): "-71000",
+			sbKey(P2PKH(carol)): "68000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(90, 3)},
+			"mp:s:{au" + string(carol) + "}": {Outpoint(funding, 1): confirmedScore(90, 3)},
+			"mp:{au" + string(alice) + "}":   {other.Outpoint(0): mempoolScore(0)},
+			"mp:{au" + string(carol) + "}":   {child.Outpoint(0): mempoolScore(2)},
+
+			spentSuKey(P2PKH(alice)): {Outpoint(funding, 0): confirmedScore(90, 3)},
+			spentSuKey(P2PKH(carol)): {Outpoint(funding, 1): confirmedScore(90, 3)},
+			suKey(P2PKH(alice)):      {other.Outpoint(0): mempoolScore(0)},
+			suKey(P2PKH(carol)):      {child.Outpoint(0): mempoolScore(2)},
+
+			"mp:feerate": {
+				other.Txid():  feeRate(1000, other),
+				parent.Txid(): feeRate(1000, parent),
+				child.Txid():  feeRate(1000, child),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + other.Txid():  packageFields(1, sizeO, 1000, 1, sizeO, 1000),
+			"mp:pk" + parent.Txid(): packageFields(1, sizeP, 1000, 2, sizeP+sizeC, 2000),
+			"mp:pk" + child.Txid():  packageFields(2, sizeP+sizeC, 2000, 1, sizeC, 1000),
+			"mp:rk" + other.Txid():  riskFields(0, ""),
+			"mp:rk" + parent.Txid(): riskFields(0, ""),
+			"mp:rk" + child.Txid():  riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(other, 0, 30000),
+			txRow(parent, 1, 100000),
+			txRow(child, 2, 99000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: other.Txid(), Vout: 0, Address: hex.EncodeToString(alice), Satoshi: 29000},
+			{Txid: parent.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 99000},
+			{Txid: child.Txid(), Vout: 0, Address: hex.EncodeToString(carol), Satoshi: 98000},
+		},
+		TxIns: []TxInRow{
+			{Txid: other.Txid(), Vin: 0, UTxid: funding, UVout: 1, UHeight: 90, Address: hex.EncodeToString(carol), Satoshi: 30000},
+			{Txid: parent.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+			{Txid: child.Txid(), Vin: 0, UTxid: parent.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(bob), Satoshi: 99000},
+		},
+	}
+}
+
+// 孙tx和子tx先后作为孤儿到达，父tx到达后整条链在同一批次同步
+func orphanChainResolved(t *testing.T, e *Env) *Expect {
+	alice, bob, carol, dave := Pkh("alice"), Pkh("bob"), Pkh("carol"), Pkh("dave")
+	funding := FakeTxid("orphan-chain-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	parent := &Tx{
+		Ins:  []TxIn{{Txid: funding, Vout: 0}},
+		Outs: []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+	}
+	child := &Tx{
+		Ins:  []TxIn{{Txid: parent.Txid(), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 98000, Script: P2PKH(carol)}},
+	}
+	grandchild := &Tx{
+		Ins:  []TxIn{{Txid: child.Txid(), Vout: 0}},
+		Outs: []TxOut{{Satoshi: 97000, Script: P2PKH(dave)}},
+	}
+	e.FullSync()
+	resolved := atomic.LoadUint64(&task.OrphanResolveCount)
+	e.Relay(grandchild)
+	e.Relay(child)
+	if len(e.Mempool.Orphans.Txs) != 2 || len(e.Mempool.Index.Entries) != 0 {
+		t.Fatal("orphans not pooled")
+	}
+	e.Relay(parent)
+	if len(e.Mempool.Orphans.Txs) != 0 {
+		t.Fatal("orphans not resolved")
+	}
+	if n := atomic.LoadUint64(&task.OrphanResolveCount) - resolved; n != 2 {
+		t.Fatalf("orphan resolved %d, want 2", n)
+	}
+
+	sizeP, sizeC, sizeG := uint64(parent.VSize()), uint64(child.VSize()), uint64(grandchild.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-100000",
+			"mp:bl" + string(dave):  "97000",
+
+			sbKey(P2PKH(alice)): "-100000",
+			sbKey(P2PKH(dave)):  "97000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(90, 3)},
+			"mp:{au" + string(dave) + "}":    {grandchild.Outpoint(0): mempoolScore(2)},
+
+			spentSuKey(P2PKH(alice)): {Outpoint(funding, 0): confirmedScore(90, 3)},
+			suKey(P2PKH(dave)):       {grandchild.Outpoint(0): mempoolScore(2)},
+
+			"mp:feerate": {
+				parent.Txid():     feeRate(1000, parent),
+				child.Txid():      feeRate(1000, child),
+				grandchild.Txid(): feeRate(1000, grandchild),
+			},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + parent.Txid():     packageFields(1, sizeP, 1000, 3, sizeP+sizeC+sizeG, 3000),
+			"mp:pk" + child.Txid():      packageFields(2, sizeP+sizeC, 2000, 2, sizeC+sizeG, 2000),
+			"mp:pk" + grandchild.Txid(): packageFields(3, sizeP+sizeC+sizeG, 3000, 1, sizeG, 1000),
+			"mp:rk" + parent.Txid():     riskFields(0, ""),
+			"mp:rk" + child.Txid():      riskFields(0, ""),
+			"mp:rk" + grandchild.Txid(): riskFields(0, ""),
+		},
+		Txs: []TxRow{
+			txRow(parent, 0, 100000),
+			txRow(child, 1, 99000),
+			txRow(grandchild, 2, 98000),
+		},
+		TxOuts: []TxOutRow{
+			{Txid: parent.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 99000},
+			{Txid: child.Txid(), Vout: 0, Address: hex.EncodeToString(carol), Satoshi: 98000},
+			{Txid: grandchild.Txid(), Vout: 0, Address: hex.EncodeToString(dave), Satoshi: 97000},
+		},
+		TxIns: []TxInRow{
+			{Txid: parent.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+			{Txid: child.Txid(), Vin: 0, UTxid: parent.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(bob), Satoshi: 99000},
+			{Txid: grandchild.Txid(), Vin: 0, UTxid: child.Txid(), UVout: 0, UHeight: model.MEMPOOL_HEIGHT, Address: hex.EncodeToString(carol), Satoshi: 98000},
+		},
+	}
+}
+
+// 锁定到高度102的tx在非final池中等待，区块102到达后同步，并记录非final风险
+func nonFinalPromoted(t *testing.T, e *Env) *Expect {
+	alice, bob := Pkh("alice"), Pkh("bob")
+	funding := FakeTxid("non-final-funding")
+	e.SeedUtxo(funding, 0, 90, 3, TxOut{Satoshi: 100000, Script: P2PKH(alice)})
+
+	tx := &Tx{
+		Ins:      []TxIn{{Txid: funding, Vout: 0, Sequence: 1}},
+		Outs:     []TxOut{{Satoshi: 99000, Script: P2PKH(bob)}},
+		LockTime: 102,
+	}
+	e.FullSync()
+	e.Relay(tx)
+	e.Mine()
+	if len(e.Mempool.NonFinal.Txs) != 1 || len(e.Mempool.Index.Entries) != 0 {
+		t.Fatal("tx final before height 102")
+	}
+	e.Mine()
+	if len(e.Mempool.NonFinal.Txs) != 0 {
+		t.Fatal("tx not promoted")
+	}
+
+	size := uint64(tx.VSize())
+	return &Expect{
+		Strings: map[string]string{
+			"mp:bl" + string(alice): "-100000",
+			"mp:bl" + string(bob):   "99000",
+
+			sbKey(P2PKH(alice)): "-100000",
+			sbKey(P2PKH(bob)):   "99000",
+		},
+		ZSets: map[string]map[string]float64{
+			"mp:s:{au" + string(alice) + "}": {Outpoint(funding, 0): confirmedScore(90, 3)},
+			"mp:{au" + string(bob) + "}":     {tx.Outpoint(0): mempoolScore(0)},
+
+			spentSuKey(P2PKH(alice)): {Outpoint(funding, 0): confirmedScore(90, 3)},
+			suKey(P2PKH(bob)):        {tx.Outpoint(0): mempoolScore(0)},
+
+			"mp:feerate": {tx.Txid(): feeRate(1000, tx)},
+		},
+		Hashes: map[string]map[string]string{
+			"mp:pk" + tx.Txid(): packageFields(1, size, 1000, 1, size, 1000),
+			"mp:rk" + tx.Txid(): riskFields(40, task.RiskNonFinal),
+		},
+		Txs: []TxRow{txRow(tx, 0, 100000)},
+		TxOuts: []TxOutRow{
+			{Txid: tx.Txid(), Vout: 0, Address: hex.EncodeToString(bob), Satoshi: 99000},
+		},
+		TxIns: []TxInRow{
+			{Txid: tx.Txid(), Vin: 0, UTxid: funding, UVout: 0, UHeight: 90, Address: hex.EncodeToString(alice), Satoshi: 100000},
+		},
+	}
+}
+
+// suKey 脚本hash的mempool utxo集合
+func suKey(script []byte) string {
+	return "mp:{su" + scriptHash(script) + "}"
+}
+
+// spentSuKey 脚本hash被mempool花费的已确认utxo集合
+func spentSuKey(script []byte) string {
+	return "mp:s:{su" + scriptHash(script) + "}"
+}
+
+// sbKey 脚本hash的余额
+func sbKey(script []byte) string {
+	return "mp:sb" + scriptHash(script)
+}
+
+func scriptHash(script []byte) string {
+	hash := sha256.Sum256(script)
+	return string(hash[:])
+}
+
+// sensibleId 根据名称生成固定的36字节genesis outpoint
+func sensibleId(name string) []byte {
+	hash := sha256.Sum256([]byte(name))
+	return fixedBytes(hash[:], 36)
+}
+
+func contractCodeHash() []byte {
+	return scriptDecoder.GetHash160(contractCode())
+}
+
+// mempoolScore mempool utxo在有序集合中的分值
+func mempoolScore(txIdx uint64) float64 {
+	return float64(model.MEMPOOL_HEIGHT)*1000000000 + float64(txIdx)
+}
+
+// confirmedScore 已确认utxo在有序集合中的分值
+func confirmedScore(height uint32, txIdx uint64) float64 {
+	return float64(height)*1000000000 + float64(txIdx)
+}
+
+func feeRate(fee uint64, tx *Tx) float64 {
+	return float64(fee) / float64(tx.VSize())
+}
+
+// txRow 已知输入金额时tx应有的行
+func txRow(tx *Tx, txIdx uint64, inputsValue uint64) TxRow {
+	outputsValue := uint64(0)
+	for _, out := range tx.Outs {
+		outputsValue += out.Satoshi
+	}
+	return TxRow{
+		Txid:         tx.Txid(),
+		Wtxid:        tx.Wtxid(),
+		TxIdx:        txIdx,
+		InCnt:        uint32(len(tx.Ins)),
+		OutCnt:       uint32(len(tx.Outs)),
+		VSize:        tx.VSize(),
+		InputsValue:  inputsValue,
+		OutputsValue: outputsValue,
+		Fee:          inputsValue - outputsValue,
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// packageFields mp:pk<txid>的字段
+func packageFields(ancestors int, ancestorSize, ancestorFee uint64, descendants int, descendantSize, descendantFee uint64) map[string]string {
+	return map[string]string{
+		"ancestors":       strconv.Itoa(ancestors),
+		"ancestorsize":    strconv.FormatUint(ancestorSize, 10),
+		"ancestorfee":     strconv.FormatUint(ancestorFee, 10),
+		"ancestorfeerate": formatFloat(float64(ancestorFee) / float64(ancestorSize)),
+		"descendants":     strconv.Itoa(descendants),
+		"descendantsize":  strconv.FormatUint(descendantSize, 10),
+		"descendantfee":   strconv.FormatUint(descendantFee, 10),
+	}
+}
+
+// riskFields mp:rk<txid>的字段
+func riskFields(score int, reasons string) map[string]string {
+	return map[string]string{
+		"score":   strconv.Itoa(score),
+		"reasons": reasons,
+	}
+}
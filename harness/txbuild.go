@@ -0,0 +1,225 @@
+package harness
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"satomempool/utils"
+)
+
+// TxIn 花费的outpoint
+type TxIn struct {
+	Txid     string // hex，显示顺序
+	Vout     uint32
+	Sequence uint32   // 为0时使用0xffffffff
+	Witness  [][]byte // 不为空时按segwit格式序列化
+}
+
+type TxOut struct {
+	Satoshi uint64
+	Script  []byte
+}
+
+// Tx 构造测试用的tx，输入不带签名
+type Tx struct {
+	Ins      []TxIn
+	Outs     []TxOut
+	LockTime uint32
+}
+
+// Raw 序列化为rawtx，有见证数据时为BIP144格式
+func (t *Tx) Raw() []byte {
+	return t.serialize(t.HasWitness())
+}
+
+// HasWitness 是否有输入带见证数据
+func (t *Tx) HasWitness() bool {
+	for _, in := range t.Ins {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tx) serialize(witness bool) []byte {
+	buf := new(bytes.Buffer)
+	writeUint32(buf, 1) // version
+	if witness {
+		buf.Write([]byte{0x00, 0x01}) // marker, flag
+	}
+	writeVarInt(buf, uint64(len(t.Ins)))
+	for _, in := range t.Ins {
+		buf.Write(hashBytes(in.Txid))
+		writeUint32(buf, in.Vout)
+		writeVarInt(buf, 1)
+		buf.WriteByte(0x51) // OP_TRUE
+		if in.Sequence == 0 {
+			writeUint32(buf, 0xffffffff)
+		} else {
+			writeUint32(buf, in.Sequence)
+		}
+	}
+	writeVarInt(buf, uint64(len(t.Outs)))
+	for _, out := range t.Outs {
+		var satoshi [8]byte
+		binary.LittleEndian.PutUint64(satoshi[:], out.Satoshi)
+		buf.Write(satoshi[:])
+		writeVarInt(buf, uint64(len(out.Script)))
+		buf.Write(out.Script)
+	}
+	if witness {
+		for _, in := range t.Ins {
+			writeVarInt(buf, uint64(len(in.Witness)))
+			for _, item := range in.Witness {
+				writeVarInt(buf, uint64(len(item)))
+				buf.Write(item)
+			}
+		}
+	}
+	writeUint32(buf, t.LockTime)
+	return buf.Bytes()
+}
+
+func (t *Tx) Hex() string {
+	return hex.EncodeToString(t.Raw())
+}
+
+// Txid 不含见证数据的hash
+func (t *Tx) Txid() string {
+	return utils.HashString(utils.GetHash256(t.serialize(false)))
+}
+
+// Wtxid 整个rawtx的hash
+func (t *Tx) Wtxid() string {
+	return utils.HashString(utils.GetHash256(t.Raw()))
+}
+
+func (t *Tx) Size() uint32 {
+	return uint32(len(t.Raw()))
+}
+
+// VSize 虚拟大小: (不含见证数据的大小*3 + 大小) / 4，向上取整
+func (t *Tx) VSize() uint32 {
+	stripped := uint32(len(t.serialize(false)))
+	return (stripped*3 + t.Size() + 3) / 4
+}
+
+// Outpoint 第vout个输出的outpointKey
+func (t *Tx) Outpoint(vout uint32) string {
+	return Outpoint(t.Txid(), vout)
+}
+
+// Outpoint 返回与model.TxIn.InputOutpointKey相同格式的key: 32字节hash + 4字节vout
+func Outpoint(txid string, vout uint32) string {
+	key := make([]byte, 36)
+	copy(key, hashBytes(txid))
+	binary.LittleEndian.PutUint32(key[32:], vout)
+	return string(key)
+}
+
+// FakeTxid 根据名称生成固定的txid，用于不需要rawtx的已确认tx
+func FakeTxid(name string) string {
+	return utils.HashString(utils.GetHash256([]byte(name)))
+}
+
+// Pkh 根据名称生成固定的20字节地址
+func Pkh(name string) []byte {
+	hash := sha256.Sum256([]byte(name))
+	return hash[:20]
+}
+
+// P2PKH OP_DUP OP_HASH160 <pkh> OP_EQUALVERIFY OP_CHECKSIG
+func P2PKH(pkh []byte) []byte {
+	script := []byte{0x76, 0xa9, 0x14}
+	script = append(script, pkh...)
+	return append(script, 0x88, 0xac)
+}
+
+// contractCode 合约代码部分，只需足够长且不含OP_RETURN
+func contractCode() []byte {
+	return bytes.Repeat([]byte{0x61}, 1000) // OP_NOP
+}
+
+// FTScript 构造sensible ft v4锁定脚本
+func FTScript(pkh, genesis []byte, amount uint64, name, symbol string, decimal byte) []byte {
+	data := new(bytes.Buffer)
+	data.Write(fixedBytes([]byte(name), 20))
+	data.Write(fixedBytes([]byte(symbol), 10))
+	data.WriteByte(0) // is_genesis
+	data.WriteByte(decimal)
+	data.Write(fixedBytes(pkh, 20))
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], amount)
+	data.Write(value[:])
+	data.Write(fixedBytes(genesis, 36))
+	writeUint32(data, 1) // PROTO_TYPE ft
+	data.WriteString("sensible")
+
+	script := contractCode()
+	script = append(script, 0x6a, 0x4c, byte(data.Len())) // OP_RETURN OP_PUSHDATA1
+	return append(script, data.Bytes()...)
+}
+
+// NFTScript 构造sensible nft v2锁定脚本
+func NFTScript(pkh, sensibleId []byte, tokenIndex, tokenSupply uint64) []byte {
+	data := new(bytes.Buffer)
+	data.Write(make([]byte, 32)) // metaid txid
+	writeUint32(data, 0)         // metaid vout
+	data.WriteByte(0)            // is_genesis
+	data.Write(fixedBytes(pkh, 20))
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], tokenSupply)
+	data.Write(value[:])
+	binary.LittleEndian.PutUint64(value[:], tokenIndex)
+	data.Write(value[:])
+	data.Write(make([]byte, 20)) // genesisHash
+	data.Write(make([]byte, 20)) // rabinPubKeyHashArrayHash
+	data.Write(fixedBytes(sensibleId, 36))
+	writeUint32(data, 3) // PROTO_TYPE nft
+	data.WriteString("sensible")
+
+	script := contractCode()
+	script = append(script, 0x6a, 0x4c, byte(data.Len())) // OP_RETURN OP_PUSHDATA1
+	return append(script, data.Bytes()...)
+}
+
+// hashBytes 显示顺序的txid转为tx中的字节顺序
+func hashBytes(txid string) []byte {
+	hash, err := hex.DecodeString(txid)
+	if err != nil || len(hash) != 32 {
+		panic("bad txid: " + txid)
+	}
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hash
+}
+
+func fixedBytes(data []byte, n int) []byte {
+	buf := make([]byte, n)
+	copy(buf, data)
+	return buf
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeVarInt(buf *bytes.Buffer, v uint64) {
+	switch {
+	case v < 0xfd:
+		buf.WriteByte(byte(v))
+	case v <= 0xffff:
+		buf.WriteByte(0xfd)
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], uint16(v))
+		buf.Write(b[:])
+	default:
+		buf.WriteByte(0xfe)
+		writeUint32(buf, uint32(v))
+	}
+}
@@ -0,0 +1,400 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"satomempool/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 抓包文件记录类型
+const (
+	CaptureRawTx = 1 // rawtx
+	CaptureBlock = 2 // 新块确认通知
+	CaptureRpc   = 3 // mempool主流程调用节点rpc的结果
+)
+
+// 记录头: len(4) + timestamp(8) + type(1)，len为payload长度
+const captureHeaderLen = 4 + 8 + 1
+
+// CaptureMaxPayload 单条记录payload长度上限，超过时不记录，读取时报错
+const CaptureMaxPayload = 256 << 20
+
+var ErrCapturePayloadTooLarge = errors.New("capture payload too large")
+
+// captureRpc CaptureRpc记录的payload
+type captureRpc struct {
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+}
+
+// CaptureRecord 抓包文件中的一条记录
+type CaptureRecord struct {
+	Type      byte
+	Timestamp int64 // 到达时间, unix nano
+	Payload   []byte
+}
+
+// CaptureWriter 将rawtx和新块通知追加写入抓包文件，用于重现问题
+type CaptureWriter struct {
+	f *os.File
+	m sync.Mutex
+}
+
+func NewCaptureWriter(path string) (w *CaptureWriter, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{f: f}, nil
+}
+
+func (w *CaptureWriter) Write(recordType byte, payload []byte) {
+	if len(payload) > CaptureMaxPayload {
+		logger.Log.Info("capture payload too large", zap.Uint8("type", recordType), zap.Int("len", len(payload)))
+		return
+	}
+	buf := make([]byte, captureHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint64(buf[4:], uint64(time.Now().UnixNano()))
+	buf[12] = recordType
+	copy(buf[captureHeaderLen:], payload)
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, err := w.f.Write(buf); err != nil {
+		logger.Log.Info("capture write failed", zap.Error(err))
+	}
+}
+
+func (w *CaptureWriter) WriteRawTx(rawtx []byte) {
+	w.Write(CaptureRawTx, rawtx)
+}
+
+func (w *CaptureWriter) WriteBlock(payload []byte) {
+	w.Write(CaptureBlock, payload)
+}
+
+// WriteRpc 记录一次节点rpc调用的结果
+func (w *CaptureWriter) WriteRpc(method string, result interface{}) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Log.Info("capture rpc marshal failed", zap.String("method", method), zap.Error(err))
+		return
+	}
+	payload, _ := json.Marshal(&captureRpc{Method: method, Result: data})
+	w.Write(CaptureRpc, payload)
+}
+
+func (w *CaptureWriter) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.f.Close()
+}
+
+// ReadCaptureRecord 读取一条记录，文件结束时返回io.EOF，payload长度超过CaptureMaxPayload时返回ErrCapturePayloadTooLarge
+func ReadCaptureRecord(r io.Reader) (rec *CaptureRecord, err error) {
+	header := make([]byte, captureHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	payloadLen := binary.LittleEndian.Uint32(header)
+	if payloadLen > CaptureMaxPayload {
+		return nil, fmt.Errorf("%w: %d", ErrCapturePayloadTooLarge, payloadLen)
+	}
+
+	// 按实际读到的数据扩容，文件截断时不会按记录头一次分配
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, r, int64(payloadLen)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rec = &CaptureRecord{
+		Timestamp: int64(binary.LittleEndian.Uint64(header[4:])),
+		Type:      header[12],
+		Payload:   buf.Bytes(),
+	}
+	return rec, nil
+}
+
+// RecordingSource 记录下层来源的所有rawtx
+type RecordingSource struct {
+	*sourceCloser
+	Source TxSource
+	Writer *CaptureWriter
+}
+
+func NewRecordingSource(source TxSource, w *CaptureWriter) *RecordingSource {
+	return &RecordingSource{
+		sourceCloser: newSourceCloser("record"),
+		Source:       source,
+		Writer:       w,
+	}
+}
+
+// Close 等待下层来源返回，之后不再写入抓包文件
+func (s *RecordingSource) Close() {
+	s.Source.Close()
+	s.sourceCloser.Close()
+}
+
+// Run 不额外缓冲，重放时领先mempool处理进度的rawtx数与抓包时相同
+func (s *RecordingSource) Run(rawtx chan []byte, resync chan string) {
+	defer s.begin()()
+	ch := make(chan []byte)
+	go func() {
+		s.Source.Run(ch, resync)
+		close(ch)
+	}()
+
+	// 关闭后继续取出下层来源的rawtx直到其返回，已记录的tx不再转发
+	for data := range ch {
+		s.Writer.WriteRawTx(data)
+		select {
+		case rawtx <- data:
+		case <-s.quit:
+		}
+	}
+}
+
+// RecordingNode 调用下层节点rpc，并按调用顺序记录结果
+type RecordingNode struct {
+	Node   Node
+	Writer *CaptureWriter
+}
+
+func NewRecordingNode(node Node, w *CaptureWriter) *RecordingNode {
+	return &RecordingNode{
+		Node:   node,
+		Writer: w,
+	}
+}
+
+func (n *RecordingNode) GetBlockCount() int {
+	height := n.Node.GetBlockCount()
+	n.Writer.WriteRpc("getblockcount", height)
+	return height
+}
+
+func (n *RecordingNode) GetBlockHash(height int) string {
+	blockHash := n.Node.GetBlockHash(height)
+	n.Writer.WriteRpc("getblockhash", blockHash)
+	return blockHash
+}
+
+func (n *RecordingNode) GetBlockTxids(blockHash string) []interface{} {
+	txids := n.Node.GetBlockTxids(blockHash)
+	n.Writer.WriteRpc("getblock", txids)
+	return txids
+}
+
+// GetBlockSpent outpointKey为二进制，记录时转为hex
+func (n *RecordingNode) GetBlockSpent(blockHash string) map[string]string {
+	spent := n.Node.GetBlockSpent(blockHash)
+	var recorded map[string]string
+	if spent != nil {
+		recorded = make(map[string]string, len(spent))
+		for key, txid := range spent {
+			recorded[hex.EncodeToString([]byte(key))] = txid
+		}
+	}
+	n.Writer.WriteRpc("getblockspent", recorded)
+	return spent
+}
+
+func (n *RecordingNode) GetBlockMedianTime(blockHash string) int64 {
+	medianTime := n.Node.GetBlockMedianTime(blockHash)
+	n.Writer.WriteRpc("getblockheader", medianTime)
+	return medianTime
+}
+
+func (n *RecordingNode) GetRawMemPool() []interface{} {
+	txids := n.Node.GetRawMemPool()
+	n.Writer.WriteRpc("getrawmempool", txids)
+	return txids
+}
+
+// GetRawTxs 每个rawtx单独记录，避免全量加载时单条记录过大
+func (n *RecordingNode) GetRawTxs(txids []interface{}) [][]byte {
+	rawtxs := n.Node.GetRawTxs(txids)
+	for _, rawtx := range rawtxs {
+		n.Writer.WriteRpc("getrawtransaction", rawtx)
+	}
+	return rawtxs
+}
+
+// CaptureReplaySource 按原始时间间隔重放抓包文件。Speed为加速倍数，0表示不等待。
+// 同时作为mempool的Node，按记录顺序返回抓包时的rpc结果，重放结束后rpc均失败
+type CaptureReplaySource struct {
+	Path  string
+	Speed float64
+
+	BlockNotify chan []byte
+
+	rpc chan *captureRpc
+
+	*sourceCloser
+}
+
+func NewCaptureReplaySource(path string, speed float64, blockNotify chan []byte) *CaptureReplaySource {
+	return &CaptureReplaySource{
+		Path:        path,
+		Speed:       speed,
+		BlockNotify: blockNotify,
+		rpc:         make(chan *captureRpc, 1024),
+
+		sourceCloser: newSourceCloser("capture"),
+	}
+}
+
+func (s *CaptureReplaySource) Run(rawtx chan []byte, resync chan string) {
+	logger.Log.Info("capture replay started", zap.String("path", s.Path), zap.Float64("speed", s.Speed))
+	defer s.begin()()
+	defer close(s.rpc)
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		logger.Log.Info("open capture file failed", zap.Error(err))
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var lastTimestamp int64
+	nTx, nBlock, nRpc := 0, 0, 0
+	for !s.closed() {
+		rec, err := ReadCaptureRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			logger.Log.Info("read capture file failed", zap.Error(err))
+			break
+		}
+
+		// rpc结果由mempool按需取用，不按时间等待
+		if rec.Type == CaptureRpc {
+			call := &captureRpc{}
+			if err := json.Unmarshal(rec.Payload, call); err != nil {
+				logger.Log.Info("capture rpc invalid", zap.Error(err))
+				break
+			}
+			nRpc++
+			select {
+			case s.rpc <- call:
+			case <-s.quit:
+			}
+			continue
+		}
+
+		if s.Speed > 0 && lastTimestamp > 0 && rec.Timestamp > lastTimestamp {
+			if !s.sleep(time.Duration(float64(rec.Timestamp-lastTimestamp) / s.Speed)) {
+				break
+			}
+		}
+		lastTimestamp = rec.Timestamp
+
+		switch rec.Type {
+		case CaptureRawTx:
+			nTx++
+			s.send(rawtx, rec.Payload)
+		case CaptureBlock:
+			nBlock++
+			select {
+			case s.BlockNotify <- rec.Payload:
+			case <-s.quit:
+			}
+		default:
+			logger.Log.Info("unknown capture record", zap.Uint8("type", rec.Type))
+		}
+	}
+	logger.Log.Info("capture replay finished", zap.Int("nTx", nTx), zap.Int("nBlock", nBlock), zap.Int("nRpc", nRpc))
+}
+
+// nextRpc 取出下一条rpc记录解码到result。重放结束、方法与记录不一致时返回false
+func (s *CaptureReplaySource) nextRpc(method string, result interface{}) bool {
+	call, ok := <-s.rpc
+	if !ok {
+		logger.Log.Info("capture rpc exhausted", zap.String("method", method))
+		return false
+	}
+	if call.Method != method {
+		logger.Log.Info("capture rpc mismatch", zap.String("method", method), zap.String("recorded", call.Method))
+		return false
+	}
+	if err := json.Unmarshal(call.Result, result); err != nil {
+		logger.Log.Info("capture rpc result invalid", zap.String("method", method), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+func (s *CaptureReplaySource) GetBlockCount() int {
+	height := -1
+	if !s.nextRpc("getblockcount", &height) {
+		return -1
+	}
+	return height
+}
+
+func (s *CaptureReplaySource) GetBlockHash(height int) string {
+	var blockHash string
+	s.nextRpc("getblockhash", &blockHash)
+	return blockHash
+}
+
+func (s *CaptureReplaySource) GetBlockTxids(blockHash string) []interface{} {
+	var txids []interface{}
+	s.nextRpc("getblock", &txids)
+	return txids
+}
+
+func (s *CaptureReplaySource) GetBlockSpent(blockHash string) map[string]string {
+	var recorded map[string]string
+	if !s.nextRpc("getblockspent", &recorded) || recorded == nil {
+		return nil
+	}
+	spent := make(map[string]string, len(recorded))
+	for keyHex, txid := range recorded {
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			logger.Log.Info("capture rpc result invalid", zap.String("method", "getblockspent"), zap.Error(err))
+			return nil
+		}
+		spent[string(key)] = txid
+	}
+	return spent
+}
+
+func (s *CaptureReplaySource) GetBlockMedianTime(blockHash string) int64 {
+	medianTime := int64(-1)
+	if !s.nextRpc("getblockheader", &medianTime) {
+		return -1
+	}
+	return medianTime
+}
+
+func (s *CaptureReplaySource) GetRawMemPool() []interface{} {
+	var txids []interface{}
+	s.nextRpc("getrawmempool", &txids)
+	return txids
+}
+
+func (s *CaptureReplaySource) GetRawTxs(txids []interface{}) [][]byte {
+	rawtxs := make([][]byte, len(txids))
+	for i := range txids {
+		s.nextRpc("getrawtransaction", &rawtxs[i])
+	}
+	return rawtxs
+}
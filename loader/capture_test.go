@@ -0,0 +1,112 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeNode 固定返回值的节点
+type fakeNode struct{}
+
+func (fakeNode) GetBlockCount() int                           { return 700000 }
+func (fakeNode) GetBlockHash(height int) string               { return "hash" }
+func (fakeNode) GetBlockTxids(blockHash string) []interface{} { return []interface{}{"a", "b"} }
+func (fakeNode) GetBlockSpent(blockHash string) map[string]string {
+	return map[string]string{"\x00\xff": "a"}
+}
+func (fakeNode) GetBlockMedianTime(blockHash string) int64 { return 1600000000 }
+func (fakeNode) GetRawMemPool() []interface{}              { return []interface{}{"a", "b"} }
+func (fakeNode) GetRawTxs(txids []interface{}) [][]byte    { return [][]byte{{1, 2}, nil} }
+
+func captureHeader(payloadLen uint32, recordType byte) []byte {
+	header := make([]byte, captureHeaderLen)
+	binary.LittleEndian.PutUint32(header, payloadLen)
+	header[12] = recordType
+	return header
+}
+
+func TestReadCaptureRecord(t *testing.T) {
+	t.Run("payload too large", func(t *testing.T) {
+		r := bytes.NewReader(captureHeader(CaptureMaxPayload+1, CaptureRawTx))
+		if _, err := ReadCaptureRecord(r); !errors.Is(err, ErrCapturePayloadTooLarge) {
+			t.Fatalf("err = %v, want ErrCapturePayloadTooLarge", err)
+		}
+	})
+
+	t.Run("truncated payload", func(t *testing.T) {
+		data := append(captureHeader(CaptureMaxPayload, CaptureRawTx), 1, 2, 3)
+		if _, err := ReadCaptureRecord(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+			t.Fatalf("err = %v, want io.ErrUnexpectedEOF", err)
+		}
+	})
+
+	t.Run("eof", func(t *testing.T) {
+		if _, err := ReadCaptureRecord(bytes.NewReader(nil)); err != io.EOF {
+			t.Fatalf("err = %v, want io.EOF", err)
+		}
+	})
+}
+
+func TestCaptureReplayNode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.bin")
+	w, err := NewCaptureWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewRecordingNode(fakeNode{}, w)
+	w.WriteRawTx([]byte{0xaa})
+	height := node.GetBlockCount()
+	blockHash := node.GetBlockHash(height)
+	medianTime := node.GetBlockMedianTime(blockHash)
+	txids := node.GetRawMemPool()
+	rawtxs := node.GetRawTxs(txids)
+	w.WriteBlock([]byte("block"))
+	blockTxids := node.GetBlockTxids(blockHash)
+	blockSpent := node.GetBlockSpent(blockHash)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blockNotify := make(chan []byte, 1)
+	replay := NewCaptureReplaySource(path, 0, blockNotify)
+	rawtx := make(chan []byte, 1)
+	go replay.Run(rawtx, make(chan string, 1))
+
+	if got := replay.GetBlockCount(); got != height {
+		t.Errorf("GetBlockCount = %d, want %d", got, height)
+	}
+	if got := replay.GetBlockHash(height); got != blockHash {
+		t.Errorf("GetBlockHash = %q, want %q", got, blockHash)
+	}
+	if got := replay.GetBlockMedianTime(blockHash); got != medianTime {
+		t.Errorf("GetBlockMedianTime = %d, want %d", got, medianTime)
+	}
+	if got := replay.GetRawMemPool(); !reflect.DeepEqual(got, txids) {
+		t.Errorf("GetRawMemPool = %v, want %v", got, txids)
+	}
+	if got := replay.GetRawTxs(txids); !reflect.DeepEqual(got, rawtxs) {
+		t.Errorf("GetRawTxs = %v, want %v", got, rawtxs)
+	}
+	if got := replay.GetBlockTxids(blockHash); !reflect.DeepEqual(got, blockTxids) {
+		t.Errorf("GetBlockTxids = %v, want %v", got, blockTxids)
+	}
+	if got := replay.GetBlockSpent(blockHash); !reflect.DeepEqual(got, blockSpent) {
+		t.Errorf("GetBlockSpent = %v, want %v", got, blockSpent)
+	}
+	if got := <-rawtx; !bytes.Equal(got, []byte{0xaa}) {
+		t.Errorf("rawtx = %x", got)
+	}
+	if got := <-blockNotify; string(got) != "block" {
+		t.Errorf("block = %q", got)
+	}
+
+	// 重放结束后rpc失败
+	if got := replay.GetBlockCount(); got != -1 {
+		t.Errorf("GetBlockCount after end = %d, want -1", got)
+	}
+}
@@ -4,66 +4,59 @@ import (
 	"database/sql"
 	"fmt"
 	"net/url"
+	"satomempool/config"
 	"strconv"
 	"strings"
 
 	_ "github.com/ClickHouse/clickhouse-go"
-	"github.com/spf13/viper"
 )
 
 var (
 	CK *clickhImpl
 )
 
-func init() {
-	viper.SetConfigFile("conf/db.yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		} else {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		}
+// Init 按配置创建clickhouse连接池
+func Init(cfg *config.DBConfig) error {
+	options := map[string]string{
+		"username":                 cfg.Username,
+		"password":                 cfg.Password,
+		"database":                 cfg.Database,
+		"read_timeout":             strconv.Itoa(cfg.ReadTimeout),
+		"write_timeout":            strconv.Itoa(cfg.WriteTimeout),
+		"send_timeout":             strconv.Itoa(cfg.SendTimeout),
+		"receive_timeout":          strconv.Itoa(cfg.ReceiveTimeout),
+		"no_delay":                 fmt.Sprintf("%t", cfg.NoDelay),
+		"connection_open_strategy": cfg.ConnectionOpenStrategy,
+		"block_size":               strconv.Itoa(cfg.BlockSize),
+		"pool_size":                strconv.Itoa(cfg.PoolSize),
+		"debug":                    fmt.Sprintf("%t", cfg.Debug),
 	}
 
-	address := viper.GetString("address")
-
-	config := map[string]string{
-		"username":                 viper.GetString("username"),
-		"password":                 viper.GetString("password"),
-		"database":                 viper.GetString("database"),
-		"read_timeout":             strconv.Itoa(viper.GetInt("read_timeout")),
-		"write_timeout":            strconv.Itoa(viper.GetInt("write_timeout")),
-		"send_timeout":             strconv.Itoa(viper.GetInt("send_timeout")),
-		"receive_timeout":          strconv.Itoa(viper.GetInt("receive_timeout")),
-		"no_delay":                 fmt.Sprintf("%t", viper.GetBool("no_delay")),
-		"connection_open_strategy": viper.GetString("connection_open_strategy"),
-		"block_size":               strconv.Itoa(viper.GetInt("block_size")),
-		"pool_size":                strconv.Itoa(viper.GetInt("pool_size")),
-		"debug":                    fmt.Sprintf("%t", viper.GetBool("debug")),
-	}
-	maxIdleConns := viper.GetInt("maxIdleConns")
-	maxOpenConns := viper.GetInt("maxOpenConns")
-	connMaxLifetime := viper.GetDuration("connMaxLifetime")
-
 	sb := new(strings.Builder)
-	for key, value := range config {
+	for key, value := range options {
 		addit(sb, key, value)
 	}
-	db, err := sql.Open("clickhouse", "tcp://"+address+sb.String())
+	db, err := sql.Open("clickhouse", "tcp://"+cfg.Address+sb.String())
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if maxIdleConns > 0 {
-		db.SetMaxIdleConns(maxIdleConns)
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
 	}
-	if maxOpenConns > 0 {
-		db.SetMaxOpenConns(maxOpenConns)
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
 	}
-	if connMaxLifetime > 0 {
-		db.SetConnMaxLifetime(connMaxLifetime)
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 	}
 
 	CK = &clickhImpl{DB: db}
+	return nil
+}
+
+// InitDB 使用已打开的连接池，如测试中的替身
+func InitDB(db *sql.DB) {
+	CK = newMysql(db)
 }
 
 func addit(sb *strings.Builder, key, val string) {
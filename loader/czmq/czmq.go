@@ -0,0 +1,22 @@
+// Package czmq 基于goczmq(libczmq)建立zmq订阅，仅由main引用，其余包和测试无需cgo
+package czmq
+
+import (
+	"satomempool/loader"
+	"strings"
+
+	"github.com/zeromq/goczmq"
+)
+
+// 接收超时(毫秒)，超时后订阅方检查心跳和关闭
+const rcvtimeo = 1000
+
+// Dial 订阅endpoint的topics。连接为异步建立，断线由订阅方的心跳和序号检测发现
+func Dial(endpoint string, topics []string) (loader.ZmqSocket, error) {
+	sock, err := goczmq.NewSub(endpoint, strings.Join(topics, ","))
+	if err != nil {
+		return nil, err
+	}
+	sock.SetRcvtimeo(rcvtimeo)
+	return sock, nil
+}
@@ -0,0 +1,63 @@
+package loader
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"satomempool/logger"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// FileSource 从文件重放rawtx，每行一个hex编码的rawtx
+type FileSource struct {
+	Path string
+
+	*sourceCloser
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{
+		Path: path,
+
+		sourceCloser: newSourceCloser("file"),
+	}
+}
+
+func (s *FileSource) Run(rawtx chan []byte, resync chan string) {
+	defer s.begin()()
+	logger.Log.Info("file replay started", zap.String("path", s.Path))
+	f, err := os.Open(s.Path)
+	if err != nil {
+		logger.Log.Info("open replay file failed", zap.Error(err))
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// 单个tx可能很大
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024*1024)
+
+	n, lineNum := 0, 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		data, err := hex.DecodeString(line)
+		if err != nil {
+			logger.Log.Info("replay rawtx hex err", zap.Int("line", lineNum), zap.Error(err))
+			continue
+		}
+		n++
+		if !s.send(rawtx, data) {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Log.Info("read replay file failed", zap.Error(err))
+	}
+	logger.Log.Info("file replay finished", zap.Int("nTx", n))
+}
@@ -0,0 +1,30 @@
+package loader
+
+// Node mempool主流程使用的节点rpc，失败时的返回值与对应的*RPC函数相同。
+// 抓包时记录每次调用的结果，重放时按记录顺序返回
+type Node interface {
+	GetBlockCount() int
+	GetBlockHash(height int) string
+	GetBlockTxids(blockHash string) []interface{}
+	GetBlockSpent(blockHash string) map[string]string
+	GetBlockMedianTime(blockHash string) int64
+	GetRawMemPool() []interface{}
+	GetRawTxs(txids []interface{}) [][]byte
+}
+
+var (
+	_ Node = RpcNode{}
+	_ Node = (*RecordingNode)(nil)
+	_ Node = (*CaptureReplaySource)(nil)
+)
+
+// RpcNode 直接调用节点rpc
+type RpcNode struct{}
+
+func (RpcNode) GetBlockCount() int                               { return GetBlockCountRPC() }
+func (RpcNode) GetBlockHash(height int) string                   { return GetBlockHashRPC(height) }
+func (RpcNode) GetBlockTxids(blockHash string) []interface{}     { return GetBlockTxidsRPC(blockHash) }
+func (RpcNode) GetBlockSpent(blockHash string) map[string]string { return GetBlockSpentRPC(blockHash) }
+func (RpcNode) GetBlockMedianTime(blockHash string) int64        { return GetBlockMedianTimeRPC(blockHash) }
+func (RpcNode) GetRawMemPool() []interface{}                     { return GetRawMemPoolRPC() }
+func (RpcNode) GetRawTxs(txids []interface{}) [][]byte           { return GetRawTxsRPC(txids) }
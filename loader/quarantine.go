@@ -0,0 +1,43 @@
+package loader
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"satomempool/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// QuarantineWriter 将解析失败的rawtx追加写入隔离文件。
+// 格式与file来源相同，每个rawtx前有一行注释记录时间和错误，可直接重放
+type QuarantineWriter struct {
+	f *os.File
+	m sync.Mutex
+}
+
+func NewQuarantineWriter(path string) (w *QuarantineWriter, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &QuarantineWriter{f: f}, nil
+}
+
+func (w *QuarantineWriter) Write(rawtx []byte, reason error) {
+	line := fmt.Sprintf("# %s %v\n%s\n", time.Now().Format(time.RFC3339), reason, hex.EncodeToString(rawtx))
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if _, err := w.f.WriteString(line); err != nil {
+		logger.Log.Info("quarantine write failed", zap.Error(err))
+	}
+}
+
+func (w *QuarantineWriter) Close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.f.Close()
+}
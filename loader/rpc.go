@@ -1,35 +1,48 @@
 package loader
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"satomempool/config"
 	"satomempool/logger"
+	"satomempool/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/spf13/viper"
 	"github.com/ybbus/jsonrpc/v2"
 	"go.uber.org/zap"
 )
 
-var rpcClient jsonrpc.RPCClient
+var (
+	rpcClient jsonrpc.RPCClient
+	rpcURL    string
+	rpcAuth   string
 
-func init() {
-	viper.SetConfigFile("conf/chain.yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		} else {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		}
-	}
+	rpcBatchSize int // 批量请求每批tx数量
+	rpcWorkers   int // 批量请求并发数
+	rpcRetry     int // 失败tx的重试轮数
+)
 
-	rpcAddress := viper.GetString("rpc")
-	rpcAuth := viper.GetString("rpc_auth")
-	rpcClient = jsonrpc.NewClientWithOpts(rpcAddress, &jsonrpc.RPCClientOpts{
+// Init 按配置创建节点rpc客户端
+func Init(cfg *config.ChainConfig) {
+	rpcClient = jsonrpc.NewClientWithOpts(cfg.Rpc, &jsonrpc.RPCClientOpts{
 		CustomHeaders: map[string]string{
-			"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(rpcAuth)),
+			"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.RpcAuth)),
 		},
 	})
+
+	rpcURL = cfg.Rpc
+	rpcAuth = cfg.RpcAuth
+	rpcBatchSize = cfg.RpcBatchSize
+	rpcWorkers = cfg.RpcWorkers
+	rpcRetry = cfg.RpcRetry
 }
 
 func GetRawMemPoolRPC() []interface{} {
@@ -64,6 +77,10 @@ func GetRawTxRPC(txid interface{}) []byte {
 		return nil
 	}
 
+	return decodeRawTx(response)
+}
+
+func decodeRawTx(response *jsonrpc.RPCResponse) []byte {
 	rawtxString, ok := response.Result.(string)
 	if !ok {
 		logger.Log.Info("mempool entry not string")
@@ -78,3 +95,259 @@ func GetRawTxRPC(txid interface{}) []byte {
 
 	return rawtx
 }
+
+// GetRawTxsRPC 并发批量获取rawtx，结果顺序与txids一致，获取失败的为nil
+func GetRawTxsRPC(txids []interface{}) [][]byte {
+	rawtxs := make([][]byte, len(txids))
+	pending := make([]int, len(txids))
+	for i := range txids {
+		pending[i] = i
+	}
+
+	for round := 0; round <= rpcRetry && len(pending) > 0; round++ {
+		if round > 0 {
+			logger.Log.Info("retry getrawtransaction", zap.Int("round", round), zap.Int("nFailed", len(pending)))
+			time.Sleep(time.Second)
+		}
+		fetchRawTxsBatch(txids, pending, rawtxs)
+
+		failed := make([]int, 0)
+		for _, idx := range pending {
+			if rawtxs[idx] == nil {
+				failed = append(failed, idx)
+			}
+		}
+		pending = failed
+	}
+
+	if len(pending) > 0 {
+		logger.Log.Info("getrawtransaction failed", zap.Int("nFailed", len(pending)))
+	}
+	return rawtxs
+}
+
+// fetchRawTxsBatch 将pending按批分给worker请求，结果写入rawtxs对应位置
+func fetchRawTxsBatch(txids []interface{}, pending []int, rawtxs [][]byte) {
+	batches := make(chan []int, rpcWorkers)
+	go func() {
+		for start := 0; start < len(pending); start += rpcBatchSize {
+			end := start + rpcBatchSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			batches <- pending[start:end]
+		}
+		close(batches)
+	}()
+
+	var nDone int64
+	lastLog := time.Now()
+	var logMutex sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < rpcWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				requests := make(jsonrpc.RPCRequests, len(batch))
+				for i, idx := range batch {
+					requests[i] = jsonrpc.NewRequest("getrawtransaction", txids[idx])
+				}
+
+				responses, err := rpcClient.CallBatch(requests)
+				if err != nil {
+					logger.Log.Info("batch call failed", zap.Int("nTx", len(batch)), zap.Error(err))
+				} else {
+					for _, response := range responses {
+						if response.ID < 0 || response.ID >= len(batch) {
+							continue
+						}
+						if response.Error != nil {
+							logger.Log.Info("Receive remote return", zap.Any("txid", txids[batch[response.ID]]), zap.Any("error", response.Error))
+							continue
+						}
+						rawtxs[batch[response.ID]] = decodeRawTx(response)
+					}
+				}
+
+				done := atomic.AddInt64(&nDone, int64(len(batch)))
+				logMutex.Lock()
+				if time.Since(lastLog) > 5*time.Second {
+					lastLog = time.Now()
+					logger.Log.Info("getrawtransaction progress", zap.Int64("done", done), zap.Int("total", len(pending)))
+				}
+				logMutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// GetBlockCountRPC 获取节点最新高度，失败返回-1
+func GetBlockCountRPC() int {
+	response, err := rpcClient.Call("getblockcount")
+	if err != nil {
+		logger.Log.Info("call failed", zap.Error(err))
+		return -1
+	}
+
+	if response.Error != nil {
+		logger.Log.Info("Receive remote return", zap.Any("response", response))
+		return -1
+	}
+
+	height, err := response.GetInt()
+	if err != nil {
+		logger.Log.Info("blockcount not int", zap.Any("response", response.Result))
+		return -1
+	}
+	return int(height)
+}
+
+// PingRPC 调用getblockcount检查节点rpc是否可用，ctx取消或超时时立即返回
+func PingRPC(ctx context.Context) error {
+	body := strings.NewReader(`{"jsonrpc":"2.0","method":"getblockcount","params":[],"id":0}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rpcURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(rpcAuth)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Result *int64            `json:"result"`
+		Error  *jsonrpc.RPCError `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("getblockcount: http %d: %w", resp.StatusCode, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("getblockcount: %s", response.Error.Message)
+	}
+	if response.Result == nil {
+		return errors.New("getblockcount: no result")
+	}
+	return nil
+}
+
+// GetBlockHashRPC 获取指定高度的区块hash，失败返回空
+func GetBlockHashRPC(height int) string {
+	response, err := rpcClient.Call("getblockhash", height)
+	if err != nil {
+		logger.Log.Info("call failed", zap.Error(err))
+		return ""
+	}
+
+	if response.Error != nil {
+		logger.Log.Info("Receive remote return", zap.Any("response", response))
+		return ""
+	}
+
+	blockHash, ok := response.Result.(string)
+	if !ok {
+		logger.Log.Info("blockhash not string", zap.Any("response", response.Result))
+		return ""
+	}
+	return blockHash
+}
+
+// GetBlockTxidsRPC 获取区块内所有txid，按区块内顺序
+func GetBlockTxidsRPC(blockHash string) []interface{} {
+	response, err := rpcClient.Call("getblock", blockHash, 1)
+	if err != nil {
+		logger.Log.Info("call failed", zap.Error(err))
+		return nil
+	}
+
+	if response.Error != nil {
+		logger.Log.Info("Receive remote return", zap.Any("response", response))
+		return nil
+	}
+
+	block, ok := response.Result.(map[string]interface{})
+	if !ok {
+		logger.Log.Info("block not object", zap.String("blkid", blockHash))
+		return nil
+	}
+	txids, ok := block["tx"].([]interface{})
+	if !ok {
+		logger.Log.Info("block tx not list", zap.String("blkid", blockHash))
+		return nil
+	}
+	return txids
+}
+
+// GetBlockSpentRPC 获取区块内所有tx花费的outpoint，outpointKey -> 花费的txid。失败返回nil
+func GetBlockSpentRPC(blockHash string) map[string]string {
+	response, err := rpcClient.Call("getblock", blockHash, 2)
+	if err != nil {
+		logger.Log.Info("call failed", zap.Error(err))
+		return nil
+	}
+
+	if response.Error != nil {
+		logger.Log.Info("Receive remote return", zap.Any("response", response))
+		return nil
+	}
+
+	var block struct {
+		Tx []struct {
+			Txid string `json:"txid"`
+			Vin  []struct {
+				Coinbase string `json:"coinbase"`
+				Txid     string `json:"txid"`
+				Vout     uint32 `json:"vout"`
+			} `json:"vin"`
+		} `json:"tx"`
+	}
+	if err := response.GetObject(&block); err != nil {
+		logger.Log.Info("block not object", zap.String("blkid", blockHash), zap.Error(err))
+		return nil
+	}
+
+	spent := make(map[string]string, 0)
+	for _, tx := range block.Tx {
+		for _, vin := range tx.Vin {
+			if vin.Coinbase != "" {
+				continue
+			}
+			key, err := utils.OutpointKey(vin.Txid, vin.Vout)
+			if err != nil {
+				logger.Log.Info("block vin invalid", zap.String("txid", tx.Txid), zap.Error(err))
+				return nil
+			}
+			spent[key] = tx.Txid
+		}
+	}
+	return spent
+}
+
+// GetBlockMedianTimeRPC 获取区块的mediantime，失败返回-1
+func GetBlockMedianTimeRPC(blockHash string) int64 {
+	response, err := rpcClient.Call("getblockheader", blockHash)
+	if err != nil {
+		logger.Log.Info("call failed", zap.Error(err))
+		return -1
+	}
+
+	if response.Error != nil {
+		logger.Log.Info("Receive remote return", zap.Any("response", response))
+		return -1
+	}
+
+	var header struct {
+		MedianTime int64 `json:"mediantime"`
+	}
+	if err := response.GetObject(&header); err != nil {
+		logger.Log.Info("blockheader not object", zap.String("blkid", blockHash), zap.Error(err))
+		return -1
+	}
+	return header.MedianTime
+}
@@ -0,0 +1,81 @@
+package loader
+
+import (
+	"satomempool/logger"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RpcPollSource 定时对比getrawmempool获取新tx，用于节点无法开启zmq的情况
+type RpcPollSource struct {
+	Interval time.Duration
+
+	known map[string]bool
+
+	*sourceCloser
+}
+
+func NewRpcPollSource(interval time.Duration) *RpcPollSource {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &RpcPollSource{
+		Interval: interval,
+
+		sourceCloser: newSourceCloser("rpc"),
+	}
+}
+
+func (s *RpcPollSource) Run(rawtx chan []byte, resync chan string) {
+	defer s.begin()()
+	logger.Log.Info("rpc poll started to listen for txs", zap.Duration("interval", s.Interval))
+	failed := false
+	for !s.closed() {
+		txids := GetRawMemPoolRPC()
+		if txids == nil {
+			// 节点不可用，恢复后需要对账
+			failed = true
+			s.sleep(s.Interval)
+			continue
+		}
+		if failed {
+			failed = false
+			NotifyResync(resync, "rpc poll recovered")
+		}
+
+		current := make(map[string]bool, len(txids))
+		newTxids := make([]interface{}, 0)
+		for _, txid := range txids {
+			txidHex, ok := txid.(string)
+			if !ok {
+				continue
+			}
+			current[txidHex] = true
+			if !s.known[txidHex] {
+				newTxids = append(newTxids, txidHex)
+			}
+		}
+
+		// 新tx批量获取，失败的按rpc_retry重试
+		nNew := 0
+		for i, data := range GetRawTxsRPC(newTxids) {
+			if data == nil {
+				// 可能已被打包或驱逐，下次仍不存在则忽略
+				delete(current, newTxids[i].(string))
+				continue
+			}
+			nNew++
+			if !s.send(rawtx, data) {
+				return
+			}
+		}
+		s.known = current
+
+		if nNew > 0 {
+			logger.Log.Info("rpc poll", zap.Int("nTx", len(current)), zap.Int("nNew", nNew))
+		}
+		s.sleep(s.Interval)
+	}
+	logger.Log.Info("rpc poll closed")
+}
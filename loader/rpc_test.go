@@ -0,0 +1,131 @@
+package loader
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"satomempool/config"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPingRPC(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		body    string
+		delay   time.Duration
+		wantErr string
+	}{
+		{"ok", `{"result":700000,"error":null,"id":0}`, 0, ""},
+		{"rpc error", `{"result":null,"error":{"code":-28,"message":"Loading block index..."},"id":0}`, 0, "Loading block index"},
+		{"no result", `{"result":null,"error":null,"id":0}`, 0, "no result"},
+		{"deadline", `{"result":700000,"error":null,"id":0}`, time.Second, "deadline exceeded"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(c.delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.Write([]byte(c.body))
+			}))
+			defer server.Close()
+			Init(&config.ChainConfig{Rpc: server.URL})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := PingRPC(ctx)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("PingRPC took %s", elapsed)
+			}
+			if c.wantErr == "" {
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("err = %v, want %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// 新tx通过一次批量请求获取，获取失败的tx不发送
+func TestRpcPollSource(t *testing.T) {
+	raws := map[string]string{"aa": "01", "bb": "02", "cc": "03"}
+	var nBatch, nSingle int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+			return
+		}
+		if body[0] != '[' {
+			var req struct{ Method string }
+			json.Unmarshal(body, &req)
+			if req.Method == "getrawmempool" {
+				w.Write([]byte(`{"result":["aa","bb","cc","dd"],"error":null,"id":0}`))
+				return
+			}
+			atomic.AddInt32(&nSingle, 1)
+			w.Write([]byte(`{"result":null,"error":{"code":-5,"message":"unexpected"},"id":0}`))
+			return
+		}
+
+		atomic.AddInt32(&nBatch, 1)
+		var reqs []struct {
+			Params []string
+			ID     int
+		}
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			t.Error(err)
+			return
+		}
+		responses := make([]map[string]interface{}, 0, len(reqs))
+		for _, req := range reqs {
+			if raw, ok := raws[req.Params[0]]; ok {
+				responses = append(responses, map[string]interface{}{"result": raw, "id": req.ID})
+			} else {
+				responses = append(responses, map[string]interface{}{"error": map[string]interface{}{"code": -5, "message": "No such mempool transaction"}, "id": req.ID})
+			}
+		}
+		json.NewEncoder(w).Encode(responses)
+	}))
+	defer server.Close()
+	Init(&config.ChainConfig{Rpc: server.URL, RpcBatchSize: 100, RpcWorkers: 2})
+
+	s := NewRpcPollSource(time.Hour)
+	rawtx := make(chan []byte, 10)
+	go s.Run(rawtx, make(chan string, 1))
+
+	got := make(map[string]bool, 0)
+	for len(got) < len(raws) {
+		select {
+		case data := <-rawtx:
+			got[hex.EncodeToString(data)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("got %d rawtxs, want %d", len(got), len(raws))
+		}
+	}
+	closeWithin(t, s)
+
+	for _, raw := range raws {
+		if !got[raw] {
+			t.Errorf("rawtx %s not sent", raw)
+		}
+	}
+	if len(rawtx) != 0 {
+		t.Errorf("%d unexpected rawtxs", len(rawtx))
+	}
+	if batch, single := atomic.LoadInt32(&nBatch), atomic.LoadInt32(&nSingle); batch != 1 || single != 0 {
+		t.Errorf("%d batch and %d single getrawtransaction calls, want 1 and 0", batch, single)
+	}
+	if s.known["dd"] {
+		t.Error("failed tx marked known")
+	}
+}
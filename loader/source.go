@@ -0,0 +1,89 @@
+package loader
+
+import (
+	"satomempool/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TxSource rawtx来源。Run持续获取rawtx写入rawtx通道，发现可能漏掉tx时写入resync通知全量同步。
+// Close通知Run尽快返回并等待其返回，之后不再写入
+type TxSource interface {
+	Run(rawtx chan []byte, resync chan string)
+	Close()
+}
+
+var (
+	_ TxSource = (*ZmqSubscriber)(nil)
+	_ TxSource = (*RpcPollSource)(nil)
+	_ TxSource = (*FileSource)(nil)
+	_ TxSource = (*RecordingSource)(nil)
+	_ TxSource = (*CaptureReplaySource)(nil)
+)
+
+// sourceCloser 各来源共用的关闭通知
+type sourceCloser struct {
+	name string // 来源名称，用于统计
+	once sync.Once
+	quit chan struct{}
+
+	started int32         // Run是否已开始，原子访问
+	done    chan struct{} // Run返回后关闭
+}
+
+func newSourceCloser(name string) *sourceCloser {
+	return &sourceCloser{
+		name: name,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// begin Run开始时调用，返回的函数在Run返回时调用
+func (c *sourceCloser) begin() (end func()) {
+	atomic.StoreInt32(&c.started, 1)
+	return func() {
+		close(c.done)
+	}
+}
+
+// Close 通知Run返回，并等待已开始的Run返回
+func (c *sourceCloser) Close() {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+	if atomic.LoadInt32(&c.started) == 1 {
+		<-c.done
+	}
+}
+
+func (c *sourceCloser) closed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// send 写入rawtx，已关闭时返回false
+func (c *sourceCloser) send(rawtx chan []byte, data []byte) bool {
+	select {
+	case rawtx <- data:
+		metrics.TxReceived.WithLabelValues(c.name).Inc()
+		return true
+	case <-c.quit:
+		return false
+	}
+}
+
+// sleep 等待d，已关闭时提前返回false
+func (c *sourceCloser) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-c.quit:
+		return false
+	}
+}
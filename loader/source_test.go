@@ -0,0 +1,91 @@
+package loader
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// floodSource 不断发送rawtx直到关闭
+type floodSource struct {
+	*sourceCloser
+	returned chan struct{}
+}
+
+func newFloodSource() *floodSource {
+	return &floodSource{
+		sourceCloser: newSourceCloser("flood"),
+		returned:     make(chan struct{}),
+	}
+}
+
+func (s *floodSource) Run(rawtx chan []byte, resync chan string) {
+	defer s.begin()()
+	defer close(s.returned)
+	for s.send(rawtx, []byte{0x01}) {
+		// 模拟关闭时仍在处理
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+}
+
+func closeWithin(t *testing.T, source TxSource) {
+	t.Helper()
+	closed := make(chan struct{})
+	go func() {
+		source.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close not returned")
+	}
+}
+
+func TestSourceClose(t *testing.T) {
+	t.Run("wait run", func(t *testing.T) {
+		s := newFloodSource()
+		rawtx := make(chan []byte, 1)
+		go s.Run(rawtx, make(chan string, 1))
+		<-rawtx
+
+		closeWithin(t, s)
+		select {
+		case <-s.returned:
+		default:
+			t.Fatal("Close returned before Run")
+		}
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		closeWithin(t, newFloodSource())
+	})
+
+	t.Run("recording", func(t *testing.T) {
+		w, err := NewCaptureWriter(filepath.Join(t.TempDir(), "capture.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inner := newFloodSource()
+		s := NewRecordingSource(inner, w)
+		// 消费方已停止读取
+		rawtx := make(chan []byte)
+		done := make(chan struct{})
+		go func() {
+			s.Run(rawtx, make(chan string, 1))
+			close(done)
+		}()
+		<-rawtx
+
+		closeWithin(t, s)
+		select {
+		case <-done:
+		default:
+			t.Fatal("Close returned before Run")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -1,39 +1,229 @@
 package loader
 
 import (
+	"encoding/binary"
 	"satomempool/logger"
+	"sync/atomic"
+	"time"
 
-	"github.com/zeromq/goczmq"
 	"go.uber.org/zap"
 )
 
-func ZmqNotify(endpoint string, rawtx chan []byte) {
-	logger.Log.Info("ZeroMQ started to listen for txs")
-	subscriber, err := goczmq.NewSub(endpoint, "rawtx")
-	if err != nil {
-		logger.Log.Fatal("ZMQ connect failed", zap.Error(err))
-		return
+// zmq订阅统计，可用于告警
+var (
+	ZmqSeqGapCount   uint64 // 检测到序号跳跃的次数
+	ZmqSeqLostCount  uint64 // 序号跳跃累计丢失的消息数
+	ZmqSeqResetCount uint64 // 检测到序号重置的次数(节点重启)
+
+	ZmqReconnectCount        uint64 // 心跳超时或序号不连续后重新订阅的次数
+	ZmqHeartbeatTimeoutCount uint64 // 心跳超时次数
+
+	ZmqConnected int32 // 当前是否已订阅，原子访问
+	zmqLastPoll  int64 // 订阅循环最近一次接收返回(含超时)的时间, unix nano，原子访问
+)
+
+// ZmqSincePoll 距订阅循环最近一次接收返回的时间，-1为尚未订阅。
+// 订阅期间每个接收超时周期都会更新，用于判断订阅循环是否卡住
+func ZmqSincePoll() time.Duration {
+	last := atomic.LoadInt64(&zmqLastPoll)
+	if last == 0 {
+		return -1
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// ZmqSeqTracker 按topic记录zmq消息序号，检测丢包和重置
+type ZmqSeqTracker struct {
+	seqs map[string]uint32
+}
+
+func NewZmqSeqTracker() *ZmqSeqTracker {
+	return &ZmqSeqTracker{
+		seqs: make(map[string]uint32, 1),
+	}
+}
+
+// Check 检查topic的新序号，返回是否连续。首个消息总是连续
+func (t *ZmqSeqTracker) Check(topic string, seq uint32) (ok bool) {
+	last, exist := t.seqs[topic]
+	t.seqs[topic] = seq
+	if !exist {
+		return true
+	}
+
+	expected := last + 1
+	if seq == expected {
+		return true
+	}
+
+	if seq > expected {
+		atomic.AddUint64(&ZmqSeqGapCount, 1)
+		atomic.AddUint64(&ZmqSeqLostCount, uint64(seq-expected))
+		logger.Log.Info("ZMQ sequence gap",
+			zap.String("topic", topic),
+			zap.Uint32("expected", expected),
+			zap.Uint32("seq", seq),
+			zap.Uint32("lost", seq-expected))
+	} else {
+		atomic.AddUint64(&ZmqSeqResetCount, 1)
+		logger.Log.Info("ZMQ sequence reset",
+			zap.String("topic", topic),
+			zap.Uint32("expected", expected),
+			zap.Uint32("seq", seq))
+	}
+	return false
+}
+
+// ZmqSocket 已建立的zmq订阅。RecvMessage在接收超时后返回错误
+type ZmqSocket interface {
+	RecvMessage() ([][]byte, error)
+	Destroy()
+}
+
+// ZmqDialer 订阅endpoint的topics
+type ZmqDialer func(endpoint string, topics []string) (ZmqSocket, error)
+
+// subscribe的返回原因
+const (
+	zmqClosed           = iota // 已关闭
+	zmqHeartbeatTimeout        // 心跳超时
+	zmqSeqBroken               // 序号不连续
+)
+
+// ZmqSubscriber 带心跳检测和断线重连的zmq订阅
+type ZmqSubscriber struct {
+	Endpoint   string
+	Topics     []string
+	Heartbeat  time.Duration // 超过该时间没有收到消息则重新订阅
+	BackoffMin time.Duration // 重连等待时间下限，连续重连仍收不到消息时指数增加
+	BackoffMax time.Duration // 重连等待时间上限
+
+	dial       ZmqDialer
+	tracker    *ZmqSeqTracker // 跨重连保留，重连期间丢失的消息表现为序号跳跃
+	needResync bool           // 订阅失败后首次收到消息时通知对账
+
+	*sourceCloser
+}
+
+func NewZmqSubscriber(dial ZmqDialer, endpoint string, heartbeat, backoffMin, backoffMax time.Duration) *ZmqSubscriber {
+	if backoffMin <= 0 {
+		backoffMin = time.Second
+	}
+	if backoffMax < backoffMin {
+		backoffMax = backoffMin
 	}
-	defer subscriber.Destroy()
+	return &ZmqSubscriber{
+		Endpoint:   endpoint,
+		Topics:     []string{"rawtx"},
+		Heartbeat:  heartbeat,
+		BackoffMin: backoffMin,
+		BackoffMax: backoffMax,
+		dial:       dial,
+		tracker:    NewZmqSeqTracker(),
 
+		sourceCloser: newSourceCloser("zmq"),
+	}
+}
+
+// Run 持续监听rawtx。心跳超时或序号不连续时重新订阅；序号不连续或订阅失败后恢复接收时，通过resync通知mempool对账
+func (s *ZmqSubscriber) Run(rawtx chan []byte, resync chan string) {
+	defer s.begin()()
+	logger.Log.Info("ZeroMQ started to listen for txs", zap.String("endpoint", s.Endpoint))
+	backoff := s.BackoffMin
 	for {
-		msg, _, err := subscriber.RecvFrame()
+		socket, err := s.dial(s.Endpoint, s.Topics)
 		if err != nil {
-			logger.Log.Info("Error ZMQ RecFrame: %s", zap.Error(err))
+			logger.Log.Info("ZMQ subscribe failed", zap.Error(err))
+			s.needResync = true
+		} else {
+			reason, gotMsg := s.subscribe(socket, rawtx, resync)
+			socket.Destroy()
+			if reason == zmqClosed {
+				logger.Log.Info("ZMQ closed")
+				return
+			}
+			if gotMsg {
+				backoff = s.BackoffMin
+			}
+			atomic.AddUint64(&ZmqReconnectCount, 1)
+			if reason == zmqSeqBroken {
+				// 已通知对账，立即重新订阅
+				continue
+			}
 		}
 
-		if len(msg) == 4 {
-			// id
-			// logger.Log.Info("id: %d, %d", zap.Int("n", n), zap.Int("id", binary.LittleEndian.Uint32(msg)))
+		logger.Log.Info("ZMQ reconnect", zap.Duration("backoff", backoff))
+		if !s.sleep(backoff) {
+			logger.Log.Info("ZMQ closed")
+			return
+		}
+		backoff *= 2
+		if backoff > s.BackoffMax {
+			backoff = s.BackoffMax
+		}
+	}
+}
 
-		} else if len(msg) == 5 || len(msg) == 6 || len(msg) == 9 {
-			// topic
-			// logger.Log.Info("sub received", zap.Int("n", n), zap.String("topic", string(msg)))
+// subscribe 在一次订阅上接收消息，直到关闭、心跳超时或序号不连续。返回原因和期间是否收到过消息
+func (s *ZmqSubscriber) subscribe(socket ZmqSocket, rawtx chan []byte, resync chan string) (reason int, gotMsg bool) {
+	atomic.StoreInt64(&zmqLastPoll, time.Now().UnixNano())
+	atomic.StoreInt32(&ZmqConnected, 1)
+	defer atomic.StoreInt32(&ZmqConnected, 0)
 
-		} else {
-			// rawtx
-			rawtx <- msg
-			// logger.Log.Info("tx received", zap.Int("n", n), zap.Int("rawtxLen", len(msg)))
+	lastRecv := time.Now()
+	for {
+		if s.closed() {
+			return zmqClosed, gotMsg
 		}
+
+		// topic, body, seq
+		msg, err := socket.RecvMessage()
+		atomic.StoreInt64(&zmqLastPoll, time.Now().UnixNano())
+		if err != nil {
+			if s.Heartbeat > 0 && time.Since(lastRecv) > s.Heartbeat {
+				atomic.AddUint64(&ZmqHeartbeatTimeoutCount, 1)
+				logger.Log.Info("ZMQ heartbeat timeout", zap.Duration("silence", time.Since(lastRecv)))
+				return zmqHeartbeatTimeout, gotMsg
+			}
+			continue
+		}
+		lastRecv = time.Now()
+		gotMsg = true
+
+		if s.needResync {
+			// 订阅失败期间的tx需要从节点mempool补齐
+			s.needResync = false
+			NotifyResync(resync, "zmq resubscribed")
+		}
+
+		if len(msg) < 2 {
+			logger.Log.Info("ZMQ message parts invalid", zap.Int("n", len(msg)))
+			continue
+		}
+
+		topic := string(msg[0])
+		seqBroken := false
+		if len(msg) > 2 && len(msg[2]) == 4 {
+			seq := binary.LittleEndian.Uint32(msg[2])
+			if !s.tracker.Check(topic, seq) {
+				NotifyResync(resync, "zmq "+topic+" sequence broken")
+				seqBroken = true
+			}
+		}
+
+		if topic == "rawtx" && !s.send(rawtx, msg[1]) {
+			return zmqClosed, gotMsg
+		}
+		if seqBroken {
+			return zmqSeqBroken, gotMsg
+		}
+	}
+}
+
+// NotifyResync 非阻塞发送全量同步通知，已有未处理的通知时忽略
+func NotifyResync(resync chan string, reason string) {
+	select {
+	case resync <- reason:
+	default:
 	}
 }
@@ -0,0 +1,267 @@
+package loader
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errRecvTimeout = errors.New("recv timeout")
+
+// fakePublisher 模拟节点zmq发布端，每次订阅得到一个新的fakeSocket
+type fakePublisher struct {
+	msgs    chan [][]byte
+	dials   chan *fakeSocket
+	dialErr error
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{
+		msgs:  make(chan [][]byte, 16),
+		dials: make(chan *fakeSocket, 64),
+	}
+}
+
+func (p *fakePublisher) Dial(endpoint string, topics []string) (ZmqSocket, error) {
+	if p.dialErr != nil {
+		err := p.dialErr
+		p.dialErr = nil
+		p.notifyDial(nil)
+		return nil, err
+	}
+	sock := &fakeSocket{msgs: p.msgs, destroyed: make(chan struct{})}
+	p.notifyDial(sock)
+	return sock, nil
+}
+
+func (p *fakePublisher) notifyDial(sock *fakeSocket) {
+	select {
+	case p.dials <- sock:
+	default:
+	}
+}
+
+// Publish 发送multipart消息: topic, body, 4字节小端序号
+func (p *fakePublisher) Publish(topic string, body []byte, seq uint32) {
+	seqBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seqBytes, seq)
+	p.msgs <- [][]byte{[]byte(topic), body, seqBytes}
+}
+
+type fakeSocket struct {
+	msgs      chan [][]byte
+	destroyed chan struct{}
+}
+
+func (s *fakeSocket) RecvMessage() ([][]byte, error) {
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case <-time.After(5 * time.Millisecond):
+		return nil, errRecvTimeout
+	}
+}
+
+func (s *fakeSocket) Destroy() {
+	close(s.destroyed)
+}
+
+func startSubscriber(t *testing.T, pub *fakePublisher, heartbeat time.Duration) (rawtx chan []byte, resync chan string, done chan struct{}) {
+	s := NewZmqSubscriber(pub.Dial, "tcp://fake", heartbeat, time.Millisecond, 10*time.Millisecond)
+	rawtx = make(chan []byte, 16)
+	resync = make(chan string, 1)
+	done = make(chan struct{})
+	go func() {
+		s.Run(rawtx, resync)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return rawtx, resync, done
+}
+
+func waitDial(t *testing.T, pub *fakePublisher) *fakeSocket {
+	t.Helper()
+	select {
+	case sock := <-pub.dials:
+		return sock
+	case <-time.After(time.Second):
+		t.Fatal("no subscribe")
+	}
+	return nil
+}
+
+func recvRawTx(t *testing.T, rawtx chan []byte, want string) {
+	t.Helper()
+	select {
+	case data := <-rawtx:
+		if string(data) != want {
+			t.Fatalf("rawtx = %q, want %q", data, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("rawtx %q not received", want)
+	}
+}
+
+func expectResync(t *testing.T, resync chan string, want string) {
+	t.Helper()
+	select {
+	case reason := <-resync:
+		if reason != want {
+			t.Fatalf("resync = %q, want %q", reason, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resync %q not notified", want)
+	}
+}
+
+func expectNoResync(t *testing.T, resync chan string) {
+	t.Helper()
+	select {
+	case reason := <-resync:
+		t.Fatalf("unexpected resync %q", reason)
+	default:
+	}
+}
+
+func TestZmqSeqTracker(t *testing.T) {
+	tracker := NewZmqSeqTracker()
+	gaps := atomic.LoadUint64(&ZmqSeqGapCount)
+	lost := atomic.LoadUint64(&ZmqSeqLostCount)
+	resets := atomic.LoadUint64(&ZmqSeqResetCount)
+
+	for _, c := range []struct {
+		topic string
+		seq   uint32
+		ok    bool
+	}{
+		{"rawtx", 7, true},
+		{"rawtx", 8, true},
+		{"hashblock", 0, true},
+		{"rawtx", 11, false}, // 丢失9, 10
+		{"rawtx", 12, true},
+		{"rawtx", 0, false}, // 节点重启
+		{"rawtx", 0xffffffff, false},
+		{"rawtx", 0, true}, // 序号回绕
+	} {
+		if ok := tracker.Check(c.topic, c.seq); ok != c.ok {
+			t.Errorf("Check(%s, %d) = %v, want %v", c.topic, c.seq, ok, c.ok)
+		}
+	}
+
+	if n := atomic.LoadUint64(&ZmqSeqGapCount) - gaps; n != 2 {
+		t.Errorf("gap count +%d, want +2", n)
+	}
+	if n := atomic.LoadUint64(&ZmqSeqLostCount) - lost; n != 2+0xfffffffe {
+		t.Errorf("lost count +%d, want +%d", n, 2+0xfffffffe)
+	}
+	if n := atomic.LoadUint64(&ZmqSeqResetCount) - resets; n != 1 {
+		t.Errorf("reset count +%d, want +1", n)
+	}
+}
+
+func TestZmqSubscriber(t *testing.T) {
+	t.Run("sequence gap", func(t *testing.T) {
+		pub := newFakePublisher()
+		rawtx, resync, _ := startSubscriber(t, pub, 0)
+		first := waitDial(t, pub)
+
+		pub.Publish("rawtx", []byte("tx1"), 1)
+		pub.Publish("rawtx", []byte("tx2"), 2)
+		recvRawTx(t, rawtx, "tx1")
+		recvRawTx(t, rawtx, "tx2")
+		expectNoResync(t, resync)
+
+		// 丢失序号3，通知对账并重新订阅
+		pub.Publish("rawtx", []byte("tx4"), 4)
+		recvRawTx(t, rawtx, "tx4")
+		expectResync(t, resync, "zmq rawtx sequence broken")
+		<-first.destroyed
+		waitDial(t, pub)
+
+		// 新订阅上序号连续，不再对账
+		pub.Publish("rawtx", []byte("tx5"), 5)
+		recvRawTx(t, rawtx, "tx5")
+		expectNoResync(t, resync)
+	})
+
+	t.Run("heartbeat timeout", func(t *testing.T) {
+		pub := newFakePublisher()
+		rawtx, resync, _ := startSubscriber(t, pub, 20*time.Millisecond)
+		first := waitDial(t, pub)
+
+		pub.Publish("rawtx", []byte("tx1"), 1)
+		recvRawTx(t, rawtx, "tx1")
+
+		// 长时间无消息只重新订阅，不对账
+		<-first.destroyed
+		waitDial(t, pub)
+		pub.Publish("rawtx", []byte("tx2"), 2)
+		recvRawTx(t, rawtx, "tx2")
+		expectNoResync(t, resync)
+
+		// 重新订阅期间丢失的消息由序号发现
+		pub.Publish("rawtx", []byte("tx5"), 5)
+		recvRawTx(t, rawtx, "tx5")
+		expectResync(t, resync, "zmq rawtx sequence broken")
+	})
+
+	t.Run("subscribe failed", func(t *testing.T) {
+		pub := newFakePublisher()
+		pub.dialErr = errors.New("bad endpoint")
+		rawtx, resync, _ := startSubscriber(t, pub, 0)
+		if sock := waitDial(t, pub); sock != nil {
+			t.Fatal("first subscribe should fail")
+		}
+		waitDial(t, pub)
+
+		// 订阅失败期间可能漏掉tx，恢复接收时对账
+		pub.Publish("rawtx", []byte("tx1"), 1)
+		recvRawTx(t, rawtx, "tx1")
+		expectResync(t, resync, "zmq resubscribed")
+	})
+
+	t.Run("liveness", func(t *testing.T) {
+		pub := newFakePublisher()
+		startSubscriber(t, pub, 0)
+		waitDial(t, pub)
+
+		// 没有tx时订阅循环仍按接收超时更新
+		time.Sleep(20 * time.Millisecond)
+		if atomic.LoadInt32(&ZmqConnected) != 1 {
+			t.Fatal("not connected")
+		}
+		if since := ZmqSincePoll(); since < 0 || since > 50*time.Millisecond {
+			t.Fatalf("since poll = %s", since)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		pub := newFakePublisher()
+		s := NewZmqSubscriber(pub.Dial, "tcp://fake", 0, time.Millisecond, time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			s.Run(make(chan []byte), make(chan string, 1))
+			close(done)
+		}()
+		sock := waitDial(t, pub)
+		s.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Run not returned after Close")
+		}
+		select {
+		case <-sock.destroyed:
+		default:
+			t.Fatal("socket not destroyed")
+		}
+		if atomic.LoadInt32(&ZmqConnected) != 0 {
+			t.Fatal("still connected after close")
+		}
+	})
+}
@@ -1,49 +1,269 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
+	"satomempool/admin"
+	"satomempool/config"
 	"satomempool/loader"
+	"satomempool/loader/clickhouse"
+	"satomempool/loader/czmq"
 	"satomempool/logger"
-	"satomempool/store"
+	"satomempool/metrics"
 	"satomempool/task"
 	"satomempool/task/serial"
+	"satomempool/utils"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
-var (
-	zmqEndpoint string
+// 退出码
+const (
+	exitClean       = 0 // 当前批次同步完毕，连接正常关闭
+	exitCloseFailed = 1 // 关闭连接出错
+	exitBadConfig   = 2 // 配置不合法
+	exitForced      = 3 // 超时或再次收到信号，同步中途退出
 )
 
-func init() {
-	viper.SetConfigFile("conf/chain.yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		} else {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
+// zmqStallTimeout zmq订阅循环超过该时间没有接收返回(每秒至少一次)，就绪检查视为卡住
+const zmqStallTimeout = 10 * time.Second
+
+var confDir = flag.String("conf", "conf", "config directory containing chain.yaml, redis.yaml and db.yaml")
+
+func newTxSource(cfg *config.ChainConfig, mempool *task.Mempool) loader.TxSource {
+	switch cfg.Source {
+	case "rpc":
+		return loader.NewRpcPollSource(cfg.RpcPollInterval)
+	case "file":
+		return loader.NewFileSource(cfg.SourceFile)
+	case "capture":
+		// 全量加载和新块确认同样重放抓包时的rpc结果
+		replay := loader.NewCaptureReplaySource(cfg.SourceFile, cfg.ReplaySpeed, mempool.BlockNotify)
+		mempool.Node = replay
+		return replay
+	case "zmq":
+		return loader.NewZmqSubscriber(czmq.Dial, cfg.Zmq, cfg.ZmqHeartbeat, cfg.ZmqBackoffMin, cfg.ZmqBackoffMax)
+	}
+	panic(fmt.Errorf("unknown tx source: %s", cfg.Source))
+}
+
+// newSinks 按配置创建存储。redis仍用于读取已确认utxo和接收新块通知
+func newSinks(cfg *config.ChainConfig) (sinks []task.Sink) {
+	for _, name := range cfg.Sinks {
+		switch name {
+		case "redis":
+			sinks = append(sinks, &serial.RedisSink{EvictedRetention: cfg.EvictedRetention})
+		case "clickhouse":
+			sinks = append(sinks, &serial.ClickHouseSink{})
+		}
+	}
+	return sinks
+}
+
+// registerMetrics 将各模块已有的统计注册到/metrics
+func registerMetrics(mempool *task.Mempool) {
+	counters := []struct {
+		name  string
+		help  string
+		value *uint64
+	}{
+		{"zmq_seq_gap_total", "ZMQ sequence gaps detected.", &loader.ZmqSeqGapCount},
+		{"zmq_seq_lost_total", "ZMQ messages lost according to sequence gaps.", &loader.ZmqSeqLostCount},
+		{"zmq_seq_reset_total", "ZMQ sequence resets detected.", &loader.ZmqSeqResetCount},
+		{"zmq_reconnect_total", "ZMQ resubscribes after a heartbeat timeout or sequence break.", &loader.ZmqReconnectCount},
+		{"zmq_heartbeat_timeout_total", "ZMQ heartbeat timeouts.", &loader.ZmqHeartbeatTimeoutCount},
+		{"orphan_add_total", "Txs moved to the orphan pool.", &task.OrphanAddCount},
+		{"orphan_resolve_total", "Orphan txs synced after their parents arrived.", &task.OrphanResolveCount},
+		{"orphan_expire_total", "Orphan txs dropped after expiring.", &task.OrphanExpireCount},
+		{"nonfinal_add_total", "Txs moved to the non-final pool.", &task.NonFinalAddCount},
+		{"nonfinal_replace_total", "Non-final txs replaced by a higher sequence version.", &task.NonFinalReplaceCount},
+		{"nonfinal_promote_total", "Non-final txs synced after becoming final.", &task.NonFinalPromoteCount},
+		{"nonfinal_expire_total", "Non-final txs dropped after expiring.", &task.NonFinalExpireCount},
+	}
+	for _, c := range counters {
+		value := c.value
+		metrics.RegisterCounterFunc(c.name, c.help, func() float64 {
+			return float64(atomic.LoadUint64(value))
+		})
+	}
+
+	metrics.RegisterGaugeFunc("orphan_pool_size", "Txs in the orphan pool.", func() float64 {
+		return float64(atomic.LoadInt64(&task.OrphanPoolSize))
+	})
+	metrics.RegisterGaugeFunc("nonfinal_pool_size", "Txs in the non-final pool.", func() float64 {
+		return float64(atomic.LoadInt64(&task.NonFinalPoolSize))
+	})
+	metrics.RegisterGaugeFunc("rawtx_queue_depth", "Raw txs waiting in the source queue.", func() float64 {
+		return float64(len(mempool.RawTxNotify))
+	})
+	metrics.RegisterGaugeFunc("block_queue_depth", "Block notifications waiting in the queue.", func() float64 {
+		return float64(len(mempool.BlockNotify))
+	})
+}
+
+// newAdminServer 就绪检查: 首次全量同步完成，且zmq、redis、clickhouse、节点rpc均可用
+func newAdminServer(cfg *config.ChainConfig, mempool *task.Mempool) *admin.Server {
+	checks := map[string]admin.Check{
+		"redis": serial.PingRedis,
+		"rpc":   loader.PingRPC,
+	}
+	if cfg.HasSink("clickhouse") {
+		checks["clickhouse"] = func(ctx context.Context) error {
+			return clickhouse.CK.PingContext(ctx)
+		}
+	}
+	if cfg.Source == "zmq" {
+		checks["zmq"] = func(ctx context.Context) error {
+			// 心跳超时后重新订阅，期间视为未订阅
+			if atomic.LoadInt32(&loader.ZmqConnected) == 0 {
+				return errors.New("not subscribed")
+			}
+			if since := loader.ZmqSincePoll(); since > zmqStallTimeout {
+				return fmt.Errorf("receive loop stalled for %s", since.Truncate(time.Second))
+			}
+			return nil
 		}
 	}
 
-	zmqEndpoint = viper.GetString("zmq")
+	return &admin.Server{
+		Addr:           cfg.AdminListen,
+		PprofToken:     cfg.AdminPprofToken,
+		Synced:         mempool.Synced,
+		SinceLastTx:    mempool.SinceLastTx,
+		SinceLastBlock: mempool.SinceLastBlock,
+		Checks:         checks,
+	}
 }
 
 func main() {
+	flag.Parse()
+	cfg, err := config.Load(*confDir)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitBadConfig)
+	}
+	chain := cfg.Chain
+
+	// 已校验，按链参数解析tx，日志中按网络的地址版本显示地址
+	utils.SetChain(chain.ChainProfile)
+	loader.Init(chain)
+	serial.Init(cfg.Redis)
+	if chain.HasSink("clickhouse") {
+		if err := clickhouse.Init(cfg.DB); err != nil {
+			fmt.Fprintln(os.Stderr, "open clickhouse:", err)
+			os.Exit(exitBadConfig)
+		}
+	}
+
 	mempool, err := task.NewMempool()
 	if err != nil {
 		logger.Log.Info("init chain error: %v", zap.Error(err))
 		return
 	}
+	mempool.Sinks = newSinks(chain)
+	mempool.IncrementalConfirm = chain.BlockConfirm == "incremental"
+	mempool.MaxConfirmBlocks = chain.BlockConfirmMax
+	mempool.Orphans.Expire = chain.OrphanExpire
+	mempool.NonFinal.Expire = chain.NonFinalExpire
+	mempool.RiskLowFeeRate = chain.RiskLowFeeRate
+	mempool.RiskMaxAncestors = chain.RiskMaxAncestors
+
+	if chain.MetricsListen != "" {
+		registerMetrics(mempool)
+		go metrics.Serve(chain.MetricsListen)
+	}
+	if chain.AdminListen != "" {
+		go newAdminServer(chain, mempool).Serve()
+	}
+	mempool.FeeEstimator.MaxBlocks = chain.FeeHistoryBlocks
+	if chain.FeeStatsInterval > 0 {
+		mempool.FeeStatsTick = time.NewTicker(chain.FeeStatsInterval).C
+	}
+
+	var recorder *loader.CaptureWriter
+	if chain.RecordFile != "" {
+		recorder, err = loader.NewCaptureWriter(chain.RecordFile)
+		if err != nil {
+			logger.Log.Info("open record file error", zap.Error(err))
+			return
+		}
+	}
 
-	// 监听新块确认
+	if chain.QuarantineFile != "" {
+		mempool.Quarantine, err = loader.NewQuarantineWriter(chain.QuarantineFile)
+		if err != nil {
+			logger.Log.Info("open quarantine file error", zap.Error(err))
+			return
+		}
+	}
+
+	// 监听新tx
+	source := newTxSource(chain, mempool)
+	if recorder != nil {
+		source = loader.NewRecordingSource(source, recorder)
+		mempool.Node = loader.NewRecordingNode(mempool.Node, recorder)
+	}
 	go func() {
-		loader.ZmqNotify(zmqEndpoint, mempool.RawTxNotify)
+		source.Run(mempool.RawTxNotify, mempool.ResyncNotify)
 	}()
 
+	// 收到退出信号后停止接收tx，等待当前批次同步完毕
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Log.Info("shutdown requested", zap.String("signal", sig.String()))
+		cancel()
+		source.Close()
+		logger.Log.Info("source closed")
+
+		var timeout <-chan time.Time
+		if chain.ShutdownTimeout > 0 {
+			timeout = time.After(chain.ShutdownTimeout)
+		}
+		select {
+		case sig = <-sigCh:
+			logger.Log.Info("shutdown forced", zap.String("signal", sig.String()))
+		case <-timeout:
+			logger.Log.Info("shutdown timeout", zap.Duration("timeout", chain.ShutdownTimeout))
+		}
+		// 不中断正在进行的存储写入，重启后全量同步
+		mempool.WaitSinks()
+		logger.Log.Info("sinks flushed")
+		logger.SyncLog()
+		os.Exit(exitForced)
+	}()
+
+	if chain.Source != "capture" {
+		// 监听新块确认，重放抓包时新块通知来自抓包文件
+		go func() {
+			for msg := range serial.ChannelBlockSynced {
+				payload := []byte(msg.Payload)
+				if recorder != nil {
+					recorder.WriteBlock(payload)
+				}
+				mempool.BlockNotify <- payload
+			}
+		}()
+
+		// 定时与节点mempool对账，驱逐已消失的tx
+		if chain.ReconcileInterval > 0 {
+			go mempool.ReconcileLoop(chain.ReconcileInterval)
+		}
+	}
+
 	go func() {
 		for {
 			runtime.GC()
@@ -53,41 +273,85 @@ func main() {
 
 	startIdx := 0
 	isFull := true
+	var fullSyncStart time.Time
 	// 扫描区块
-	for {
+	for ctx.Err() == nil {
 		mempool.Init()
 
 		if isFull {
 			logger.Log.Info("full sync...")
+			metrics.FullSyncCount.Inc()
+			fullSyncStart = time.Now()
 			startIdx = 0
 			serial.CleanUtxoMap()
-			serial.FlushdbInRedis()
-
-			// 重新全量同步
-			mempool.LoadFromMempool()
 
 			// 删除mempool数据
-			store.ProcessAllSyncCk()
+			mempool.ResetSinks()
+
+			// 重新全量同步，节点最新区块未知时无法判断tx是否final，稍后重试
+			if !mempool.LoadFromMempool(ctx) {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
 		} else {
-			// 现有追加同步
-			if blockReady := mempool.SyncMempoolFromZmq(); blockReady {
+			// 现有追加同步，新块确认(非增量模式)或zmq丢包时重新全量同步
+			if needFullSync := mempool.SyncMempoolFromZmq(ctx); needFullSync {
 				isFull = true
 				continue
 			}
 		}
 
-		// 初始化同步数据库表
-		store.CreatePartSyncCk()
-		store.PreparePartSyncCk()
-
-		// 开始同步mempool
-		mempool.ParseMempool(startIdx)
+		// 开始同步mempool，退出时丢弃尚未写入的批次，重启后全量同步会补齐
+		if !mempool.ParseMempool(ctx, startIdx) {
+			break
+		}
 
 		startIdx += len(mempool.BatchTxs)
+		metrics.GlobalNewUtxoSize.Set(float64(len(serial.GlobalNewUtxoDataMap)))
+		if isFull {
+			metrics.FullSyncDuration.Observe(time.Since(fullSyncStart).Seconds())
+			mempool.SetSynced()
+		}
 
 		// 同步完毕
 		logger.Log.Info("finished.", zap.Int("idx", startIdx), zap.Int("nNewTx", len(mempool.BatchTxs)))
 
 		isFull = false
 	}
+
+	// 等待来源返回，之后不再写入抓包文件
+	source.Close()
+	os.Exit(shutdown(recorder, mempool.Quarantine))
+}
+
+// shutdown 关闭redis、clickhouse、抓包文件和隔离文件，返回退出码
+func shutdown(recorder *loader.CaptureWriter, quarantine *loader.QuarantineWriter) int {
+	code := exitClean
+	if err := serial.CloseRedis(); err != nil {
+		code = exitCloseFailed
+	}
+	if clickhouse.CK != nil {
+		if err := clickhouse.CK.Close(); err != nil {
+			logger.Log.Info("close clickhouse failed", zap.Error(err))
+			code = exitCloseFailed
+		}
+	}
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			logger.Log.Info("close record file failed", zap.Error(err))
+			code = exitCloseFailed
+		}
+	}
+	if quarantine != nil {
+		if err := quarantine.Close(); err != nil {
+			logger.Log.Info("close quarantine file failed", zap.Error(err))
+			code = exitCloseFailed
+		}
+	}
+	logger.Log.Info("shutdown", zap.Int("code", code))
+	logger.SyncLog()
+	return code
 }
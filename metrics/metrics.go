@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"net/http"
+	"satomempool/logger"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const namespace = "satomempool"
+
+var (
+	// tx接收
+	TxReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tx_received_total",
+		Help:      "Raw txs received, by source.",
+	}, []string{"source"})
+	TxBadRaw = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tx_bad_raw_total",
+		Help:      "Raw txs that failed to parse, by reason.",
+	}, []string{"reason"})
+	TxNonFinal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tx_non_final_total",
+		Help:      "Txs held because they or their parents are not final.",
+	})
+	TxDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tx_duplicate_total",
+		Help:      "Txs skipped because they were already seen.",
+	})
+
+	// 批次同步
+	BatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "batch_txs",
+		Help:      "Txs per ParseMempool batch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	ParseStepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "parse_step_duration_seconds",
+		Help:      "Duration of each ParseMempool step, numbered as in the code.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"step"})
+	TxInUnresolved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "txin_unresolved_total",
+		Help:      "Tx inputs not written to the clickhouse txin table because the spent txo was not found.",
+	})
+	FullSyncCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "full_sync_total",
+		Help:      "Full syncs started.",
+	})
+	FullSyncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "full_sync_duration_seconds",
+		Help:      "Duration of a full sync, from flush to the end of the first batch.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	GlobalNewUtxoSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "global_new_utxo_size",
+		Help:      "Entries in GlobalNewUtxoDataMap after the last batch.",
+	})
+
+	// 存储
+	RedisPipelineCmds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_pipeline_cmds",
+		Help:      "Commands per Redis pipeline, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"op"})
+	RedisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Redis errors, by operation.",
+	}, []string{"op"})
+	ClickHouseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "clickhouse_errors_total",
+		Help:      "ClickHouse errors, by operation (begin, prepare, insert, commit, exec).",
+	}, []string{"op"})
+)
+
+// ObserveStep 记录ParseMempool某一步自start起的耗时
+func ObserveStep(step string, start time.Time) {
+	ParseStepDuration.WithLabelValues(step).Observe(time.Since(start).Seconds())
+}
+
+// RegisterCounterFunc 将已有的计数器注册为counter，fn需并发安全
+func RegisterCounterFunc(name, help string, fn func() float64) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn)
+}
+
+// RegisterGaugeFunc 将已有的状态注册为gauge，fn需并发安全
+func RegisterGaugeFunc(name, help string, fn func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn)
+}
+
+// Serve 在addr上提供/metrics
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	logger.Log.Info("metrics listen", zap.String("addr", addr))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Log.Info("metrics server failed", zap.Error(err))
+	}
+}
@@ -23,6 +23,14 @@ type Tx struct {
 	OutputsValue uint64
 	TxIns        TxIns
 	TxOuts       TxOuts
+
+	VSize          uint32 // 虚拟大小，见证数据按1/4计算，用于手续费率
+	WitnessHashHex string // wtxid，没有见证数据时与HashHex相同
+	WitnessHash    []byte // 32
+
+	Fee           uint64  // 手续费, satoshi
+	FeeRate       float64 // 手续费率, sat/byte
+	FeeUnresolved bool    // 有输入找不到utxo，无法计算手续费
 }
 
 type TxIn struct {
@@ -31,11 +39,14 @@ type TxIn struct {
 	InputVout    uint32
 	ScriptSig    []byte
 	Sequence     uint32
+	Witness      [][]byte // 见证数据
 
 	// other:
 	InputOutpointKey string // 32 + 4
 	InputOutpoint    []byte // 32 + 4
 	InputPoint       []byte // 32 + 4
+
+	SpentTxo *TxoData // 花费的utxo，找不到时为nil
 }
 
 func (t *TxIn) MarshalLogObject(enc zapcore.ObjectEncoder) error {
@@ -99,6 +110,57 @@ func (tt TxOuts) MarshalLogArray(arr zapcore.ArrayEncoder) error {
 	return err
 }
 
+// TxConflict 双花记录，两个tx花费同一个utxo
+type TxConflict struct {
+	OutpointKey string // 32 + 4
+	FirstTxid   string // 先收到的tx
+	SecondTxid  string // 后收到的冲突tx，不计入余额
+}
+
+// TxPackage tx与其未确认祖先/后代的统计，均包含tx自身
+type TxPackage struct {
+	AncestorCount   int
+	AncestorSize    uint64
+	AncestorFee     uint64
+	DescendantCount int
+	DescendantSize  uint64
+	DescendantFee   uint64
+}
+
+// AncestorFeeRate tx及其祖先整体的手续费率(CPFP), sat/byte
+func (p *TxPackage) AncestorFeeRate() float64 {
+	if p.AncestorSize == 0 {
+		return 0
+	}
+	return float64(p.AncestorFee) / float64(p.AncestorSize)
+}
+
+// TxRisk 未确认tx的风险评分，0-100，越高越可能无法确认
+type TxRisk struct {
+	Score   int
+	Reasons []string
+}
+
+// SyncBatch 一批新同步的tx及其utxo变化
+type SyncBatch struct {
+	StartIdx          int
+	Txs               []*Tx
+	SpentUtxoKeysMap  map[string]bool
+	NewUtxoDataMap    map[string]*TxoData // 新产生且未在批次内花费的utxo
+	RemoveUtxoDataMap map[string]*TxoData // 被花费的mempool utxo
+	SpentUtxoDataMap  map[string]*TxoData // 被花费的已确认utxo
+}
+
+// RemoveBatch 已确认或被驱逐的一批tx及其utxo变化
+type RemoveBatch struct {
+	Txids         []string             // hex
+	TxHashes      []string             // 32 bytes
+	UtxoToRestore map[string]*TxoData // 恢复为未花费的mempool utxo
+	UtxoToRemove  map[string]*TxoData // 不再属于mempool的utxo
+	UtxoToSpend   map[string]*TxoData // 未确认子tx改为花费的已确认utxo
+	UtxoToUnspend map[string]*TxoData // 恢复为未花费的已确认utxo
+}
+
 ////////////////
 type TxoData struct {
 	UTxid       []byte
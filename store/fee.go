@@ -0,0 +1,60 @@
+package store
+
+import (
+	"satomempool/loader/clickhouse"
+	"satomempool/logger"
+	"satomempool/metrics"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var sqlFeeHistogram string = "INSERT INTO mempool_fee_histogram (time, height, feerate, ntx, bytes) VALUES (?, ?, ?, ?, ?)"
+
+// FeeHistogramRow 手续费率分布中的一个分桶
+type FeeHistogramRow struct {
+	Time    time.Time
+	Height  uint32
+	FeeRate float64 // 分桶下限, sat/byte
+	NTx     uint64
+	Bytes   uint64
+}
+
+// SaveFeeHistogramCk 保存一次手续费率分布
+func SaveFeeHistogramCk(rows []*FeeHistogramRow) bool {
+	tx, err := clickhouse.CK.Begin()
+	if err != nil {
+		logger.Log.Info("fee-begin", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("begin").Inc()
+		return false
+	}
+	stmt, err := tx.Prepare(sqlFeeHistogram)
+	if err != nil {
+		logger.Log.Info("fee-prepare", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("prepare").Inc()
+		tx.Rollback()
+		return false
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.Exec(
+			row.Time,
+			row.Height,
+			row.FeeRate,
+			row.NTx,
+			row.Bytes,
+		); err != nil {
+			logger.Log.Info("fee-exec", zap.Error(err))
+			metrics.ClickHouseErrors.WithLabelValues("insert").Inc()
+			tx.Rollback()
+			return false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Log.Info("fee-commit", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("commit").Inc()
+		return false
+	}
+	return true
+}
@@ -1,27 +1,46 @@
 package store
 
 import (
+	"encoding/hex"
+	"fmt"
 	"satomempool/loader/clickhouse"
 	"satomempool/logger"
+	"satomempool/metrics"
+	"strings"
 
 	"go.uber.org/zap"
 )
 
 var (
+	createAllSQLs = []string{
+		// mempool tx手续费
+		"CREATE TABLE IF NOT EXISTS blktx_fee (txid String, txsize UInt32, fee UInt64, feerate Float64, unresolved UInt8, height UInt32, txidx UInt64) ENGINE=MergeTree() ORDER BY (height, txid)",
+		// segwit: wtxid和虚拟大小，无见证数据时与txid、txsize相同。追加在末尾，兼容已有表
+		"ALTER TABLE blktx_fee ADD COLUMN IF NOT EXISTS wtxid String",
+		"ALTER TABLE blktx_fee ADD COLUMN IF NOT EXISTS vsize UInt32",
+		// mempool手续费率分布
+		"CREATE TABLE IF NOT EXISTS mempool_fee_histogram (time DateTime, height UInt32, feerate Float64, ntx UInt64, bytes UInt64) ENGINE=MergeTree() ORDER BY (time, feerate)",
+	}
+
 	processAllSQLs = []string{
 		// 删除mempool数据
 		"ALTER TABLE blktx_height DELETE WHERE height >= 4294967295",
+		"ALTER TABLE blktx_fee DELETE WHERE height >= 4294967295",
 		"ALTER TABLE txin_spent DELETE WHERE height >= 4294967295",
 		"ALTER TABLE txin DELETE WHERE height >= 4294967295",
 		"ALTER TABLE txout DELETE WHERE height >= 4294967295",
+		// 旧版本的墓碑表，已不再使用
+		"DROP TABLE IF EXISTS mempool_tx_state",
 	}
 
 	createPartSQLs = []string{
 		"DROP TABLE IF EXISTS blktx_height_mempool_new",
+		"DROP TABLE IF EXISTS blktx_fee_mempool_new",
 		"DROP TABLE IF EXISTS txout_mempool_new",
 		"DROP TABLE IF EXISTS txin_mempool_new",
 
 		"CREATE TABLE IF NOT EXISTS blktx_height_mempool_new AS blktx_height",
+		"CREATE TABLE IF NOT EXISTS blktx_fee_mempool_new AS blktx_fee",
 		"CREATE TABLE IF NOT EXISTS txout_mempool_new AS txout",
 		"CREATE TABLE IF NOT EXISTS txin_mempool_new AS txin",
 	}
@@ -42,18 +61,57 @@ var (
 
 	processPartSQLs = []string{
 		"INSERT INTO blktx_height SELECT * FROM blktx_height_mempool_new;",
+		"INSERT INTO blktx_fee SELECT * FROM blktx_fee_mempool_new;",
 
 		"DROP TABLE IF EXISTS blktx_height_mempool_new",
+		"DROP TABLE IF EXISTS blktx_fee_mempool_new",
 	}
 )
 
 func ProcessAllSyncCk() bool {
-	// if !ProcessSyncCk(createAllSQLs) {
-	// 	return false
-	// }
+	if !ProcessSyncCk(createAllSQLs) {
+		return false
+	}
 	return ProcessSyncCk(processAllSQLs)
 }
 
+// 按txid删除mempool数据
+var processTxsSQLPatterns = []string{
+	"ALTER TABLE blktx_height DELETE WHERE height >= 4294967295 AND txid IN (%s)",
+	"ALTER TABLE blktx_fee DELETE WHERE height >= 4294967295 AND txid IN (%s)",
+	"ALTER TABLE txin_spent DELETE WHERE height >= 4294967295 AND txid IN (%s)",
+	"ALTER TABLE txin DELETE WHERE height >= 4294967295 AND txid IN (%s)",
+	"ALTER TABLE txout DELETE WHERE height >= 4294967295 AND utxid IN (%s)",
+}
+
+// 每条ALTER DELETE中的txid数量
+const deleteTxsBatchSize = 1000
+
+// DeleteMempoolTxsCk 删除已确认或被驱逐的mempool tx数据，txids为tx.Hash原始字节
+func DeleteMempoolTxsCk(txids []string) bool {
+	for start := 0; start < len(txids); start += deleteTxsBatchSize {
+		end := start + deleteTxsBatchSize
+		if end > len(txids) {
+			end = len(txids)
+		}
+
+		values := make([]string, 0, end-start)
+		for _, txid := range txids[start:end] {
+			values = append(values, "unhex('"+hex.EncodeToString([]byte(txid))+"')")
+		}
+		inValues := strings.Join(values, ",")
+
+		processSQLs := make([]string, 0, len(processTxsSQLPatterns))
+		for _, pattern := range processTxsSQLPatterns {
+			processSQLs = append(processSQLs, fmt.Sprintf(pattern, inValues))
+		}
+		if !ProcessSyncCk(processSQLs) {
+			return false
+		}
+	}
+	return true
+}
+
 func CreatePartSyncCk() bool {
 	return ProcessSyncCk(createPartSQLs)
 }
@@ -76,6 +134,7 @@ func ProcessSyncCk(processSQLs []string) bool {
 		}
 		if _, err := clickhouse.CK.Exec(psql); err != nil {
 			logger.Log.Info("sync exec err", zap.String("sql", psql[:partLen]), zap.Error(err))
+			metrics.ClickHouseErrors.WithLabelValues("exec").Inc()
 			return false
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"satomempool/loader/clickhouse"
 	"satomempool/logger"
+	"satomempool/metrics"
 
 	"go.uber.org/zap"
 )
@@ -13,13 +14,16 @@ var (
 	SyncStmtTx    *sql.Stmt
 	SyncStmtTxOut *sql.Stmt
 	SyncStmtTxIn  *sql.Stmt
+	SyncStmtTxFee *sql.Stmt
 
 	syncTxTx    *sql.Tx
 	syncTxTxOut *sql.Tx
 	syncTxTxIn  *sql.Tx
+	syncTxTxFee *sql.Tx
 
 	sqlTxPattern    string = "INSERT INTO %s (txid, nin, nout, txsize, locktime, invalue, outvalue, rawtx, height, blkid, txidx) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	sqlTxOutPattern string = "INSERT INTO %s (utxid, vout, address, codehash, genesis, code_type, data_value, satoshi, script_type, script_pk, height, utxidx) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	sqlTxFeePattern string = "INSERT INTO %s (txid, txsize, fee, feerate, unresolved, height, txidx, wtxid, vsize) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	sqlTxInPattern  string = "INSERT INTO %s (height, txidx, txid, idx, script_sig, nsequence, height_txo, utxidx, utxid, vout, address, codehash, genesis, code_type, data_value, satoshi, script_type, script_pk) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 )
 
@@ -27,45 +31,83 @@ func prepareSyncCk() bool {
 	sqlTx := fmt.Sprintf(sqlTxPattern, "blktx_height_mempool_new")
 	sqlTxOut := fmt.Sprintf(sqlTxOutPattern, "txout_mempool_new")
 	sqlTxIn := fmt.Sprintf(sqlTxInPattern, "txin_mempool_new")
+	sqlTxFee := fmt.Sprintf(sqlTxFeePattern, "blktx_fee_mempool_new")
 
 	var err error
+	syncTxTx, syncTxTxOut, syncTxTxIn, syncTxTxFee = nil, nil, nil, nil
 
 	syncTxTx, err = clickhouse.CK.Begin()
 	if err != nil {
 		logger.Log.Info("sync-begin-tx", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("begin").Inc()
+		rollbackSyncCk()
 		return false
 	}
 	SyncStmtTx, err = syncTxTx.Prepare(sqlTx)
 	if err != nil {
 		logger.Log.Info("sync-prepare-tx", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("prepare").Inc()
+		rollbackSyncCk()
 		return false
 	}
 
 	syncTxTxOut, err = clickhouse.CK.Begin()
 	if err != nil {
 		logger.Log.Info("sync-begin-txout", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("begin").Inc()
+		rollbackSyncCk()
 		return false
 	}
 	SyncStmtTxOut, err = syncTxTxOut.Prepare(sqlTxOut)
 	if err != nil {
 		logger.Log.Info("sync-prepare-txout", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("prepare").Inc()
+		rollbackSyncCk()
 		return false
 	}
 
 	syncTxTxIn, err = clickhouse.CK.Begin()
 	if err != nil {
 		logger.Log.Info("sync-begin-txinfull", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("begin").Inc()
+		rollbackSyncCk()
 		return false
 	}
 	SyncStmtTxIn, err = syncTxTxIn.Prepare(sqlTxIn)
 	if err != nil {
 		logger.Log.Info("sync-prepare-txinfull", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("prepare").Inc()
+		rollbackSyncCk()
+		return false
+	}
+
+	syncTxTxFee, err = clickhouse.CK.Begin()
+	if err != nil {
+		logger.Log.Info("sync-begin-txfee", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("begin").Inc()
+		rollbackSyncCk()
+		return false
+	}
+	SyncStmtTxFee, err = syncTxTxFee.Prepare(sqlTxFee)
+	if err != nil {
+		logger.Log.Info("sync-prepare-txfee", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("prepare").Inc()
+		rollbackSyncCk()
 		return false
 	}
 
 	return true
 }
 
+// rollbackSyncCk 准备失败时回滚已开始的事务，语句随事务关闭
+func rollbackSyncCk() {
+	for _, tx := range []*sql.Tx{syncTxTx, syncTxTxOut, syncTxTxIn, syncTxTxFee} {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}
+}
+
 func PreparePartSyncCk() bool {
 	return prepareSyncCk()
 }
@@ -73,12 +115,19 @@ func PreparePartSyncCk() bool {
 func CommitSyncCk() {
 	defer SyncStmtTx.Close()
 	defer SyncStmtTxOut.Close()
+	defer SyncStmtTxFee.Close()
 
 	if err := syncTxTx.Commit(); err != nil {
 		logger.Log.Info("sync-commit-tx", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("commit").Inc()
 	}
 	if err := syncTxTxOut.Commit(); err != nil {
 		logger.Log.Info("sync-commit-txout", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("commit").Inc()
+	}
+	if err := syncTxTxFee.Commit(); err != nil {
+		logger.Log.Info("sync-commit-txfee", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("commit").Inc()
 	}
 }
 
@@ -92,5 +141,6 @@ func CommitFullSyncCk(needCommit bool) {
 
 	if err := syncTxTxIn.Commit(); err != nil {
 		logger.Log.Info("sync-commit-txinfull", zap.Error(err))
+		metrics.ClickHouseErrors.WithLabelValues("commit").Inc()
 	}
 }
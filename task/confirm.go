@@ -0,0 +1,213 @@
+package task
+
+import (
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/task/serial"
+	"satomempool/utils"
+
+	"go.uber.org/zap"
+)
+
+// ConfirmBlocks 增量处理新确认的区块，只移除其中已同步的mempool tx。失败时返回false，需要全量同步
+func (mp *Mempool) ConfirmBlocks() bool {
+	if mp.BestHeight <= 0 {
+		return false
+	}
+
+	height := mp.Node.GetBlockCount()
+	if height < 0 {
+		return false
+	}
+	if height < mp.BestHeight || height-mp.BestHeight > mp.MaxConfirmBlocks {
+		logger.Log.Info("confirm blocks skip",
+			zap.Int("bestHeight", mp.BestHeight),
+			zap.Int("height", height))
+		return false
+	}
+
+	// 分叉时全量同步
+	if blockHash := mp.Node.GetBlockHash(mp.BestHeight); blockHash != mp.BestHash {
+		logger.Log.Info("confirm blocks reorg",
+			zap.Int("bestHeight", mp.BestHeight),
+			zap.String("bestHash", mp.BestHash),
+			zap.String("blkid", blockHash))
+		return false
+	}
+
+	for h := mp.BestHeight + 1; h <= height; h++ {
+		blockHash := mp.Node.GetBlockHash(h)
+		if blockHash == "" {
+			return false
+		}
+		txids := mp.Node.GetBlockTxids(blockHash)
+		if txids == nil {
+			return false
+		}
+		spent := mp.Node.GetBlockSpent(blockHash)
+		if spent == nil {
+			return false
+		}
+		if !mp.confirmBlockTxs(h, txids, spent) {
+			return false
+		}
+		// mediantime未知时无法判断tx是否final
+		medianTime := mp.Node.GetBlockMedianTime(blockHash)
+		if medianTime <= 0 {
+			return false
+		}
+		mp.BestHeight = h
+		mp.BestHash = blockHash
+		mp.BestMedianTime = uint32(medianTime)
+	}
+	// 孤儿tx的父tx可能已确认
+	mp.Orphans.RetryAll()
+	// 非final的tx可能已final
+	mp.promoteNonFinalTxs()
+	return true
+}
+
+// confirmBlockTxs 撤销区块中已确认tx在mempool中的影响，未确认的子tx改为花费已确认utxo。
+// spent为区块内tx花费的outpoint，与之双花的未确认tx连同子tx一起驱逐
+func (mp *Mempool) confirmBlockTxs(height int, txids []interface{}, spent map[string]string) bool {
+	blockTxs := make(map[string]bool, len(txids))
+	confirmed := make(map[string]uint64, 0) // txid -> 区块内txidx
+	for txIdx, txid := range txids {
+		txidHex, ok := txid.(string)
+		if !ok {
+			continue
+		}
+		blockTxs[txidHex] = true
+		mp.NonFinal.Remove(txidHex)
+		if _, ok := mp.Index.Entries[txidHex]; ok {
+			confirmed[txidHex] = uint64(txIdx)
+		}
+	}
+
+	// 当前批次中尚未同步的已确认tx直接丢弃
+	batchTxs := make([]*model.Tx, 0, len(mp.BatchTxs))
+	for _, tx := range mp.BatchTxs {
+		if blockTxs[tx.HashHex] {
+			delete(mp.Txs, tx.HashHex)
+			continue
+		}
+		batchTxs = append(batchTxs, tx)
+	}
+	nBatchConfirmed := len(mp.BatchTxs) - len(batchTxs)
+	mp.BatchTxs = batchTxs
+
+	mp.FeeEstimator.AddBlock(mp.blockFeeStats(height, txids))
+
+	conflicting := mp.blockConflictTxs(blockTxs, spent)
+
+	utxoToRemove := make(map[string]*model.TxoData, 0)
+	utxoToSpend := make(map[string]*model.TxoData, 0)
+	utxoToUnspend := make(map[string]*model.TxoData, 0)
+	txHashes := make([]string, 0, len(confirmed))
+	txidHexes := make([]string, 0, len(confirmed))
+	for txid, txIdx := range confirmed {
+		entry := mp.Index.Entries[txid]
+		txHashes = append(txHashes, string(entry.Tx.Hash))
+		txidHexes = append(txidHexes, txid)
+
+		for _, input := range entry.Tx.TxIns {
+			if input.SpentTxo == nil || input.SpentTxo.BlockHeight == model.MEMPOOL_HEIGHT {
+				continue
+			}
+			// 花费的已确认utxo已在区块中花费
+			utxoToUnspend[input.InputOutpointKey] = input.SpentTxo
+		}
+
+		for _, output := range entry.Tx.TxOuts {
+			key := output.OutpointKey
+			if spender, ok := mp.Index.Spenders[key]; ok {
+				if _, ok := confirmed[spender]; ok {
+					continue
+				}
+				// 未确认的子tx改为花费已确认utxo
+				if d := mp.Index.SpentTxo(spender, key); d != nil {
+					d.BlockHeight = uint32(height)
+					d.TxIdx = txIdx
+					utxoToSpend[key] = d
+				}
+				continue
+			}
+
+			// 未花费的输出已成为已确认utxo
+			if d, ok := serial.GlobalNewUtxoDataMap[key]; ok {
+				utxoToRemove[key] = d
+				delete(serial.GlobalNewUtxoDataMap, key)
+			}
+		}
+	}
+
+	logger.Log.Info("confirm block",
+		zap.Int("height", height),
+		zap.Int("nTx", len(txids)),
+		zap.Int("nConfirmed", len(confirmed)),
+		zap.Int("nBatchConfirmed", nBatchConfirmed),
+		zap.Int("nConflict", len(conflicting)))
+	if len(confirmed) > 0 {
+		unlock := mp.lockSinks()
+		if !mp.removeTxsFromSinks(&model.RemoveBatch{
+			Txids:         txidHexes,
+			TxHashes:      txHashes,
+			UtxoToRestore: map[string]*model.TxoData{},
+			UtxoToRemove:  utxoToRemove,
+			UtxoToSpend:   utxoToSpend,
+			UtxoToUnspend: utxoToUnspend,
+		}) {
+			unlock()
+			return false
+		}
+
+		mp.Index.Remove(txidHexes)
+		for txid := range confirmed {
+			delete(mp.Txs, txid)
+			mp.removeConflicts(txid)
+		}
+		changed := mp.Index.takeChanged()
+		mp.syncPackages(changed, txidHexes)
+		mp.syncRisks(changed, txidHexes)
+		unlock()
+	}
+
+	// 已确认的父tx移除后再驱逐双花tx，其花费的已确认utxo恢复为未花费
+	if len(conflicting) > 0 {
+		mp.EvictTxs(conflicting, EvictReasonBlockConflict)
+	}
+	return true
+}
+
+// blockConflictTxs 返回与区块中tx花费相同outpoint的已同步和当前批次中的tx。非final池中的双花tx直接丢弃
+func (mp *Mempool) blockConflictTxs(blockTxs map[string]bool, spent map[string]string) (conflicting []string) {
+	batchSpenders := make(map[string]string, 0)
+	for _, tx := range mp.BatchTxs {
+		for _, input := range tx.TxIns {
+			batchSpenders[input.InputOutpointKey] = tx.HashHex
+		}
+	}
+
+	found := make(map[string]bool, 0)
+	for key, blockTxid := range spent {
+		for _, spender := range []string{mp.Index.Spenders[key], batchSpenders[key]} {
+			if spender == "" || blockTxs[spender] || found[spender] {
+				continue
+			}
+			logger.Log.Info("block conflict",
+				zap.String("txid", spender),
+				zap.String("outpoint", utils.OutpointString(key)),
+				zap.String("by", blockTxid))
+			found[spender] = true
+			conflicting = append(conflicting, spender)
+		}
+
+		if spender, ok := mp.NonFinal.Spenders[key]; ok && spender != blockTxid {
+			logger.Log.Info("remove non final conflict",
+				zap.String("txid", spender),
+				zap.String("by", blockTxid))
+			mp.NonFinal.removeWithDescendants(spender)
+		}
+	}
+	return conflicting
+}
@@ -0,0 +1,117 @@
+package task
+
+import (
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/utils"
+
+	"go.uber.org/zap"
+)
+
+// removeConflictTxs 检查当前批次与已同步tx、孤儿池中tx的双花，后收到的冲突tx及其子tx不再同步，返回新发现的双花
+func (mp *Mempool) removeConflictTxs() (conflicts []*model.TxConflict) {
+	spentInBatch := make(map[string]string, 0) // outpointKey -> txid
+	rejected := make(map[string]bool, 0)
+
+	batchTxs := make([]*model.Tx, 0, len(mp.BatchTxs))
+	for _, tx := range mp.BatchTxs {
+		isRejected := false
+		for _, input := range tx.TxIns {
+			if rejected[input.InputHashHex] {
+				// 父tx冲突
+				isRejected = true
+				continue
+			}
+
+			first, ok := mp.Index.Spenders[input.InputOutpointKey]
+			if !ok {
+				first, ok = spentInBatch[input.InputOutpointKey]
+			}
+			if !ok {
+				// 孤儿池中的tx先收到
+				first, ok = mp.Orphans.Spenders[input.InputOutpointKey]
+			}
+			if !ok || first == tx.HashHex {
+				continue
+			}
+
+			isRejected = true
+			conflicts = append(conflicts, &model.TxConflict{
+				OutpointKey: input.InputOutpointKey,
+				FirstTxid:   first,
+				SecondTxid:  tx.HashHex,
+			})
+		}
+
+		if isRejected {
+			rejected[tx.HashHex] = true
+			delete(mp.Txs, tx.HashHex)
+			continue
+		}
+		for _, input := range tx.TxIns {
+			spentInBatch[input.InputOutpointKey] = tx.HashHex
+		}
+		batchTxs = append(batchTxs, tx)
+	}
+
+	// 批次未排序，子tx可能先于被拒绝的父tx到达
+	for changed := true; changed; {
+		changed = false
+		survivors := batchTxs[:0]
+		for _, tx := range batchTxs {
+			if hasRejectedParent(tx, rejected) {
+				rejected[tx.HashHex] = true
+				delete(mp.Txs, tx.HashHex)
+				changed = true
+				continue
+			}
+			survivors = append(survivors, tx)
+		}
+		batchTxs = survivors
+	}
+	mp.BatchTxs = batchTxs
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+	for _, c := range conflicts {
+		logger.Log.Info("double spend",
+			zap.String("first", c.FirstTxid),
+			zap.String("second", c.SecondTxid),
+			zap.String("outpoint", utils.OutpointString(c.OutpointKey)))
+		mp.Conflicts[c.FirstTxid] = append(mp.Conflicts[c.FirstTxid], c)
+		mp.Conflicts[c.SecondTxid] = append(mp.Conflicts[c.SecondTxid], c)
+	}
+	logger.Log.Info("remove conflict txs",
+		zap.Int("nConflict", len(conflicts)),
+		zap.Int("nRejected", len(rejected)))
+	unlock := mp.lockSinks()
+	for _, sink := range mp.indexSinks() {
+		sink.RecordConflicts(conflicts)
+	}
+	unlock()
+	return conflicts
+}
+
+func hasRejectedParent(tx *model.Tx, rejected map[string]bool) bool {
+	for _, input := range tx.TxIns {
+		if rejected[input.InputHashHex] {
+			return true
+		}
+	}
+	return false
+}
+
+// removeConflicts 删除已确认或被驱逐tx的双花记录，与之冲突而未同步的tx的记录一并删除
+func (mp *Mempool) removeConflicts(txid string) {
+	for _, c := range mp.Conflicts[txid] {
+		other := c.SecondTxid
+		if other == txid {
+			other = c.FirstTxid
+		}
+		if _, ok := mp.Index.Entries[other]; !ok {
+			delete(mp.Conflicts, other)
+		}
+	}
+	delete(mp.Conflicts, txid)
+}
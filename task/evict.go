@@ -0,0 +1,265 @@
+package task
+
+import (
+	"satomempool/loader"
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/task/serial"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 驱逐原因
+const (
+	EvictReasonVanished = "vanished" // 已不在节点mempool中(过期、冲突或节点重启)
+	EvictReasonAncestor = "ancestor" // 父tx被驱逐
+
+	EvictReasonBlockConflict = "blockconflict" // 与区块中的tx双花
+)
+
+// MempoolSnapshot 节点mempool快照，用于对账
+type MempoolSnapshot struct {
+	Height int
+	Txids  map[string]bool
+}
+
+// ReconcileLoop 定时获取节点mempool快照，交给同步主循环对账
+func (mp *Mempool) ReconcileLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		height := loader.GetBlockCountRPC()
+		txids := loader.GetRawMemPoolRPC()
+		// 快照期间有新块则跳过
+		if txids == nil || height < 0 || height != loader.GetBlockCountRPC() {
+			continue
+		}
+
+		snapshot := &MempoolSnapshot{
+			Height: height,
+			Txids:  make(map[string]bool, len(txids)),
+		}
+		for _, txid := range txids {
+			if txidHex, ok := txid.(string); ok {
+				snapshot.Txids[txidHex] = true
+			}
+		}
+		mp.ReconcileNotify <- snapshot
+	}
+}
+
+// ReconcileMempool 驱逐已不在节点mempool中的tx。
+// 连续两次快照都不存在，且已处理到快照时的最新区块，才认为被驱逐，避免误删刚收到或刚被打包的tx
+func (mp *Mempool) ReconcileMempool(snapshot *MempoolSnapshot) {
+	if snapshot.Height != mp.BestHeight {
+		mp.evictSuspects = nil
+		return
+	}
+
+	suspects := make(map[string]bool, 0)
+	vanished := make([]string, 0)
+	for txid := range mp.Index.Entries {
+		if snapshot.Txids[txid] {
+			continue
+		}
+		if mp.evictSuspects[txid] {
+			vanished = append(vanished, txid)
+		} else {
+			suspects[txid] = true
+		}
+	}
+	mp.evictSuspects = suspects
+
+	logger.Log.Info("reconcile mempool",
+		zap.Int("nNode", len(snapshot.Txids)),
+		zap.Int("nIndex", len(mp.Index.Entries)),
+		zap.Int("nSuspect", len(suspects)),
+		zap.Int("nVanished", len(vanished)))
+	if len(vanished) > 0 {
+		mp.EvictTxs(vanished, EvictReasonVanished)
+	}
+}
+
+// EvictTxs 移除tx及其所有子tx，撤销其对utxo和余额的影响，并记录驱逐原因。当前批次中尚未同步的tx直接丢弃
+func (mp *Mempool) EvictTxs(txids []string, reason string) (evicted map[string]string) {
+	evicted = make(map[string]string, len(txids)) // txid -> reason
+	queue := make([]string, 0, len(txids))
+	for _, txid := range txids {
+		if _, ok := mp.Index.Entries[txid]; ok {
+			evicted[txid] = reason
+			queue = append(queue, txid)
+		} else if mp.Txs[txid] {
+			evicted[txid] = reason
+		}
+	}
+	// 已同步的子tx
+	for len(queue) > 0 {
+		txid := queue[0]
+		queue = queue[1:]
+		for _, output := range mp.Index.Entries[txid].Tx.TxOuts {
+			spender, ok := mp.Index.Spenders[output.OutpointKey]
+			if !ok {
+				continue
+			}
+			if _, ok := evicted[spender]; ok {
+				continue
+			}
+			evicted[spender] = EvictReasonAncestor
+			queue = append(queue, spender)
+		}
+	}
+	// 未同步的子tx: 当前批次、孤儿池和非final池中的tx可能互相依赖
+	nBatchEvicted, nPoolEvicted := 0, 0
+	for {
+		nBatch := mp.evictBatchDescendants(evicted)
+		nPool := mp.evictPoolDescendants(evicted)
+		if nBatch+nPool == 0 {
+			break
+		}
+		nBatchEvicted += nBatch
+		nPoolEvicted += nPool
+	}
+
+	utxoToRestore := make(map[string]*model.TxoData, 0)
+	utxoToRemove := make(map[string]*model.TxoData, 0)
+	utxoToUnspend := make(map[string]*model.TxoData, 0)
+	txHashes := make([]string, 0, len(evicted))
+	txidHexes := make([]string, 0, len(evicted))
+	for txid := range evicted {
+		entry, ok := mp.Index.Entries[txid]
+		if !ok {
+			continue
+		}
+		txHashes = append(txHashes, string(entry.Tx.Hash))
+		txidHexes = append(txidHexes, txid)
+
+		for _, input := range entry.Tx.TxIns {
+			d := input.SpentTxo
+			if d == nil {
+				continue
+			}
+			if d.BlockHeight != model.MEMPOOL_HEIGHT {
+				// 已确认utxo恢复为未花费
+				utxoToUnspend[input.InputOutpointKey] = d
+				continue
+			}
+			if _, ok := evicted[input.InputHashHex]; ok {
+				continue
+			}
+			if _, ok := mp.Index.Entries[input.InputHashHex]; ok {
+				// 父tx的输出恢复为未花费
+				txo := *d
+				utxoToRestore[input.InputOutpointKey] = &txo
+				serial.GlobalNewUtxoDataMap[input.InputOutpointKey] = &txo
+			}
+		}
+
+		for _, output := range entry.Tx.TxOuts {
+			if d, ok := serial.GlobalNewUtxoDataMap[output.OutpointKey]; ok {
+				utxoToRemove[output.OutpointKey] = d
+				delete(serial.GlobalNewUtxoDataMap, output.OutpointKey)
+			}
+		}
+	}
+
+	logger.Log.Info("evict txs",
+		zap.String("reason", reason),
+		zap.Int("nRoot", len(txids)),
+		zap.Int("nEvicted", len(txHashes)),
+		zap.Int("nBatchEvicted", nBatchEvicted),
+		zap.Int("nPoolEvicted", nPoolEvicted))
+	if len(evicted) == 0 {
+		return evicted
+	}
+
+	defer mp.lockSinks()()
+	if len(txHashes) > 0 {
+		mp.removeTxsFromSinks(&model.RemoveBatch{
+			Txids:         txidHexes,
+			TxHashes:      txHashes,
+			UtxoToRestore: utxoToRestore,
+			UtxoToRemove:  utxoToRemove,
+			UtxoToSpend:   map[string]*model.TxoData{},
+			UtxoToUnspend: utxoToUnspend,
+		})
+	}
+	for _, sink := range mp.indexSinks() {
+		sink.RecordEvicted(evicted)
+	}
+
+	mp.Index.Remove(txidHexes)
+	for txid, reason := range evicted {
+		logger.Log.Info("evict tx", zap.String("txid", txid), zap.String("reason", reason))
+		delete(mp.Txs, txid)
+		mp.removeConflicts(txid)
+	}
+	changed := mp.Index.takeChanged()
+	mp.syncPackages(changed, txidHexes)
+	mp.syncRisks(changed, txidHexes)
+	return evicted
+}
+
+// evictBatchDescendants 从当前未同步的批次中移除被驱逐的tx及其子tx
+func (mp *Mempool) evictBatchDescendants(evicted map[string]string) (n int) {
+	for {
+		batchTxs := make([]*model.Tx, 0, len(mp.BatchTxs))
+		for _, tx := range mp.BatchTxs {
+			if _, ok := evicted[tx.HashHex]; ok {
+				delete(mp.Txs, tx.HashHex)
+				continue
+			}
+			isChild := false
+			for _, input := range tx.TxIns {
+				if _, ok := evicted[input.InputHashHex]; ok {
+					isChild = true
+					break
+				}
+			}
+			if isChild {
+				evicted[tx.HashHex] = EvictReasonAncestor
+				delete(mp.Txs, tx.HashHex)
+				continue
+			}
+			batchTxs = append(batchTxs, tx)
+		}
+		removed := len(mp.BatchTxs) - len(batchTxs)
+		mp.BatchTxs = batchTxs
+		if removed == 0 {
+			return n
+		}
+		n += removed
+	}
+}
+
+// evictPoolDescendants 从孤儿池和非final池中移除被驱逐tx的子tx
+func (mp *Mempool) evictPoolDescendants(evicted map[string]string) (n int) {
+	for txid, orphan := range mp.Orphans.Txs {
+		if spendsEvicted(orphan.Tx, evicted) {
+			mp.Orphans.Remove(txid)
+			delete(mp.Txs, txid)
+			evicted[txid] = EvictReasonAncestor
+			n++
+		}
+	}
+	for txid, ntx := range mp.NonFinal.Txs {
+		if !spendsEvicted(ntx.Tx, evicted) {
+			continue
+		}
+		for _, removed := range mp.NonFinal.removeWithDescendants(txid) {
+			evicted[removed] = EvictReasonAncestor
+			n++
+		}
+	}
+	return n
+}
+
+// spendsEvicted 判断tx是否花费被驱逐tx的输出
+func spendsEvicted(tx *model.Tx, evicted map[string]string) bool {
+	for _, input := range tx.TxIns {
+		if _, ok := evicted[input.InputHashHex]; ok {
+			return true
+		}
+	}
+	return false
+}
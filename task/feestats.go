@@ -0,0 +1,214 @@
+package task
+
+import (
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/store"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FeeRateBuckets 手续费率分桶下限, sat/byte
+var FeeRateBuckets = []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 1, 2, 5, 10, 20, 50, 100}
+
+// FeeEstimateTargets 估算手续费的目标确认区块数
+var FeeEstimateTargets = []int{1, 2, 3, 6}
+
+// FeeHistogram 当前mempool的手续费率分布，按字节数加权
+type FeeHistogram struct {
+	Count []uint64
+	Bytes []uint64
+}
+
+func NewFeeHistogram() *FeeHistogram {
+	return &FeeHistogram{
+		Count: make([]uint64, len(FeeRateBuckets)),
+		Bytes: make([]uint64, len(FeeRateBuckets)),
+	}
+}
+
+// feeRateBucket 返回费率所在分桶
+func feeRateBucket(feeRate float64) int {
+	return sort.Search(len(FeeRateBuckets), func(i int) bool { return FeeRateBuckets[i] > feeRate }) - 1
+}
+
+func (h *FeeHistogram) Add(tx *model.Tx) {
+	if tx.FeeUnresolved {
+		return
+	}
+	b := feeRateBucket(tx.FeeRate)
+	h.Count[b]++
+	h.Bytes[b] += uint64(tx.VSize)
+}
+
+func (h *FeeHistogram) Remove(tx *model.Tx) {
+	if tx.FeeUnresolved {
+		return
+	}
+	b := feeRateBucket(tx.FeeRate)
+	if h.Count[b] > 0 {
+		h.Count[b]--
+	}
+	if h.Bytes[b] >= uint64(tx.VSize) {
+		h.Bytes[b] -= uint64(tx.VSize)
+	} else {
+		h.Bytes[b] = 0
+	}
+}
+
+// BlockFeeStats 区块中已同步的mempool tx手续费统计
+type BlockFeeStats struct {
+	Height     int
+	NTx        int
+	Bytes      uint64
+	MinFeeRate float64
+}
+
+// FeeEstimator 根据当前mempool分布和最近区块估算手续费率
+type FeeEstimator struct {
+	Blocks    []*BlockFeeStats // 最近区块，按高度递增
+	MaxBlocks int
+}
+
+func NewFeeEstimator(maxBlocks int) *FeeEstimator {
+	return &FeeEstimator{
+		Blocks:    make([]*BlockFeeStats, 0),
+		MaxBlocks: maxBlocks,
+	}
+}
+
+func (e *FeeEstimator) AddBlock(stats *BlockFeeStats) {
+	if n := len(e.Blocks); n > 0 && e.Blocks[n-1].Height >= stats.Height {
+		return
+	}
+	e.Blocks = append(e.Blocks, stats)
+	if e.MaxBlocks > 0 && len(e.Blocks) > e.MaxBlocks {
+		e.Blocks = e.Blocks[len(e.Blocks)-e.MaxBlocks:]
+	}
+	logger.Log.Info("block fee stats",
+		zap.Int("height", stats.Height),
+		zap.Int("nTx", stats.NTx),
+		zap.Uint64("bytes", stats.Bytes),
+		zap.Float64("minFeeRate", stats.MinFeeRate))
+}
+
+// Estimate 估算在nBlocks个区块内确认所需的手续费率，没有区块数据时返回-1。
+// 从高费率累计mempool字节数，超过nBlocks个区块平均容量时的费率为所需费率，且不低于最近区块确认的最低费率
+func (e *FeeEstimator) Estimate(h *FeeHistogram, nBlocks int) float64 {
+	var blockBytes uint64
+	minFeeRate := -1.0
+	nBlock := 0
+	for _, stats := range e.Blocks {
+		if stats.NTx == 0 {
+			continue
+		}
+		nBlock++
+		blockBytes += stats.Bytes
+		if minFeeRate < 0 || stats.MinFeeRate < minFeeRate {
+			minFeeRate = stats.MinFeeRate
+		}
+	}
+	if nBlock == 0 {
+		return -1
+	}
+	capacity := blockBytes / uint64(nBlock) * uint64(nBlocks)
+
+	feeRate := 0.0
+	var total uint64
+	for b := len(FeeRateBuckets) - 1; b >= 0; b-- {
+		total += h.Bytes[b]
+		if total > capacity {
+			feeRate = FeeRateBuckets[b]
+			if b+1 < len(FeeRateBuckets) {
+				feeRate = FeeRateBuckets[b+1]
+			}
+			break
+		}
+	}
+	if feeRate < minFeeRate {
+		feeRate = minFeeRate
+	}
+	return feeRate
+}
+
+// blockFeeStats 统计区块中已同步的tx
+func (mp *Mempool) blockFeeStats(height int, txids []interface{}) *BlockFeeStats {
+	stats := &BlockFeeStats{Height: height, MinFeeRate: -1}
+	for _, txid := range txids {
+		txidHex, ok := txid.(string)
+		if !ok {
+			continue
+		}
+		entry, ok := mp.Index.Entries[txidHex]
+		if !ok || entry.Tx.FeeUnresolved {
+			continue
+		}
+		stats.NTx++
+		stats.Bytes += uint64(entry.Tx.VSize)
+		if stats.MinFeeRate < 0 || entry.Tx.FeeRate < stats.MinFeeRate {
+			stats.MinFeeRate = entry.Tx.FeeRate
+		}
+	}
+	if stats.NTx == 0 {
+		stats.MinFeeRate = 0
+	}
+	return stats
+}
+
+// recordBlocksFee 全量同步前统计新区块，全量同步会清空已同步的tx
+func (mp *Mempool) recordBlocksFee() {
+	if mp.BestHeight <= 0 {
+		return
+	}
+	height := mp.Node.GetBlockCount()
+	if height <= mp.BestHeight || height-mp.BestHeight > mp.MaxConfirmBlocks {
+		return
+	}
+	for h := mp.BestHeight + 1; h <= height; h++ {
+		blockHash := mp.Node.GetBlockHash(h)
+		if blockHash == "" {
+			return
+		}
+		txids := mp.Node.GetBlockTxids(blockHash)
+		if txids == nil {
+			return
+		}
+		mp.FeeEstimator.AddBlock(mp.blockFeeStats(h, txids))
+	}
+}
+
+// EstimateFeeRate 估算在nBlocks个区块内确认所需的手续费率, sat/byte
+func (mp *Mempool) EstimateFeeRate(nBlocks int) float64 {
+	return mp.FeeEstimator.Estimate(mp.Index.Histogram, nBlocks)
+}
+
+// SaveFeeStats 保存手续费率分布和估算结果到支持的存储
+func (mp *Mempool) SaveFeeStats() {
+	h := mp.Index.Histogram
+	now := time.Now()
+	rows := make([]*store.FeeHistogramRow, 0, len(FeeRateBuckets))
+	for b, feeRate := range FeeRateBuckets {
+		rows = append(rows, &store.FeeHistogramRow{
+			Time:    now,
+			Height:  uint32(mp.BestHeight),
+			FeeRate: feeRate,
+			NTx:     h.Count[b],
+			Bytes:   h.Bytes[b],
+		})
+	}
+
+	estimates := make(map[int]float64, len(FeeEstimateTargets))
+	for _, nBlocks := range FeeEstimateTargets {
+		estimates[nBlocks] = mp.EstimateFeeRate(nBlocks)
+	}
+	unlock := mp.lockSinks()
+	for _, sink := range mp.Sinks {
+		if s, ok := sink.(FeeStatsSink); ok {
+			s.SaveFeeStats(rows, estimates)
+		}
+	}
+	unlock()
+	logger.Log.Info("fee stats", zap.Any("estimates", estimates))
+}
@@ -1,14 +1,16 @@
 package task
 
 import (
+	"context"
 	"satomempool/loader"
 	"satomempool/logger"
+	"satomempool/metrics"
 	"satomempool/model"
-	"satomempool/store"
 	"satomempool/task/parallel"
 	"satomempool/task/serial"
 	"satomempool/utils"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -17,10 +19,43 @@ import (
 type Mempool struct {
 	BatchTxs []*model.Tx     // 所有Tx
 	Txs      map[string]bool // 所有Tx
-	SkipTxs  map[string]bool // 需要跳过的Tx
 
-	BlockNotify chan []byte
-	RawTxNotify chan []byte
+	Node loader.Node // 全量加载和新块确认使用的节点rpc，抓包时记录，重放时来自抓包文件
+
+	Index     *TxIndex                       // 已同步的tx
+	Conflicts map[string][]*model.TxConflict // txid -> 双花记录
+	Orphans   *OrphanPool                    // 等待父tx的tx
+	NonFinal  *NonFinalPool                  // 尚不能打包的tx
+
+	Quarantine *loader.QuarantineWriter // 解析失败的rawtx写入隔离文件，为nil时不记录
+
+	promotedTxs      map[string]bool // 从非final池加入同步的tx
+	RiskLowFeeRate   float64         // 低于该手续费率(sat/byte)视为有风险
+	RiskMaxAncestors int             // 未确认祖先超过该数量视为有风险
+
+	IncrementalConfirm bool   // 新块确认时只移除已确认的tx，否则全量同步
+	MaxConfirmBlocks   int    // 增量确认最多处理的区块数
+	BestHeight         int    // 已处理的最新区块高度
+	BestHash           string // 已处理的最新区块hash
+	BestMedianTime     uint32 // 已处理的最新区块mediantime，用于判断tx是否final
+
+	BlockNotify  chan []byte // 新块确认通知
+	RawTxNotify  chan []byte
+	ResyncNotify chan string // zmq丢包等需要全量同步的通知
+
+	// 以下状态供健康检查读取，原子访问
+	lastTxAt    int64 // 最近收到tx的时间, unix nano
+	lastBlockAt int64 // 最近收到新块通知的时间, unix nano
+	synced      int32 // 是否已完成首次全量同步
+
+	ReconcileNotify chan *MempoolSnapshot // 节点mempool快照，用于驱逐已消失的tx
+	evictSuspects   map[string]bool       // 上次对账时已不在节点mempool中的tx
+
+	Sinks  []Sink     // 同步结果写入的存储
+	sinkMu sync.Mutex // 写入存储期间持有，强制退出前等待写入完成
+
+	FeeEstimator *FeeEstimator    // 手续费率估算，全量同步时保留
+	FeeStatsTick <-chan time.Time // 定时保存手续费率分布，为nil时不保存
 
 	SpentUtxoKeysMap  map[string]bool
 	SpentUtxoDataMap  map[string]*model.TxoData
@@ -33,25 +68,53 @@ type Mempool struct {
 func NewMempool() (mp *Mempool, err error) {
 	mp = new(Mempool)
 
+	mp.Node = loader.RpcNode{}
 	mp.BlockNotify = make(chan []byte, 10)
 	mp.RawTxNotify = make(chan []byte, 1000)
+	mp.ResyncNotify = make(chan string, 1)
+	mp.ReconcileNotify = make(chan *MempoolSnapshot, 1)
+	mp.Index = NewTxIndex()
+	mp.Conflicts = make(map[string][]*model.TxConflict, 0)
+	mp.Orphans = NewOrphanPool(0)
+	mp.NonFinal = NewNonFinalPool(0)
+	mp.promotedTxs = make(map[string]bool, 0)
+	mp.FeeEstimator = NewFeeEstimator(0)
 
 	return
 }
 
 func (mp *Mempool) Init() {
 	mp.BatchTxs = make([]*model.Tx, 0)
+	mp.initUtxoMaps()
+}
+
+func (mp *Mempool) initUtxoMaps() {
 	mp.SpentUtxoKeysMap = make(map[string]bool, 1)
 	mp.SpentUtxoDataMap = make(map[string]*model.TxoData, 1)
 	mp.NewUtxoDataMap = make(map[string]*model.TxoData, 1)
 	mp.RemoveUtxoDataMap = make(map[string]*model.TxoData, 1)
 }
 
-func (mp *Mempool) LoadFromMempool() bool {
+// LoadFromMempool 清空后从节点加载mempool，无法获取最新区块或ctx取消时返回false
+func (mp *Mempool) LoadFromMempool(ctx context.Context) bool {
 	// 清空
 	mp.Txs = make(map[string]bool, 0)
-	mp.SkipTxs = make(map[string]bool, 0)
+	mp.Index = NewTxIndex()
+	mp.Conflicts = make(map[string][]*model.TxConflict, 0)
+	mp.Orphans.Clear()
+	mp.promotedTxs = make(map[string]bool, 0)
+	mp.evictSuspects = nil
+	mp.BestHeight = 0
+	mp.BestHash = ""
+	mp.BestMedianTime = 0
+
+	// 全量同步会覆盖之前的通知
+	select {
+	case <-mp.ResyncNotify:
+	default:
+	}
 
+	// 此前收到的tx要么在节点mempool快照中，要么已被打包或驱逐
 	for i := 0; i < 1000; i++ {
 		select {
 		case <-mp.RawTxNotify:
@@ -59,44 +122,163 @@ func (mp *Mempool) LoadFromMempool() bool {
 		}
 	}
 
-	txids := loader.GetRawMemPoolRPC()
-	for _, txid := range txids {
-		rawtx := loader.GetRawTxRPC(txid)
+	// 加载期间收到的tx先缓存，加载完毕后合并，避免遗漏快照之后的新tx
+	stopBuffer := mp.bufferRawTxs()
+
+	// 快照之前的区块，用于增量确认和判断tx是否final。获取失败时不加载，由调用方重试
+	if !mp.loadBestBlock() {
+		stopBuffer()
+		return false
+	}
+
+	txids := mp.Node.GetRawMemPool()
+	rawtxs := mp.Node.GetRawTxs(txids)
+	for _, rawtx := range rawtxs {
+		if ctx.Err() != nil {
+			stopBuffer()
+			return false
+		}
 		if rawtx == nil {
 			continue
 		}
+		metrics.TxReceived.WithLabelValues("rpc_load").Inc()
+		mp.AddRawTx(rawtx)
+	}
 
-		tx, txoffset := utils.NewTx(rawtx)
-		if int(txoffset) < len(rawtx) {
-			logger.Log.Info("skip bad rawtx")
-			continue
+	buffered := stopBuffer()
+	nMerged := 0
+	for _, rawtx := range buffered {
+		if mp.AddRawTx(rawtx) {
+			nMerged++
+		}
+	}
+
+	// 非final池在全量同步时保留，此前已final的tx重新同步
+	nPromoted := mp.promoteNonFinalTxs()
+	logger.Log.Info("load mempool",
+		zap.Int("nTx", len(txids)),
+		zap.Int("nBuffered", len(buffered)),
+		zap.Int("nMerged", nMerged),
+		zap.Int("nPromoted", nPromoted))
+	return true
+}
+
+// loadBestBlock 获取节点最新区块的高度、hash和mediantime
+func (mp *Mempool) loadBestBlock() bool {
+	height := mp.Node.GetBlockCount()
+	if height < 0 {
+		logger.Log.Info("load best block failed", zap.String("rpc", "getblockcount"))
+		return false
+	}
+	blockHash := mp.Node.GetBlockHash(height)
+	if blockHash == "" {
+		logger.Log.Info("load best block failed", zap.String("rpc", "getblockhash"), zap.Int("height", height))
+		return false
+	}
+	medianTime := mp.Node.GetBlockMedianTime(blockHash)
+	if medianTime <= 0 {
+		logger.Log.Info("load best block failed", zap.String("rpc", "getblockheader"), zap.String("blkid", blockHash))
+		return false
+	}
+	mp.BestHeight = height
+	mp.BestHash = blockHash
+	mp.BestMedianTime = uint32(medianTime)
+	return true
+}
+
+// bufferRawTxs 持续缓存收到的rawtx，调用返回的函数停止缓存并取出
+func (mp *Mempool) bufferRawTxs() (stop func() [][]byte) {
+	quit := make(chan struct{})
+	done := make(chan [][]byte)
+	go func() {
+		rawtxs := make([][]byte, 0)
+		for {
+			select {
+			case rawtx := <-mp.RawTxNotify:
+				atomic.StoreInt64(&mp.lastTxAt, time.Now().UnixNano())
+				rawtxs = append(rawtxs, rawtx)
+			case <-quit:
+				done <- rawtxs
+				return
+			}
 		}
+	}()
 
-		tx.Raw = rawtx
-		tx.Size = uint32(txoffset)
-		tx.Hash = utils.GetHash256(rawtx)
-		tx.HashHex = utils.HashString(tx.Hash)
+	return func() [][]byte {
+		close(quit)
+		return <-done
+	}
+}
+
+// AddRawTx 解析rawtx加入当前批次，跳过无效和重复的tx，非final的tx暂存
+func (mp *Mempool) AddRawTx(rawtx []byte) bool {
+	tx, _, err := utils.NewTx(rawtx)
+	if err != nil {
+		logger.Log.Info("skip bad rawtx",
+			zap.Int("size", len(rawtx)),
+			zap.Error(err))
+		metrics.TxBadRaw.WithLabelValues(utils.ParseErrorReason(err)).Inc()
+		if mp.Quarantine != nil {
+			mp.Quarantine.Write(rawtx, err)
+		}
+		return false
+	}
+
+	tx.Raw = rawtx
 
-		if utils.IsTxNonFinal(tx, mp.SkipTxs) {
-			logger.Log.Info("skip non final tx",
+	// 非final的tx及其子tx进入非final池，final后再同步
+	if !mp.isTxFinal(tx) || mp.NonFinal.DependsOn(tx) {
+		metrics.TxNonFinal.Inc()
+		if mp.NonFinal.Add(tx) {
+			logger.Log.Info("hold non final tx",
 				zap.String("txid", tx.HashHex),
+				zap.Uint32("locktime", tx.LockTime),
 			)
-			mp.SkipTxs[tx.HashHex] = true
-			continue
 		}
+		return false
+	}
+	mp.NonFinal.Remove(tx.HashHex)
+	mp.NonFinal.RemoveConflicts(tx)
 
-		if ok := mp.Txs[tx.HashHex]; ok {
-			logger.Log.Info("skip dup")
-			continue
-		}
-		mp.Txs[tx.HashHex] = true
-		mp.BatchTxs = append(mp.BatchTxs, tx)
+	if ok := mp.Txs[tx.HashHex]; ok {
+		logger.Log.Info("skip dup")
+		metrics.TxDuplicate.Inc()
+		return false
 	}
+	mp.Txs[tx.HashHex] = true
+	mp.BatchTxs = append(mp.BatchTxs, tx)
 	return true
 }
 
-// SyncMempoolFromZmq 从zmq同步tx
-func (mp *Mempool) SyncMempoolFromZmq() (blockReady bool) {
+// SinceLastTx 距最近收到tx的时间，尚未收到时返回-1
+func (mp *Mempool) SinceLastTx() time.Duration {
+	return sinceUnixNano(atomic.LoadInt64(&mp.lastTxAt))
+}
+
+// SinceLastBlock 距最近收到新块通知的时间，尚未收到时返回-1
+func (mp *Mempool) SinceLastBlock() time.Duration {
+	return sinceUnixNano(atomic.LoadInt64(&mp.lastBlockAt))
+}
+
+func sinceUnixNano(t int64) time.Duration {
+	if t == 0 {
+		return -1
+	}
+	return time.Since(time.Unix(0, t))
+}
+
+// SetSynced 标记已完成首次全量同步
+func (mp *Mempool) SetSynced() {
+	atomic.StoreInt32(&mp.synced, 1)
+}
+
+// Synced 是否已完成首次全量同步
+func (mp *Mempool) Synced() bool {
+	return atomic.LoadInt32(&mp.synced) == 1
+}
+
+// SyncMempoolFromZmq 从zmq同步tx，需要全量同步时返回true。ctx取消时立即返回false
+func (mp *Mempool) SyncMempoolFromZmq(ctx context.Context) (needFullSync bool) {
 	start := time.Now()
 	firstGot := false
 	rawtx := make([]byte, 0)
@@ -104,29 +286,47 @@ func (mp *Mempool) SyncMempoolFromZmq() (blockReady bool) {
 		timeout := false
 		select {
 		case rawtx = <-mp.RawTxNotify:
+			atomic.StoreInt64(&mp.lastTxAt, time.Now().UnixNano())
 			if !firstGot {
 				start = time.Now()
 			}
 			firstGot = true
-		case msg := <-serial.ChannelBlockSynced:
+		case msg := <-mp.BlockNotify:
+			atomic.StoreInt64(&mp.lastBlockAt, time.Now().UnixNano())
 			loop := true
 			nblk := 1
 			for loop {
 				select {
-				case <-serial.ChannelBlockSynced:
+				case <-mp.BlockNotify:
 					nblk++
 					loop = true
 				case <-time.After(time.Second):
 					loop = false
 				}
 			}
-			logger.Log.Info("redis subcribe", zap.Int("nblk", nblk), zap.String("channel", msg.Channel))
-			blockReady = true
+			logger.Log.Info("block notify", zap.Int("nblk", nblk), zap.ByteString("payload", msg))
+			if mp.IncrementalConfirm && mp.ConfirmBlocks() {
+				// 继续同步当前批次
+				return false
+			}
+			mp.recordBlocksFee()
+			needFullSync = true
+		case reason := <-mp.ResyncNotify:
+			logger.Log.Info("resync", zap.String("reason", reason))
+			needFullSync = true
+		case snapshot := <-mp.ReconcileNotify:
+			mp.ReconcileMempool(snapshot)
+			continue
+		case <-ctx.Done():
+			return false
+		case <-mp.FeeStatsTick:
+			mp.SaveFeeStats()
+			continue
 		case <-time.After(time.Second):
 			timeout = true
 		}
 
-		if blockReady {
+		if needFullSync {
 			return true
 		}
 		if timeout {
@@ -137,31 +337,9 @@ func (mp *Mempool) SyncMempoolFromZmq() (blockReady bool) {
 			}
 		}
 
-		tx, txoffset := utils.NewTx(rawtx)
-		if int(txoffset) < len(rawtx) {
-			logger.Log.Info("skip bad rawtx")
-			continue
-		}
-
-		tx.Raw = rawtx
-		tx.Size = uint32(txoffset)
-		tx.Hash = utils.GetHash256(rawtx)
-		tx.HashHex = utils.HashString(tx.Hash)
-
-		if utils.IsTxNonFinal(tx, mp.SkipTxs) {
-			logger.Log.Info("skip non final tx",
-				zap.String("txid", tx.HashHex),
-			)
-			mp.SkipTxs[tx.HashHex] = true
-			continue
-		}
-
-		if ok := mp.Txs[tx.HashHex]; ok {
-			logger.Log.Info("skip dup")
+		if !mp.AddRawTx(rawtx) {
 			continue
 		}
-		mp.Txs[tx.HashHex] = true
-		mp.BatchTxs = append(mp.BatchTxs, tx)
 
 		if time.Since(start) > 200*time.Millisecond {
 			return false
@@ -169,51 +347,105 @@ func (mp *Mempool) SyncMempoolFromZmq() (blockReady bool) {
 	}
 }
 
-// ParseMempool 先并行分析区块，不同区块并行，同区块内串行
-func (mp *Mempool) ParseMempool(startIdx int) {
-	// first
-	for txIdx, tx := range mp.BatchTxs {
-		// no dep, 准备utxo花费关系数据
-		parallel.ParseTxoSpendByTxParallel(tx, mp.SpentUtxoKeysMap)
+// ParseMempool 先并行分析区块，不同区块并行，同区块内串行。
+// ctx在写入存储前取消时丢弃当前批次并返回false，开始写入后不再中断
+func (mp *Mempool) ParseMempool(ctx context.Context, startIdx int) bool {
+	// 父tx已到达的孤儿tx，比当前批次先收到，双花时优先
+	mp.BatchTxs = append(mp.takeResolvableOrphans(), mp.BatchTxs...)
 
-		// 0
-		parallel.ParseTxFirst(tx)
+	// 按到达顺序排除双花，先收到的tx优先
+	conflicts := mp.removeConflictTxs()
 
-		// 1 dep 0
-		parallel.ParseNewUtxoInTxParallel(startIdx+txIdx, tx, mp.NewUtxoDataMap)
-	}
+	// 剩余tx中父tx排在子tx之前，保证txidx与依赖顺序一致
+	mp.sortBatchTxs()
+	metrics.BatchSize.Observe(float64(len(mp.BatchTxs)))
 
-	// 2 dep 0
-	serial.SyncBlockTxOutputInfo(startIdx, mp.BatchTxs)
+	for {
+		if ctx.Err() != nil {
+			return false
+		}
 
-	// 3 dep 1
-	serial.ParseGetSpentUtxoDataFromRedisSerial(mp.SpentUtxoKeysMap, mp.NewUtxoDataMap, mp.RemoveUtxoDataMap, mp.SpentUtxoDataMap)
-	// 4 dep 3
-	serial.SyncBlockTxInputDetail(startIdx, mp.BatchTxs, mp.NewUtxoDataMap, mp.RemoveUtxoDataMap, mp.SpentUtxoDataMap)
+		// first
+		var durFirst, dur0, dur1 time.Duration
+		for txIdx, tx := range mp.BatchTxs {
+			// no dep, 准备utxo花费关系数据
+			start := time.Now()
+			parallel.ParseTxoSpendByTxParallel(tx, mp.SpentUtxoKeysMap)
+			durFirst += time.Since(start)
+
+			// 0
+			start = time.Now()
+			parallel.ParseTxFirst(tx)
+			dur0 += time.Since(start)
+
+			// 1 dep 0
+			start = time.Now()
+			parallel.ParseNewUtxoInTxParallel(startIdx+txIdx, tx, mp.NewUtxoDataMap)
+			dur1 += time.Since(start)
+		}
+		metrics.ParseStepDuration.WithLabelValues("first").Observe(durFirst.Seconds())
+		metrics.ParseStepDuration.WithLabelValues("0").Observe(dur0.Seconds())
+		metrics.ParseStepDuration.WithLabelValues("1").Observe(dur1.Seconds())
+
+		// 3 dep 1
+		start := time.Now()
+		serial.ParseGetSpentUtxoDataFromRedisSerial(mp.SpentUtxoKeysMap, mp.NewUtxoDataMap, mp.RemoveUtxoDataMap, mp.SpentUtxoDataMap)
+		metrics.ObserveStep("3", start)
+
+		// 输入缺失的tx移入孤儿池，剩余tx重新分析
+		if !mp.removeOrphanTxs() {
+			break
+		}
+		mp.initUtxoMaps()
+	}
 
-	// 5 dep 2 4
-	serial.SyncBlockTx(startIdx, mp.BatchTxs)
+	// 补全输入utxo，计算金额和手续费
+	start := time.Now()
+	serial.ResolveBatchTxs(mp.BatchTxs, mp.NewUtxoDataMap, mp.RemoveUtxoDataMap, mp.SpentUtxoDataMap)
+	serial.UpdateGlobalUtxoMap(mp.SpentUtxoKeysMap, mp.NewUtxoDataMap, mp.RemoveUtxoDataMap)
+	metrics.ObserveStep("resolve", start)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		// for txin dump
-		// 6 dep 2 4
-		serial.UpdateUtxoInRedisSerial(mp.SpentUtxoKeysMap, mp.NewUtxoDataMap, mp.RemoveUtxoDataMap, mp.SpentUtxoDataMap)
-	}()
+	if ctx.Err() != nil {
+		return false
+	}
+	defer mp.lockSinks()()
+
+	// 各存储并行写入，失败的存储缺少当前批次，全量同步后补齐
+	if !mp.syncBatchToSinks(&model.SyncBatch{
+		StartIdx:          startIdx,
+		Txs:               mp.BatchTxs,
+		SpentUtxoKeysMap:  mp.SpentUtxoKeysMap,
+		NewUtxoDataMap:    mp.NewUtxoDataMap,
+		RemoveUtxoDataMap: mp.RemoveUtxoDataMap,
+		SpentUtxoDataMap:  mp.SpentUtxoDataMap,
+	}) {
+		loader.NotifyResync(mp.ResyncNotify, "sink")
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		// ParseEnd 最后分析执行
-		// 7 dep 5
-		store.CommitSyncCk()
-		store.CommitFullSyncCk(serial.SyncTxFullCount > 0)
-		store.ProcessPartSyncCk()
-	}()
+	txids := make([]string, 0, len(mp.BatchTxs))
+	for txIdx, tx := range mp.BatchTxs {
+		mp.Index.Add(tx, uint64(startIdx+txIdx))
+		txids = append(txids, tx.HashHex)
+	}
+	mp.Orphans.countResolved(mp.Index)
 
-	wg.Wait()
+	// 新tx及其祖先的package统计有变化
+	changed := mp.Index.takeChanged()
+	mp.syncPackages(changed, nil)
+
+	// 新出现双花的tx及其后代风险有变化，被拒绝的tx同样记录
+	for _, c := range conflicts {
+		changed[c.SecondTxid] = true
+		if _, ok := mp.Index.Entries[c.FirstTxid]; !ok {
+			continue
+		}
+		changed[c.FirstTxid] = true
+		for descendant := range mp.Index.Descendants(c.FirstTxid) {
+			changed[descendant] = true
+		}
+	}
+	mp.syncRisks(changed, nil)
 
 	logger.SyncLog()
+	return true
 }
@@ -0,0 +1,206 @@
+package task
+
+import (
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/utils"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 非final tx统计
+var (
+	NonFinalAddCount     uint64 // 进入非final池的tx数
+	NonFinalReplaceCount uint64 // 被更高sequence版本替换的tx数
+	NonFinalPromoteCount uint64 // 变为final后开始同步的tx数
+	NonFinalExpireCount  uint64 // 过期丢弃的tx数
+	NonFinalPoolSize     int64  // 当前非final池大小
+)
+
+// NonFinalTx 尚不能打包的tx，或其子tx
+type NonFinalTx struct {
+	Tx        *model.Tx
+	LockTime  uint32
+	Sequences []uint32
+	Added     time.Time
+}
+
+// NonFinalPool 非final tx池，全量同步时保留
+type NonFinalPool struct {
+	Txs      map[string]*NonFinalTx // txid -> tx
+	Spenders map[string]string      // outpointKey -> 花费该utxo的txid
+	Expire   time.Duration          // 超过该时间仍未final则丢弃
+}
+
+func NewNonFinalPool(expire time.Duration) *NonFinalPool {
+	return &NonFinalPool{
+		Txs:      make(map[string]*NonFinalTx, 0),
+		Spenders: make(map[string]string, 0),
+		Expire:   expire,
+	}
+}
+
+func (p *NonFinalPool) Has(txid string) bool {
+	_, ok := p.Txs[txid]
+	return ok
+}
+
+// DependsOn 判断tx是否花费池中tx的输出
+func (p *NonFinalPool) DependsOn(tx *model.Tx) bool {
+	for _, input := range tx.TxIns {
+		if _, ok := p.Txs[input.InputHashHex]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Add 加入非final tx。与池中tx花费相同输入时，只有sequence更高的更新版本才替换旧版本及其子tx，否则丢弃
+func (p *NonFinalPool) Add(tx *model.Tx) bool {
+	if p.Has(tx.HashHex) {
+		return false
+	}
+
+	replaced := make(map[string]bool, 0)
+	for _, input := range tx.TxIns {
+		if old, ok := p.Spenders[input.InputOutpointKey]; ok {
+			replaced[old] = true
+		}
+	}
+	for old := range replaced {
+		if !utils.IsSequenceUpdate(p.Txs[old].Tx, tx) {
+			logger.Log.Info("skip non final conflict",
+				zap.String("txid", tx.HashHex),
+				zap.String("other", old))
+			return false
+		}
+	}
+	for old := range replaced {
+		logger.Log.Info("replace non final tx",
+			zap.String("txid", old),
+			zap.String("by", tx.HashHex))
+		atomic.AddUint64(&NonFinalReplaceCount, uint64(len(p.removeWithDescendants(old))))
+	}
+
+	sequences := make([]uint32, 0, len(tx.TxIns))
+	for _, input := range tx.TxIns {
+		sequences = append(sequences, input.Sequence)
+		p.Spenders[input.InputOutpointKey] = tx.HashHex
+	}
+	p.Txs[tx.HashHex] = &NonFinalTx{
+		Tx:        tx,
+		LockTime:  tx.LockTime,
+		Sequences: sequences,
+		Added:     time.Now(),
+	}
+	atomic.AddUint64(&NonFinalAddCount, 1)
+	atomic.StoreInt64(&NonFinalPoolSize, int64(len(p.Txs)))
+	return true
+}
+
+// Remove 移除tx，池中子tx保留
+func (p *NonFinalPool) Remove(txid string) {
+	ntx, ok := p.Txs[txid]
+	if !ok {
+		return
+	}
+	delete(p.Txs, txid)
+	for _, input := range ntx.Tx.TxIns {
+		if spender, ok := p.Spenders[input.InputOutpointKey]; ok && spender == txid {
+			delete(p.Spenders, input.InputOutpointKey)
+		}
+	}
+	atomic.StoreInt64(&NonFinalPoolSize, int64(len(p.Txs)))
+}
+
+// RemoveConflicts 移除与tx花费相同输入的池中tx及其子tx
+func (p *NonFinalPool) RemoveConflicts(tx *model.Tx) {
+	for _, input := range tx.TxIns {
+		old, ok := p.Spenders[input.InputOutpointKey]
+		if !ok || old == tx.HashHex {
+			continue
+		}
+		logger.Log.Info("remove non final conflict",
+			zap.String("txid", old),
+			zap.String("by", tx.HashHex))
+		p.removeWithDescendants(old)
+	}
+}
+
+func (p *NonFinalPool) removeWithDescendants(txid string) (removed []string) {
+	queue := []string{txid}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if !p.Has(cur) {
+			continue
+		}
+		p.Remove(cur)
+		removed = append(removed, cur)
+		for child, ntx := range p.Txs {
+			for _, input := range ntx.Tx.TxIns {
+				if input.InputHashHex == cur {
+					queue = append(queue, child)
+					break
+				}
+			}
+		}
+	}
+	return removed
+}
+
+// isTxFinal 判断tx能否打包进下一个区块
+func (mp *Mempool) isTxFinal(tx *model.Tx) bool {
+	return utils.IsTxFinal(tx, uint32(mp.BestHeight+1), mp.BestMedianTime)
+}
+
+// promoteNonFinalTxs 将已final且不依赖池中tx的tx加入当前批次，同时丢弃过期的tx
+func (mp *Mempool) promoteNonFinalTxs() (n int) {
+	p := mp.NonFinal
+	now := time.Now()
+	for txid, ntx := range p.Txs {
+		if p.Expire > 0 && now.Sub(ntx.Added) > p.Expire {
+			logger.Log.Info("non final expired", zap.String("txid", txid))
+			atomic.AddUint64(&NonFinalExpireCount, uint64(len(p.removeWithDescendants(txid))))
+		}
+	}
+
+	// 子tx在父tx加入后的下一轮加入
+	for {
+		ready := make([]*NonFinalTx, 0)
+		for _, ntx := range p.Txs {
+			if p.DependsOn(ntx.Tx) || !mp.isTxFinal(ntx.Tx) {
+				continue
+			}
+			ready = append(ready, ntx)
+		}
+		if len(ready) == 0 {
+			break
+		}
+		sort.Slice(ready, func(i, j int) bool { return ready[i].Added.Before(ready[j].Added) })
+
+		for _, ntx := range ready {
+			tx := ntx.Tx
+			p.Remove(tx.HashHex)
+			if mp.Txs[tx.HashHex] {
+				continue
+			}
+			logger.Log.Info("promote non final tx", zap.String("txid", tx.HashHex))
+			mp.Txs[tx.HashHex] = true
+			mp.promotedTxs[tx.HashHex] = true
+			mp.BatchTxs = append(mp.BatchTxs, tx)
+			n++
+		}
+	}
+
+	atomic.AddUint64(&NonFinalPromoteCount, uint64(n))
+	logger.Log.Info("promote non final txs",
+		zap.Int("nPromoted", n),
+		zap.Int("nPool", len(p.Txs)),
+		zap.Int("height", mp.BestHeight),
+		zap.Uint32("medianTime", mp.BestMedianTime))
+	return n
+}
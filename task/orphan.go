@@ -0,0 +1,218 @@
+package task
+
+import (
+	"satomempool/logger"
+	"satomempool/model"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 孤儿tx统计
+var (
+	OrphanAddCount     uint64 // 进入孤儿池的tx数
+	OrphanResolveCount uint64 // 找到父tx后同步成功的tx数
+	OrphanExpireCount  uint64 // 过期丢弃的tx数
+	OrphanPoolSize     int64  // 当前孤儿池大小
+)
+
+// OrphanTx 输入找不到对应utxo的tx，等待父tx到达
+type OrphanTx struct {
+	Tx    *model.Tx
+	Added time.Time
+}
+
+// OrphanPool 孤儿tx池
+type OrphanPool struct {
+	Txs      map[string]*OrphanTx // txid -> tx
+	Spenders map[string]string    // outpointKey -> 花费该utxo的txid
+	Expire   time.Duration        // 超过该时间仍未找到父tx则丢弃
+
+	retryAll bool                 // 新块确认后父tx可能已确认，全部重试
+	retrying map[string]time.Time // 上次取出重试的tx及其最初加入时间
+}
+
+func NewOrphanPool(expire time.Duration) *OrphanPool {
+	return &OrphanPool{
+		Txs:      make(map[string]*OrphanTx, 0),
+		Spenders: make(map[string]string, 0),
+		Expire:   expire,
+	}
+}
+
+func (p *OrphanPool) Add(tx *model.Tx) {
+	if _, ok := p.Txs[tx.HashHex]; ok {
+		return
+	}
+	// 重试失败的tx保留最初加入时间
+	added, ok := p.retrying[tx.HashHex]
+	if ok {
+		delete(p.retrying, tx.HashHex)
+	} else {
+		added = time.Now()
+		atomic.AddUint64(&OrphanAddCount, 1)
+	}
+	p.Txs[tx.HashHex] = &OrphanTx{
+		Tx:    tx,
+		Added: added,
+	}
+	for _, input := range tx.TxIns {
+		p.Spenders[input.InputOutpointKey] = tx.HashHex
+	}
+	atomic.StoreInt64(&OrphanPoolSize, int64(len(p.Txs)))
+}
+
+// Remove 移除tx，池中子tx保留
+func (p *OrphanPool) Remove(txid string) {
+	orphan, ok := p.Txs[txid]
+	if !ok {
+		return
+	}
+	delete(p.Txs, txid)
+	for _, input := range orphan.Tx.TxIns {
+		if spender, ok := p.Spenders[input.InputOutpointKey]; ok && spender == txid {
+			delete(p.Spenders, input.InputOutpointKey)
+		}
+	}
+	atomic.StoreInt64(&OrphanPoolSize, int64(len(p.Txs)))
+}
+
+func (p *OrphanPool) Clear() {
+	p.Txs = make(map[string]*OrphanTx, 0)
+	p.Spenders = make(map[string]string, 0)
+	p.retryAll = false
+	p.retrying = nil
+	atomic.StoreInt64(&OrphanPoolSize, 0)
+}
+
+// RetryAll 下次同步时重试所有孤儿tx
+func (p *OrphanPool) RetryAll() {
+	p.retryAll = true
+}
+
+// takeResolvableOrphans 取出父tx在当前批次中的孤儿tx，同时丢弃过期的孤儿tx
+func (mp *Mempool) takeResolvableOrphans() (txs []*model.Tx) {
+	p := mp.Orphans
+	p.retrying = make(map[string]time.Time, 0)
+	if len(p.Txs) == 0 {
+		return nil
+	}
+
+	batch := make(map[string]bool, len(mp.BatchTxs))
+	for _, tx := range mp.BatchTxs {
+		batch[tx.HashHex] = true
+	}
+
+	// 子tx可能也是孤儿，直到没有新的可重试tx
+	for {
+		n := len(txs)
+		for txid, orphan := range p.Txs {
+			resolvable := p.retryAll
+			for _, input := range orphan.Tx.TxIns {
+				if batch[input.InputHashHex] {
+					resolvable = true
+					break
+				}
+			}
+			if !resolvable {
+				continue
+			}
+			p.Remove(txid)
+			p.retrying[txid] = orphan.Added
+			batch[txid] = true
+			txs = append(txs, orphan.Tx)
+		}
+		if len(txs) == n {
+			break
+		}
+	}
+	p.retryAll = false
+
+	now := time.Now()
+	for txid, orphan := range p.Txs {
+		if p.Expire > 0 && now.Sub(orphan.Added) > p.Expire {
+			logger.Log.Info("orphan expired", zap.String("txid", txid))
+			p.Remove(txid)
+			delete(mp.Txs, txid)
+			atomic.AddUint64(&OrphanExpireCount, 1)
+		}
+	}
+
+	atomic.StoreInt64(&OrphanPoolSize, int64(len(p.Txs)))
+	return txs
+}
+
+// countResolved 统计本次重试后已同步的孤儿tx，被判为双花或再次成为孤儿的不计
+func (p *OrphanPool) countResolved(index *TxIndex) {
+	n := 0
+	for txid := range p.retrying {
+		if _, ok := index.Entries[txid]; ok {
+			n++
+		}
+	}
+	atomic.AddUint64(&OrphanResolveCount, uint64(n))
+	p.retrying = nil
+}
+
+// removeOrphanTxs 将输入找不到utxo的tx及其批次内子tx移入孤儿池，返回是否有移除
+func (mp *Mempool) removeOrphanTxs() bool {
+	orphans := make(map[string]bool, 0)
+	for _, tx := range mp.BatchTxs {
+		for _, input := range tx.TxIns {
+			key := input.InputOutpointKey
+			if _, ok := mp.NewUtxoDataMap[key]; ok {
+				continue
+			}
+			if _, ok := mp.RemoveUtxoDataMap[key]; ok {
+				continue
+			}
+			if _, ok := mp.SpentUtxoDataMap[key]; ok {
+				continue
+			}
+			logger.Log.Info("orphan tx",
+				zap.String("txid", tx.HashHex),
+				zap.String("utxid", input.InputHashHex),
+				zap.Uint32("vout", input.InputVout))
+			orphans[tx.HashHex] = true
+			break
+		}
+	}
+	if len(orphans) == 0 {
+		return false
+	}
+
+	// 批次内子tx同样等待
+	for {
+		n := len(orphans)
+		for _, tx := range mp.BatchTxs {
+			if orphans[tx.HashHex] {
+				continue
+			}
+			for _, input := range tx.TxIns {
+				if orphans[input.InputHashHex] {
+					orphans[tx.HashHex] = true
+					break
+				}
+			}
+		}
+		if len(orphans) == n {
+			break
+		}
+	}
+
+	batchTxs := make([]*model.Tx, 0, len(mp.BatchTxs))
+	for _, tx := range mp.BatchTxs {
+		if orphans[tx.HashHex] {
+			mp.Orphans.Add(tx)
+			continue
+		}
+		batchTxs = append(batchTxs, tx)
+	}
+	mp.BatchTxs = batchTxs
+
+	logger.Log.Info("remove orphan txs",
+		zap.Int("nOrphan", len(orphans)),
+		zap.Int("nPool", len(mp.Orphans.Txs)))
+	return true
+}
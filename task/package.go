@@ -0,0 +1,55 @@
+package task
+
+import (
+	"satomempool/model"
+)
+
+// Ancestors 返回txid的所有未确认祖先，不含自身
+func (idx *TxIndex) Ancestors(txid string) map[string]bool {
+	return idx.walk(txid, idx.Parents)
+}
+
+// Descendants 返回txid的所有未确认后代，不含自身
+func (idx *TxIndex) Descendants(txid string) map[string]bool {
+	return idx.walk(txid, idx.Children)
+}
+
+func (idx *TxIndex) walk(txid string, edges map[string]map[string]bool) map[string]bool {
+	visited := make(map[string]bool, 0)
+	queue := []string{txid}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for next := range edges[cur] {
+			if visited[next] || next == txid {
+				continue
+			}
+			visited[next] = true
+			queue = append(queue, next)
+		}
+	}
+	return visited
+}
+
+// Package 返回txid及其祖先、后代的数量、大小和手续费，tx未同步时返回nil
+func (idx *TxIndex) Package(txid string) *model.TxPackage {
+	entry, ok := idx.Entries[txid]
+	if !ok {
+		return nil
+	}
+	pkg := entry.Package
+	return &pkg
+}
+
+// syncPackages 更新changed中tx的package统计，并删除removed的记录
+func (mp *Mempool) syncPackages(changed map[string]bool, removed []string) {
+	packages := make(map[string]*model.TxPackage, len(changed))
+	for txid := range changed {
+		if pkg := mp.Index.Package(txid); pkg != nil {
+			packages[txid] = pkg
+		}
+	}
+	for _, sink := range mp.indexSinks() {
+		sink.SyncPackages(packages, removed)
+	}
+}
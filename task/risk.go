@@ -0,0 +1,92 @@
+package task
+
+import (
+	"satomempool/model"
+)
+
+// 风险原因
+const (
+	RiskConflict   = "conflict"   // 自身或祖先有双花
+	RiskNonFinal   = "nonfinal"   // 自身或祖先曾为非final，可能被替换
+	RiskUnresolved = "unresolved" // 自身或祖先有输入找不到utxo
+	RiskLowFee     = "lowfee"     // 连同祖先的手续费率过低
+	RiskLongChain  = "longchain"  // 未确认祖先过多
+)
+
+// riskWeights 各风险原因的分值，总分不超过100
+var riskWeights = map[string]int{
+	RiskConflict:   100,
+	RiskNonFinal:   40,
+	RiskUnresolved: 30,
+	RiskLowFee:     20,
+	RiskLongChain:  10,
+}
+
+// riskReasons 按固定顺序输出原因
+var riskReasons = []string{RiskConflict, RiskNonFinal, RiskUnresolved, RiskLowFee, RiskLongChain}
+
+// TxRisk 评估已同步tx的零确认风险，因双花未同步的tx评分100，其他未同步的tx返回nil
+func (mp *Mempool) TxRisk(txid string) *model.TxRisk {
+	entry, ok := mp.Index.Entries[txid]
+	if !ok {
+		if len(mp.Conflicts[txid]) > 0 {
+			return &model.TxRisk{Score: riskWeights[RiskConflict], Reasons: []string{RiskConflict}}
+		}
+		return nil
+	}
+
+	found := make(map[string]bool, 0)
+	check := func(id string, tx *model.Tx) {
+		if len(mp.Conflicts[id]) > 0 {
+			found[RiskConflict] = true
+		}
+		if mp.promotedTxs[id] {
+			found[RiskNonFinal] = true
+		}
+		if tx.FeeUnresolved {
+			found[RiskUnresolved] = true
+		}
+	}
+	check(txid, entry.Tx)
+	ancestors := mp.Index.Ancestors(txid)
+	for ancestor := range ancestors {
+		check(ancestor, mp.Index.Entries[ancestor].Tx)
+	}
+
+	pkg := mp.Index.Package(txid)
+	if !found[RiskUnresolved] && pkg.AncestorFeeRate() < mp.RiskLowFeeRate {
+		found[RiskLowFee] = true
+	}
+	if mp.RiskMaxAncestors > 0 && len(ancestors) > mp.RiskMaxAncestors {
+		found[RiskLongChain] = true
+	}
+
+	risk := &model.TxRisk{Reasons: make([]string, 0, len(found))}
+	for _, reason := range riskReasons {
+		if !found[reason] {
+			continue
+		}
+		risk.Reasons = append(risk.Reasons, reason)
+		risk.Score += riskWeights[reason]
+	}
+	if risk.Score > 100 {
+		risk.Score = 100
+	}
+	return risk
+}
+
+// syncRisks 更新changed中tx的风险评分，并删除removed的记录
+func (mp *Mempool) syncRisks(changed map[string]bool, removed []string) {
+	risks := make(map[string]*model.TxRisk, len(changed))
+	for txid := range changed {
+		if risk := mp.TxRisk(txid); risk != nil {
+			risks[txid] = risk
+		}
+	}
+	for _, txid := range removed {
+		delete(mp.promotedTxs, txid)
+	}
+	for _, sink := range mp.indexSinks() {
+		sink.SyncRisks(risks, removed)
+	}
+}
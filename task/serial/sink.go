@@ -0,0 +1,110 @@
+package serial
+
+import (
+	"satomempool/logger"
+	"satomempool/metrics"
+	"satomempool/model"
+	"satomempool/store"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RedisSink 将mempool数据写入redis的mp:*键
+type RedisSink struct {
+	EvictedRetention time.Duration // 驱逐记录保留时间，0为一直保留
+}
+
+func (s *RedisSink) Name() string { return "redis" }
+
+// Reset 删除所有mp:*键
+func (s *RedisSink) Reset() bool {
+	FlushdbInRedis()
+	return true
+}
+
+func (s *RedisSink) SyncBatch(b *model.SyncBatch) bool {
+	// 6 dep 2 4
+	defer metrics.ObserveStep("6", time.Now())
+	UpdateUtxoInRedis(b.NewUtxoDataMap, b.RemoveUtxoDataMap, b.SpentUtxoDataMap)
+	UpdateFeeRateInRedis(b.Txs)
+	return true
+}
+
+func (s *RedisSink) RemoveTxs(b *model.RemoveBatch) bool {
+	UpdateUtxoInRedis(b.UtxoToRestore, b.UtxoToRemove, b.UtxoToSpend)
+	RevertSpentUtxoInRedis(b.UtxoToUnspend)
+	RemoveFeeRateInRedis(b.Txids)
+	RemoveConflictsInRedis(b.Txids)
+	return true
+}
+
+func (s *RedisSink) SyncPackages(packages map[string]*model.TxPackage, removed []string) {
+	UpdatePackagesInRedis(packages, removed)
+}
+
+func (s *RedisSink) SyncRisks(risks map[string]*model.TxRisk, removed []string) {
+	UpdateRisksInRedis(risks, removed)
+}
+
+func (s *RedisSink) RecordConflicts(conflicts []*model.TxConflict) {
+	RecordConflictsInRedis(conflicts)
+}
+
+func (s *RedisSink) RecordEvicted(evicted map[string]string) {
+	RecordEvictedTxsInRedis(evicted, s.EvictedRetention)
+}
+
+func (s *RedisSink) SaveFeeStats(rows []*store.FeeHistogramRow, estimates map[int]float64) {
+	UpdateFeeEstimatesInRedis(estimates)
+}
+
+// ClickHouseSink 将mempool tx写入clickhouse的*_mempool_new表后合并到主表
+type ClickHouseSink struct{}
+
+func (s *ClickHouseSink) Name() string { return "clickhouse" }
+
+// Reset 删除主表中的mempool数据，清空*_mempool_new表
+func (s *ClickHouseSink) Reset() bool {
+	return store.ProcessAllSyncCk()
+}
+
+func (s *ClickHouseSink) SyncBatch(b *model.SyncBatch) bool {
+	// 初始化同步数据库表，失败时跳过当前批次
+	if !store.CreatePartSyncCk() || !store.PreparePartSyncCk() {
+		logger.Log.Info("prepare clickhouse sync failed, skip batch", zap.Int("nTx", len(b.Txs)))
+		return false
+	}
+
+	// 2 dep 0
+	start := time.Now()
+	SyncBlockTxOutputInfo(b.StartIdx, b.Txs)
+	metrics.ObserveStep("2", start)
+
+	// 4 dep 3
+	start = time.Now()
+	SyncBlockTxInputDetail(b.StartIdx, b.Txs)
+	metrics.ObserveStep("4", start)
+
+	// 5 dep 2 4
+	start = time.Now()
+	SyncBlockTx(b.StartIdx, b.Txs)
+	metrics.ObserveStep("5", start)
+
+	// ParseEnd 最后分析执行
+	// 7 dep 5
+	start = time.Now()
+	store.CommitSyncCk()
+	store.CommitFullSyncCk(SyncTxFullCount > 0)
+	ok := store.ProcessPartSyncCk()
+	metrics.ObserveStep("7", start)
+	return ok
+}
+
+func (s *ClickHouseSink) RemoveTxs(b *model.RemoveBatch) bool {
+	return store.DeleteMempoolTxsCk(b.TxHashes)
+}
+
+func (s *ClickHouseSink) SaveFeeStats(rows []*store.FeeHistogramRow, estimates map[int]float64) {
+	store.SaveFeeHistogramCk(rows)
+}
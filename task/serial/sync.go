@@ -2,6 +2,7 @@ package serial
 
 import (
 	"satomempool/logger"
+	"satomempool/metrics"
 	"satomempool/model"
 	"satomempool/store"
 
@@ -14,9 +15,88 @@ var (
 	SyncTxCodeHashCount int
 )
 
+// computeTxFee 计算手续费和手续费率，依赖输入输出金额
+func computeTxFee(tx *model.Tx) {
+	tx.Fee = 0
+	tx.FeeRate = 0
+	tx.FeeUnresolved = false
+	for _, input := range tx.TxIns {
+		if input.SpentTxo == nil {
+			tx.FeeUnresolved = true
+			return
+		}
+	}
+	if tx.InputsValue < tx.OutputsValue {
+		tx.FeeUnresolved = true
+		return
+	}
+	tx.Fee = tx.InputsValue - tx.OutputsValue
+	if tx.VSize > 0 {
+		tx.FeeRate = float64(tx.Fee) / float64(tx.VSize)
+	}
+}
+
+// ResolveBatchTxs 补全输入花费的utxo，计算输入输出金额和手续费，在写入各存储之前执行
+func ResolveBatchTxs(txs []*model.Tx, mpNewUtxo, removeUtxo, mpSpentUtxo map[string]*model.TxoData) {
+	for _, tx := range txs {
+		for _, output := range tx.TxOuts {
+			tx.OutputsValue += output.Satoshi
+		}
+
+		for vin, input := range tx.TxIns {
+			objData, ok := mpNewUtxo[input.InputOutpointKey]
+			if !ok {
+				objData, ok = removeUtxo[input.InputOutpointKey]
+			}
+			if !ok {
+				objData, ok = mpSpentUtxo[input.InputOutpointKey]
+			}
+			if !ok {
+				logger.Log.Info("tx-input-err",
+					zap.String("txin", "input missing utxo"),
+					zap.String("txid", tx.HashHex),
+					zap.Int("vin", vin),
+
+					zap.String("utxid", input.InputHashHex),
+					zap.Uint32("vout", input.InputVout),
+				)
+				continue
+			}
+			// 保留副本以备撤销，原数据会被回收
+			txo := *objData
+			input.SpentTxo = &txo
+			tx.InputsValue += objData.Satoshi
+		}
+
+		computeTxFee(tx)
+		if tx.FeeUnresolved {
+			logger.Log.Info("tx fee unresolved", zap.String("txid", tx.HashHex))
+		}
+	}
+}
+
 // SyncBlockTx all tx in block height
 func SyncBlockTx(startIdx int, txs []*model.Tx) {
 	for txIdx, tx := range txs {
+		if _, err := store.SyncStmtTxFee.Exec(
+			string(tx.Hash),
+			tx.Size,
+			tx.Fee,
+			tx.FeeRate,
+			tx.FeeUnresolved,
+			model.MEMPOOL_HEIGHT,
+			uint64(startIdx+txIdx),
+			string(tx.WitnessHash),
+			tx.VSize,
+		); err != nil {
+			metrics.ClickHouseErrors.WithLabelValues("insert").Inc()
+			logger.Log.Info("sync-txfee-err",
+				zap.String("sync", "txfee err"),
+				zap.String("txid", tx.HashHex),
+				zap.String("err", err.Error()),
+			)
+		}
+
 		if _, err := store.SyncStmtTx.Exec(
 			string(tx.Hash),
 			tx.TxInCnt,
@@ -30,6 +110,7 @@ func SyncBlockTx(startIdx int, txs []*model.Tx) {
 			"",                   // string(block.Hash),
 			uint64(startIdx+txIdx),
 		); err != nil {
+			metrics.ClickHouseErrors.WithLabelValues("insert").Inc()
 			logger.Log.Info("sync-tx-err",
 				zap.String("sync", "tx err"),
 				zap.String("txid", tx.HashHex),
@@ -43,8 +124,6 @@ func SyncBlockTx(startIdx int, txs []*model.Tx) {
 func SyncBlockTxOutputInfo(startIdx int, txs []*model.Tx) {
 	for txIdx, tx := range txs {
 		for vout, output := range tx.TxOuts {
-			tx.OutputsValue += output.Satoshi
-
 			var dataValue uint64
 			if output.CodeType == scriptDecoder.CodeType_NFT {
 				dataValue = output.TokenIndex
@@ -66,6 +145,7 @@ func SyncBlockTxOutputInfo(startIdx int, txs []*model.Tx) {
 				model.MEMPOOL_HEIGHT, // uint32(block.Height),
 				uint64(startIdx+txIdx),
 			); err != nil {
+				metrics.ClickHouseErrors.WithLabelValues("insert").Inc()
 				logger.Log.Info("sync-txout-err",
 					zap.String("sync", "txout err"),
 					zap.String("utxid", tx.HashHex),
@@ -78,34 +158,21 @@ func SyncBlockTxOutputInfo(startIdx int, txs []*model.Tx) {
 }
 
 // SyncBlockTxInputDetail all tx input info
-func SyncBlockTxInputDetail(startIdx int, txs []*model.Tx, mpNewUtxo, removeUtxo, mpSpentUtxo map[string]*model.TxoData) {
-	var commonObjData *model.TxoData = &model.TxoData{
-		CodeHash:   make([]byte, 1),
-		GenesisId:  make([]byte, 1),
-		AddressPkh: make([]byte, 1),
-		Satoshi:    0,
-	}
-
+func SyncBlockTxInputDetail(startIdx int, txs []*model.Tx) {
 	for txIdx, tx := range txs {
 		for vin, input := range tx.TxIns {
-			objData := commonObjData
-			if obj, ok := mpNewUtxo[input.InputOutpointKey]; ok {
-				objData = obj
-			} else if obj, ok := removeUtxo[input.InputOutpointKey]; ok {
-				objData = obj
-			} else if obj, ok := mpSpentUtxo[input.InputOutpointKey]; ok {
-				objData = obj
-			} else {
-				logger.Log.Info("tx-input-err",
-					zap.String("txin", "input missing utxo"),
+			// 找不到花费的utxo时不写入txin，避免写入全零的地址和金额
+			objData := input.SpentTxo
+			if objData == nil {
+				metrics.TxInUnresolved.Inc()
+				logger.Log.Info("sync-txin-skip",
+					zap.String("sync", "txin unresolved"),
 					zap.String("txid", tx.HashHex),
-					zap.Int("vin", vin),
-
-					zap.String("utxid", input.InputHashHex),
-					zap.Uint32("vout", input.InputVout),
+					zap.Uint32("vin", uint32(vin)),
 				)
+				continue
 			}
-			tx.InputsValue += objData.Satoshi
+
 			var dataValue uint64
 			if objData.CodeType == scriptDecoder.CodeType_NFT {
 				dataValue = objData.TokenIndex
@@ -135,6 +202,7 @@ func SyncBlockTxInputDetail(startIdx int, txs []*model.Tx, mpNewUtxo, removeUtxo
 				string(objData.ScriptType),
 				string(objData.Script),
 			); err != nil {
+				metrics.ClickHouseErrors.WithLabelValues("insert").Inc()
 				logger.Log.Info("sync-txin-full-err",
 					zap.String("sync", "txin full err"),
 					zap.String("txid", tx.HashHex),
@@ -2,14 +2,19 @@ package serial
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"satomempool/config"
 	"satomempool/logger"
+	"satomempool/metrics"
 	"satomempool/model"
+	"satomempool/utils"
+	"strconv"
+	"strings"
+	"time"
 
 	redis "github.com/go-redis/redis/v8"
 	scriptDecoder "github.com/sensible-contract/sensible-script-decoder"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
@@ -21,34 +26,19 @@ var (
 	ChannelBlockSynced  <-chan *redis.Message
 )
 
-func init() {
-	viper.SetConfigFile("conf/redis.yaml")
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		} else {
-			panic(fmt.Errorf("Fatal error config file: %s \n", err))
-		}
-	}
-
-	addrs := viper.GetStringSlice("addrs")
-	password := viper.GetString("password")
-	database := viper.GetInt("database")
-	dialTimeout := viper.GetDuration("dialTimeout")
-	readTimeout := viper.GetDuration("readTimeout")
-	writeTimeout := viper.GetDuration("writeTimeout")
-	poolSize := viper.GetInt("poolSize")
+// Init 按配置创建redis客户端，并订阅区块同步完成通知
+func Init(cfg *config.RedisConfig) {
 	rdb = redis.NewUniversalClient(&redis.UniversalOptions{
-		Addrs:        addrs,
-		Password:     password,
-		DB:           database,
-		DialTimeout:  dialTimeout,
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
-		PoolSize:     poolSize,
+		Addrs:        cfg.Addrs,
+		Password:     cfg.Password,
+		DB:           cfg.Database,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		PoolSize:     cfg.PoolSize,
 	})
 
-	if len(addrs) > 1 {
+	if len(cfg.Addrs) > 1 {
 		useCluster = true
 	}
 
@@ -56,6 +46,16 @@ func init() {
 	ChannelBlockSynced = SubcribeBlockSynced.Channel()
 }
 
+// execPipeline 执行pipeline，记录命令数和错误
+func execPipeline(op string, pipe redis.Pipeliner) ([]redis.Cmder, error) {
+	cmds, err := pipe.Exec(ctx)
+	metrics.RedisPipelineCmds.WithLabelValues(op).Observe(float64(len(cmds)))
+	if err != nil && err != redis.Nil {
+		metrics.RedisErrors.WithLabelValues(op).Inc()
+	}
+	return cmds, err
+}
+
 func SubcribeBlockSyncFinished() {
 	msg := <-ChannelBlockSynced
 	logger.Log.Info("redis subcribe",
@@ -91,7 +91,7 @@ func ParseGetSpentUtxoDataFromRedisSerial(
 		return
 	}
 
-	_, err := pipe.Exec(ctx)
+	_, err := execPipeline("get", pipe)
 	if err != nil && err != redis.Nil {
 		panic(err)
 	}
@@ -131,36 +131,6 @@ func ParseGetSpentUtxoDataFromRedisSerial(
 	}
 }
 
-// UpdateUtxoInRedisSerial 顺序更新当前区块的utxo信息变化到redis
-func UpdateUtxoInRedisSerial(
-	spentUtxoKeysMap map[string]bool,
-	newUtxoDataMap, removeUtxoDataMap, spentUtxoDataMap map[string]*model.TxoData) {
-
-	insideTxo := make([]string, len(spentUtxoKeysMap))
-	for key := range spentUtxoKeysMap {
-		if data, ok := newUtxoDataMap[key]; !ok {
-			continue
-		} else {
-			model.TxoDataPool.Put(data)
-		}
-		insideTxo = append(insideTxo, key)
-	}
-	for _, key := range insideTxo {
-		delete(newUtxoDataMap, key)
-	}
-
-	for key, data := range newUtxoDataMap {
-		GlobalNewUtxoDataMap[key] = data
-	}
-
-	for key, data := range removeUtxoDataMap {
-		model.TxoDataPool.Put(data)
-		delete(GlobalNewUtxoDataMap, key)
-	}
-
-	UpdateUtxoInRedis(newUtxoDataMap, removeUtxoDataMap, spentUtxoDataMap)
-}
-
 func FlushdbInRedis() {
 	logger.Log.Info("FlushdbInRedis start")
 	keys, err := rdb.SMembers(ctx, "mp:keys").Result()
@@ -178,13 +148,25 @@ func FlushdbInRedis() {
 		pipe.Del(ctx, key)
 	}
 	pipe.Del(ctx, "mp:keys")
-	_, err = pipe.Exec(ctx)
+	_, err = execPipeline("flush", pipe)
 	if err != nil {
 		panic(err)
 	}
 	logger.Log.Info("FlushdbInRedis finish")
 }
 
+// scriptHashKey 锁定脚本的sha256(electrum风格，键中为原始字节顺序)，不可花费的OP_RETURN输出返回false
+func scriptHashKey(script []byte) (string, bool) {
+	if len(script) > 0 && script[0] == 0x6a {
+		return "", false
+	}
+	if len(script) > 1 && script[0] == 0x00 && script[1] == 0x6a {
+		return "", false
+	}
+	hash := sha256.Sum256(script)
+	return string(hash[:]), true
+}
+
 // UpdateUtxoInRedis 批量更新redis utxo
 func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*model.TxoData) (err error) {
 	logger.Log.Info("UpdateUtxoInRedis",
@@ -206,6 +188,16 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 
 		// redis有序utxo数据添加
 		member := &redis.Z{Score: float64(data.BlockHeight)*1000000000 + float64(data.TxIdx), Member: outpointKey}
+
+		// 按脚本hash记录所有可花费的utxo，包括无法识别地址的脚本
+		if strScriptHash, ok := scriptHashKey(data.Script); ok {
+			mpkeySU := "mp:{su" + strScriptHash + "}"
+			pipe.ZAdd(ctx, mpkeySU, &redis.Z{Score: member.Score, Member: outpointKey})
+			mpkeySB := "mp:sb" + strScriptHash
+			pipe.IncrBy(ctx, mpkeySB, int64(data.Satoshi))
+			mpkeys = append(mpkeys, mpkeySU, mpkeySB)
+		}
+
 		if len(data.AddressPkh) < 20 {
 			// 无法识别地址，暂不记录utxo
 			logger.Log.Info("ignore mp:utxo", zap.String("key", hex.EncodeToString([]byte(outpointKey))), zap.Float64("score", member.Score))
@@ -218,7 +210,7 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 			// 不是合约tx，则记录address utxo
 			// redis有序address utxo数据添加
 			logger.Log.Info("ZAdd mp:au",
-				zap.String("addrHex", hex.EncodeToString(data.AddressPkh)),
+				zap.String("address", utils.EncodeAddress(data.AddressPkh)),
 				zap.String("key", hex.EncodeToString([]byte(outpointKey))),
 				zap.Float64("score", member.Score))
 			mpkeyAU := "mp:{au" + strAddressPkh + "}"
@@ -226,7 +218,7 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 
 			// balance of address
 			logger.Log.Info("IncrBy mp:bl",
-				zap.String("addrHex", hex.EncodeToString(data.AddressPkh)),
+				zap.String("address", utils.EncodeAddress(data.AddressPkh)),
 				zap.Uint64("satoshi", data.Satoshi))
 			mpkeyBL := "mp:bl" + strAddressPkh
 			pipe.IncrBy(ctx, mpkeyBL, int64(data.Satoshi))
@@ -237,7 +229,7 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 
 		// contract balance of address
 		logger.Log.Info("IncrBy mp:cb",
-			zap.String("addrHex", hex.EncodeToString(data.AddressPkh)),
+			zap.String("address", utils.EncodeAddress(data.AddressPkh)),
 			zap.Uint64("satoshi", data.Satoshi))
 		mpkeyCB := "mp:cb" + strAddressPkh
 		pipe.IncrBy(ctx, mpkeyCB, int64(data.Satoshi))
@@ -312,6 +304,13 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 		strGenesisId := string(data.GenesisId)
 
 		// redis有序utxo数据清除
+		if strScriptHash, ok := scriptHashKey(data.Script); ok {
+			mpkeySU := "mp:{su" + strScriptHash + "}"
+			pipe.ZRem(ctx, mpkeySU, key)
+			mpkeySB := "mp:sb" + strScriptHash
+			pipe.DecrBy(ctx, mpkeySB, int64(data.Satoshi))
+		}
+
 		if len(data.AddressPkh) < 20 {
 			// 无法识别地址，暂不记录utxo
 			// pipe.ZRem(ctx, "mp:utxo", key)
@@ -373,6 +372,15 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 
 		// redis有序utxo数据添加
 		member := &redis.Z{Score: float64(data.BlockHeight)*1000000000 + float64(data.TxIdx), Member: outpointKey}
+
+		if strScriptHash, ok := scriptHashKey(data.Script); ok {
+			mpkeySU := "mp:s:{su" + strScriptHash + "}"
+			pipe.ZAdd(ctx, mpkeySU, &redis.Z{Score: member.Score, Member: outpointKey})
+			mpkeySB := "mp:sb" + strScriptHash
+			pipe.DecrBy(ctx, mpkeySB, int64(data.Satoshi))
+			mpkeys = append(mpkeys, mpkeySU, mpkeySB)
+		}
+
 		if len(data.AddressPkh) < 20 {
 			// 无法识别地址，暂不记录utxo
 			// pipe.ZAdd(ctx, "mp:s:utxo", member)
@@ -448,9 +456,313 @@ func UpdateUtxoInRedis(utxoToRestore, utxoToRemove, utxoToSpend map[string]*mode
 		pipe.SAdd(ctx, "mp:keys", mpkey)
 	}
 
-	_, err = pipe.Exec(ctx)
+	_, err = execPipeline("utxo", pipe)
+	if err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// RevertSpentUtxoInRedis 撤销mempool对已确认utxo的花费记录，用于tx被确认或驱逐
+func RevertSpentUtxoInRedis(utxoToUnspend map[string]*model.TxoData) (err error) {
+	logger.Log.Info("RevertSpentUtxoInRedis",
+		zap.Int("nUnspend", len(utxoToUnspend)))
+	if len(utxoToUnspend) == 0 {
+		return nil
+	}
+
+	pipe := rdb.Pipeline()
+	addrToRemove := make(map[string]bool, 1)
+	tokenToRemove := make(map[string]bool, 1)
+	for outpointKey, data := range utxoToUnspend {
+		strAddressPkh := string(data.AddressPkh)
+		strCodeHash := string(data.CodeHash)
+		strGenesisId := string(data.GenesisId)
+
+		if strScriptHash, ok := scriptHashKey(data.Script); ok {
+			mpkeySU := "mp:s:{su" + strScriptHash + "}"
+			pipe.ZRem(ctx, mpkeySU, outpointKey)
+			mpkeySB := "mp:sb" + strScriptHash
+			pipe.IncrBy(ctx, mpkeySB, int64(data.Satoshi))
+		}
+
+		if len(data.AddressPkh) < 20 {
+			// 无法识别地址，暂不记录utxo
+			continue
+		}
+
+		if len(data.GenesisId) < 20 {
+			// 不是合约tx，则记录address utxo
+			mpkeyAU := "mp:s:{au" + strAddressPkh + "}"
+			pipe.ZRem(ctx, mpkeyAU, outpointKey)
+
+			// balance of address
+			mpkeyBL := "mp:bl" + strAddressPkh
+			pipe.IncrBy(ctx, mpkeyBL, int64(data.Satoshi))
+			continue
+		}
+
+		// contract balance of address
+		mpkeyCB := "mp:cb" + strAddressPkh
+		pipe.IncrBy(ctx, mpkeyCB, int64(data.Satoshi))
+
+		if data.CodeType == scriptDecoder.CodeType_NFT {
+			mpkeyNU := "mp:s:{nu" + strAddressPkh + "}" + strCodeHash + strGenesisId
+			pipe.ZRem(ctx, mpkeyNU, outpointKey) // nft:utxo
+			mpkeyND := "mp:s:nd" + strCodeHash + strGenesisId
+			pipe.ZRem(ctx, mpkeyND, outpointKey) // nft:utxo-detail
+			mpkeyNO := "mp:{no" + strGenesisId + strCodeHash + "}"
+			pipe.ZIncrBy(ctx, mpkeyNO, 1, strAddressPkh) // nft:owners
+			mpkeyNS := "mp:{ns" + strAddressPkh + "}"
+			pipe.ZIncrBy(ctx, mpkeyNS, 1, strCodeHash+strGenesisId) // nft:summary
+
+		} else if data.CodeType == scriptDecoder.CodeType_FT {
+			mpkeyFU := "mp:s:{fu" + strAddressPkh + "}" + strCodeHash + strGenesisId
+			pipe.ZRem(ctx, mpkeyFU, outpointKey) // ft:utxo
+			mpkeyFB := "mp:{fb" + strGenesisId + strCodeHash + "}"
+			pipe.ZIncrBy(ctx, mpkeyFB, float64(data.Amount), strAddressPkh) // ft:balance
+			mpkeyFS := "mp:{fs" + strAddressPkh + "}"
+			pipe.ZIncrBy(ctx, mpkeyFS, float64(data.Amount), strCodeHash+strGenesisId) // ft:summary
+
+		} else if data.CodeType == scriptDecoder.CodeType_UNIQUE {
+			mpkeyFU := "mp:s:{fu" + strAddressPkh + "}" + strCodeHash + strGenesisId
+			pipe.ZRem(ctx, mpkeyFU, outpointKey) // ft:utxo
+		}
+
+		// 记录key以备删除
+		tokenToRemove[strGenesisId+strCodeHash] = true
+		addrToRemove[strAddressPkh] = true
+	}
+
+	// 删除summary 为0的记录
+	for codeKey := range tokenToRemove {
+		pipe.ZRemRangeByScore(ctx, "mp:{no"+codeKey+"}", "0", "0")
+		pipe.ZRemRangeByScore(ctx, "mp:{fb"+codeKey+"}", "0", "0")
+	}
+	// 删除balance 为0的记录
+	for addr := range addrToRemove {
+		pipe.ZRemRangeByScore(ctx, "mp:{ns"+addr+"}", "0", "0")
+		pipe.ZRemRangeByScore(ctx, "mp:{fs"+addr+"}", "0", "0")
+	}
+
+	_, err = execPipeline("unspend", pipe)
 	if err != nil {
 		panic(err)
 	}
 	return nil
 }
+
+// RecordEvictedTxsInRedis 记录被驱逐的tx及原因，txid -> reason，并删除超过retention的记录
+func RecordEvictedTxsInRedis(evicted map[string]string, retention time.Duration) {
+	if len(evicted) == 0 {
+		return
+	}
+	now := time.Now()
+	var expired []string
+	if retention > 0 {
+		var err error
+		expired, err = rdb.ZRangeByScore(ctx, "mp:evictedtime", &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(now.Add(-retention).Unix(), 10),
+		}).Result()
+		if err != nil {
+			metrics.RedisErrors.WithLabelValues("evicted").Inc()
+			panic(err)
+		}
+	}
+
+	pipe := rdb.Pipeline()
+	if len(expired) > 0 {
+		members := make([]interface{}, 0, len(expired))
+		for _, txid := range expired {
+			members = append(members, txid)
+		}
+		pipe.HDel(ctx, "mp:evicted", expired...)
+		pipe.ZRem(ctx, "mp:evictedtime", members...)
+	}
+	for txid, reason := range evicted {
+		pipe.HSet(ctx, "mp:evicted", txid, reason)
+		pipe.ZAdd(ctx, "mp:evictedtime", &redis.Z{Score: float64(now.Unix()), Member: txid})
+	}
+	pipe.SAdd(ctx, "mp:keys", "mp:evicted", "mp:evictedtime")
+	_, err := execPipeline("evicted", pipe)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RecordConflictsInRedis 记录双花，冲突双方各自记录 outpoint -> 对方txid
+func RecordConflictsInRedis(conflicts []*model.TxConflict) {
+	if len(conflicts) == 0 {
+		return
+	}
+	pipe := rdb.Pipeline()
+	for _, c := range conflicts {
+		outpoint := utils.OutpointString(c.OutpointKey)
+
+		mpkeyFirst := "mp:ds" + c.FirstTxid
+		pipe.HSet(ctx, mpkeyFirst, outpoint, c.SecondTxid)
+		mpkeySecond := "mp:ds" + c.SecondTxid
+		pipe.HSet(ctx, mpkeySecond, outpoint, c.FirstTxid)
+
+		pipe.SAdd(ctx, "mp:keys", mpkeyFirst, mpkeySecond)
+	}
+	_, err := execPipeline("conflict", pipe)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RemoveConflictsInRedis 删除已确认或被驱逐tx的双花记录，以及与之冲突而未同步的tx的双花和风险记录
+func RemoveConflictsInRedis(txids []string) {
+	if len(txids) == 0 {
+		return
+	}
+	pipe := rdb.Pipeline()
+	others := make([]*redis.StringSliceCmd, 0, len(txids))
+	for _, txid := range txids {
+		others = append(others, pipe.HVals(ctx, "mp:ds"+txid))
+	}
+	if _, err := execPipeline("conflict", pipe); err != nil {
+		panic(err)
+	}
+
+	keys := make([]string, 0, len(txids))
+	for i, txid := range txids {
+		keys = append(keys, "mp:ds"+txid)
+		for _, other := range others[i].Val() {
+			keys = append(keys, "mp:ds"+other, "mp:rk"+other)
+		}
+	}
+	members := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		members = append(members, key)
+	}
+	pipe = rdb.Pipeline()
+	pipe.Del(ctx, keys...)
+	pipe.SRem(ctx, "mp:keys", members...)
+	if _, err := execPipeline("conflict", pipe); err != nil {
+		panic(err)
+	}
+}
+
+// UpdateFeeRateInRedis 按手续费率记录mempool tx，无法计算手续费的tx不记录
+func UpdateFeeRateInRedis(txs []*model.Tx) {
+	pipe := rdb.Pipeline()
+	needExec := false
+	for _, tx := range txs {
+		if tx.FeeUnresolved {
+			continue
+		}
+		needExec = true
+		pipe.ZAdd(ctx, "mp:feerate", &redis.Z{Score: tx.FeeRate, Member: tx.HashHex})
+	}
+	if !needExec {
+		return
+	}
+	pipe.SAdd(ctx, "mp:keys", "mp:feerate")
+	_, err := execPipeline("feerate", pipe)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RemoveFeeRateInRedis 删除已确认或被驱逐tx的手续费率记录
+func RemoveFeeRateInRedis(txids []string) {
+	if len(txids) == 0 {
+		return
+	}
+	members := make([]interface{}, 0, len(txids))
+	for _, txid := range txids {
+		members = append(members, txid)
+	}
+	if err := rdb.ZRem(ctx, "mp:feerate", members...).Err(); err != nil {
+		metrics.RedisErrors.WithLabelValues("feerate").Inc()
+		panic(err)
+	}
+}
+
+// UpdateFeeEstimatesInRedis 记录手续费率估算，目标区块数 -> sat/byte，无法估算时为-1
+func UpdateFeeEstimatesInRedis(estimates map[int]float64) {
+	pipe := rdb.Pipeline()
+	for nBlocks, feeRate := range estimates {
+		pipe.HSet(ctx, "mp:fee", strconv.Itoa(nBlocks), feeRate)
+	}
+	pipe.SAdd(ctx, "mp:keys", "mp:fee")
+	_, err := execPipeline("fee", pipe)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// UpdatePackagesInRedis 记录tx的未确认祖先/后代统计，删除已移除tx的记录
+func UpdatePackagesInRedis(packages map[string]*model.TxPackage, removed []string) {
+	if len(packages) == 0 && len(removed) == 0 {
+		return
+	}
+	pipe := rdb.Pipeline()
+	for txid, pkg := range packages {
+		mpkeyPK := "mp:pk" + txid
+		pipe.HSet(ctx, mpkeyPK,
+			"ancestors", pkg.AncestorCount,
+			"ancestorsize", pkg.AncestorSize,
+			"ancestorfee", pkg.AncestorFee,
+			"ancestorfeerate", pkg.AncestorFeeRate(),
+			"descendants", pkg.DescendantCount,
+			"descendantsize", pkg.DescendantSize,
+			"descendantfee", pkg.DescendantFee,
+		)
+		pipe.SAdd(ctx, "mp:keys", mpkeyPK)
+	}
+	for _, txid := range removed {
+		mpkeyPK := "mp:pk" + txid
+		pipe.Del(ctx, mpkeyPK)
+		pipe.SRem(ctx, "mp:keys", mpkeyPK)
+	}
+	_, err := execPipeline("package", pipe)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// UpdateRisksInRedis 记录tx的零确认风险评分和原因，删除已移除tx的记录
+func UpdateRisksInRedis(risks map[string]*model.TxRisk, removed []string) {
+	if len(risks) == 0 && len(removed) == 0 {
+		return
+	}
+	pipe := rdb.Pipeline()
+	for txid, risk := range risks {
+		mpkeyRK := "mp:rk" + txid
+		pipe.HSet(ctx, mpkeyRK,
+			"score", risk.Score,
+			"reasons", strings.Join(risk.Reasons, ","),
+		)
+		pipe.SAdd(ctx, "mp:keys", mpkeyRK)
+	}
+	for _, txid := range removed {
+		mpkeyRK := "mp:rk" + txid
+		pipe.Del(ctx, mpkeyRK)
+		pipe.SRem(ctx, "mp:keys", mpkeyRK)
+	}
+	_, err := execPipeline("risk", pipe)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// CloseRedis 关闭新块通知订阅和redis连接
+func CloseRedis() (err error) {
+	if err = SubcribeBlockSynced.Close(); err != nil {
+		logger.Log.Info("close redis subscribe failed", zap.Error(err))
+	}
+	if e := rdb.Close(); e != nil {
+		logger.Log.Info("close redis failed", zap.Error(e))
+		err = e
+	}
+	return err
+}
+
+// PingRedis 检查redis是否可用
+func PingRedis(ctx context.Context) error {
+	return rdb.Ping(ctx).Err()
+}
@@ -18,3 +18,28 @@ func CleanUtxoMap() {
 
 	runtime.GC()
 }
+
+// UpdateGlobalUtxoMap 记录当前批次新产生的utxo，批次内已花费的utxo不再保存
+func UpdateGlobalUtxoMap(spentUtxoKeysMap map[string]bool, newUtxoDataMap, removeUtxoDataMap map[string]*model.TxoData) {
+	insideTxo := make([]string, 0, len(spentUtxoKeysMap))
+	for key := range spentUtxoKeysMap {
+		if data, ok := newUtxoDataMap[key]; !ok {
+			continue
+		} else {
+			model.TxoDataPool.Put(data)
+		}
+		insideTxo = append(insideTxo, key)
+	}
+	for _, key := range insideTxo {
+		delete(newUtxoDataMap, key)
+	}
+
+	for key, data := range newUtxoDataMap {
+		GlobalNewUtxoDataMap[key] = data
+	}
+
+	for key, data := range removeUtxoDataMap {
+		model.TxoDataPool.Put(data)
+		delete(GlobalNewUtxoDataMap, key)
+	}
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"satomempool/logger"
+	"satomempool/model"
+	"satomempool/store"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Sink 同步结果的存储，如redis、clickhouse
+type Sink interface {
+	Name() string
+	// Reset 全量同步前清空已同步的mempool数据
+	Reset() bool
+	// SyncBatch 写入新同步的批次，utxo信息已补全。失败时返回false
+	SyncBatch(b *model.SyncBatch) bool
+	// RemoveTxs 撤销已确认或被驱逐的tx
+	RemoveTxs(b *model.RemoveBatch) bool
+}
+
+// IndexSink 可选，保存tx之间的关系: package统计、风险评分、双花和驱逐记录
+type IndexSink interface {
+	SyncPackages(packages map[string]*model.TxPackage, removed []string)
+	SyncRisks(risks map[string]*model.TxRisk, removed []string)
+	RecordConflicts(conflicts []*model.TxConflict)
+	RecordEvicted(evicted map[string]string)
+}
+
+// FeeStatsSink 可选，保存手续费率分布和估算结果
+type FeeStatsSink interface {
+	SaveFeeStats(rows []*store.FeeHistogramRow, estimates map[int]float64)
+}
+
+// lockSinks 写入存储前调用，返回的函数在写入完成后调用
+func (mp *Mempool) lockSinks() (unlock func()) {
+	mp.sinkMu.Lock()
+	return mp.sinkMu.Unlock
+}
+
+// WaitSinks 等待正在进行的存储写入完成，之后不再写入。强制退出前调用
+func (mp *Mempool) WaitSinks() {
+	mp.sinkMu.Lock()
+}
+
+// ResetSinks 全量同步前清空所有存储
+func (mp *Mempool) ResetSinks() {
+	defer mp.lockSinks()()
+	for _, sink := range mp.Sinks {
+		if !sink.Reset() {
+			logger.Log.Info("reset sink failed", zap.String("sink", sink.Name()))
+		}
+	}
+}
+
+// syncBatchToSinks 并行写入所有存储，任一存储失败时返回false
+func (mp *Mempool) syncBatchToSinks(b *model.SyncBatch) bool {
+	var wg sync.WaitGroup
+	results := make([]bool, len(mp.Sinks))
+	for i, sink := range mp.Sinks {
+		wg.Add(1)
+		go func(i int, sink Sink) {
+			defer wg.Done()
+			results[i] = sink.SyncBatch(b)
+		}(i, sink)
+	}
+	wg.Wait()
+
+	ok := true
+	for i, sink := range mp.Sinks {
+		if !results[i] {
+			logger.Log.Info("sync batch failed", zap.String("sink", sink.Name()), zap.Int("nTx", len(b.Txs)))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// removeTxsFromSinks 从所有存储撤销tx，任一存储失败时返回false
+func (mp *Mempool) removeTxsFromSinks(b *model.RemoveBatch) bool {
+	ok := true
+	for _, sink := range mp.Sinks {
+		if !sink.RemoveTxs(b) {
+			logger.Log.Info("remove txs failed", zap.String("sink", sink.Name()), zap.Int("nTx", len(b.Txids)))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// indexSinks 支持IndexSink的存储
+func (mp *Mempool) indexSinks() (sinks []IndexSink) {
+	for _, sink := range mp.Sinks {
+		if s, ok := sink.(IndexSink); ok {
+			sinks = append(sinks, s)
+		}
+	}
+	return sinks
+}
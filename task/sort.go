@@ -0,0 +1,86 @@
+package task
+
+import (
+	"container/heap"
+	"satomempool/logger"
+	"satomempool/model"
+
+	"go.uber.org/zap"
+)
+
+// txIdxHeap 按到达顺序出队
+type txIdxHeap []int
+
+func (h txIdxHeap) Len() int            { return len(h) }
+func (h txIdxHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h txIdxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *txIdxHeap) Push(x interface{}) { *h = append(*h, x.(int)) }
+func (h *txIdxHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// sortBatchTxs 按批次内的输入引用拓扑排序，父tx总在子tx之前，无依赖的tx保持到达顺序
+func (mp *Mempool) sortBatchTxs() {
+	n := len(mp.BatchTxs)
+	if n < 2 {
+		return
+	}
+
+	pos := make(map[string]int, n)
+	for idx, tx := range mp.BatchTxs {
+		pos[tx.HashHex] = idx
+	}
+
+	inDegree := make([]int, n)
+	children := make([][]int, n)
+	for idx, tx := range mp.BatchTxs {
+		parents := make(map[int]bool, 0)
+		for _, input := range tx.TxIns {
+			parent, ok := pos[input.InputHashHex]
+			if !ok || parent == idx || parents[parent] {
+				continue
+			}
+			parents[parent] = true
+			children[parent] = append(children[parent], idx)
+			inDegree[idx]++
+		}
+	}
+
+	ready := &txIdxHeap{}
+	for idx := 0; idx < n; idx++ {
+		if inDegree[idx] == 0 {
+			*ready = append(*ready, idx)
+		}
+	}
+	heap.Init(ready)
+
+	sorted := make([]*model.Tx, 0, n)
+	nMoved := 0
+	for ready.Len() > 0 {
+		idx := heap.Pop(ready).(int)
+		if idx != len(sorted) {
+			nMoved++
+		}
+		sorted = append(sorted, mp.BatchTxs[idx])
+		for _, child := range children[idx] {
+			inDegree[child]--
+			if inDegree[child] == 0 {
+				heap.Push(ready, child)
+			}
+		}
+	}
+
+	// 不应出现循环引用，保险起见保持原顺序
+	if len(sorted) != n {
+		logger.Log.Info("sort batch txs failed", zap.Int("nTx", n), zap.Int("nSorted", len(sorted)))
+		return
+	}
+	if nMoved > 0 {
+		logger.Log.Info("sort batch txs", zap.Int("nTx", n), zap.Int("nMoved", nMoved))
+	}
+	mp.BatchTxs = sorted
+}
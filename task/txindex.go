@@ -0,0 +1,168 @@
+package task
+
+import (
+	"satomempool/model"
+)
+
+// TxEntry 已同步到redis/clickhouse的mempool tx
+type TxEntry struct {
+	Tx      *model.Tx
+	TxIdx   uint64
+	Package model.TxPackage // 随祖先、后代的加入和移除增量更新
+}
+
+// TxIndex 已同步的mempool tx索引，用于新块确认或驱逐时只撤销相关tx的影响
+type TxIndex struct {
+	Entries   map[string]*TxEntry // txid -> tx
+	Spenders  map[string]string   // outpointKey -> 花费该utxo的txid
+	Histogram *FeeHistogram       // 手续费率分布
+
+	Parents  map[string]map[string]bool // txid -> 未确认的父tx
+	Children map[string]map[string]bool // txid -> 未确认的子tx
+
+	changed map[string]bool // 上次takeChanged后package统计有变化的tx
+}
+
+func NewTxIndex() *TxIndex {
+	return &TxIndex{
+		Entries:   make(map[string]*TxEntry, 0),
+		Spenders:  make(map[string]string, 0),
+		Histogram: NewFeeHistogram(),
+		Parents:   make(map[string]map[string]bool, 0),
+		Children:  make(map[string]map[string]bool, 0),
+		changed:   make(map[string]bool, 0),
+	}
+}
+
+// Add 加入tx并累加到祖先的后代统计中。父tx总在子tx之前加入
+func (idx *TxIndex) Add(tx *model.Tx, txIdx uint64) {
+	entry := &TxEntry{
+		Tx:    tx,
+		TxIdx: txIdx,
+		Package: model.TxPackage{
+			AncestorCount:   1,
+			AncestorSize:    uint64(tx.VSize),
+			AncestorFee:     tx.Fee,
+			DescendantCount: 1,
+			DescendantSize:  uint64(tx.VSize),
+			DescendantFee:   tx.Fee,
+		},
+	}
+	idx.Entries[tx.HashHex] = entry
+	for _, input := range tx.TxIns {
+		idx.Spenders[input.InputOutpointKey] = tx.HashHex
+
+		parent := input.InputHashHex
+		if _, ok := idx.Entries[parent]; !ok || parent == tx.HashHex {
+			continue
+		}
+		if idx.Parents[tx.HashHex] == nil {
+			idx.Parents[tx.HashHex] = make(map[string]bool, 1)
+		}
+		idx.Parents[tx.HashHex][parent] = true
+		if idx.Children[parent] == nil {
+			idx.Children[parent] = make(map[string]bool, 1)
+		}
+		idx.Children[parent][tx.HashHex] = true
+	}
+	idx.Histogram.Add(tx)
+
+	for ancestor := range idx.Ancestors(tx.HashHex) {
+		pkg := &idx.Entries[ancestor].Package
+		pkg.DescendantCount++
+		pkg.DescendantSize += uint64(tx.VSize)
+		pkg.DescendantFee += tx.Fee
+		idx.changed[ancestor] = true
+
+		ancestorTx := idx.Entries[ancestor].Tx
+		entry.Package.AncestorCount++
+		entry.Package.AncestorSize += uint64(ancestorTx.VSize)
+		entry.Package.AncestorFee += ancestorTx.Fee
+	}
+	idx.changed[tx.HashHex] = true
+}
+
+// Remove 移除一组tx，从留下的祖先的后代统计、留下的后代的祖先统计中扣除。
+// 先按移除前的依赖关系计算，移除顺序不影响结果
+func (idx *TxIndex) Remove(txids []string) {
+	removed := make(map[string]bool, len(txids))
+	for _, txid := range txids {
+		if _, ok := idx.Entries[txid]; ok {
+			removed[txid] = true
+		}
+	}
+	for txid := range removed {
+		tx := idx.Entries[txid].Tx
+		for ancestor := range idx.Ancestors(txid) {
+			if removed[ancestor] {
+				continue
+			}
+			pkg := &idx.Entries[ancestor].Package
+			pkg.DescendantCount--
+			pkg.DescendantSize -= uint64(tx.VSize)
+			pkg.DescendantFee -= tx.Fee
+			idx.changed[ancestor] = true
+		}
+		for descendant := range idx.Descendants(txid) {
+			if removed[descendant] {
+				continue
+			}
+			pkg := &idx.Entries[descendant].Package
+			pkg.AncestorCount--
+			pkg.AncestorSize -= uint64(tx.VSize)
+			pkg.AncestorFee -= tx.Fee
+			idx.changed[descendant] = true
+		}
+	}
+	for txid := range removed {
+		idx.remove(txid)
+	}
+}
+
+func (idx *TxIndex) remove(txid string) {
+	entry := idx.Entries[txid]
+	delete(idx.changed, txid)
+	delete(idx.Entries, txid)
+	idx.Histogram.Remove(entry.Tx)
+	for _, input := range entry.Tx.TxIns {
+		if spender, ok := idx.Spenders[input.InputOutpointKey]; ok && spender == txid {
+			delete(idx.Spenders, input.InputOutpointKey)
+		}
+	}
+
+	for parent := range idx.Parents[txid] {
+		delete(idx.Children[parent], txid)
+		if len(idx.Children[parent]) == 0 {
+			delete(idx.Children, parent)
+		}
+	}
+	for child := range idx.Children[txid] {
+		delete(idx.Parents[child], txid)
+		if len(idx.Parents[child]) == 0 {
+			delete(idx.Parents, child)
+		}
+	}
+	delete(idx.Parents, txid)
+	delete(idx.Children, txid)
+}
+
+// takeChanged 返回上次调用后package统计有变化且仍在索引中的tx
+func (idx *TxIndex) takeChanged() map[string]bool {
+	changed := idx.changed
+	idx.changed = make(map[string]bool, 0)
+	return changed
+}
+
+// SpentTxo 返回txid花费outpointKey时记录的utxo
+func (idx *TxIndex) SpentTxo(txid, outpointKey string) *model.TxoData {
+	entry, ok := idx.Entries[txid]
+	if !ok {
+		return nil
+	}
+	for _, input := range entry.Tx.TxIns {
+		if input.InputOutpointKey == outpointKey {
+			return input.SpentTxo
+		}
+	}
+	return nil
+}
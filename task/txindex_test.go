@@ -0,0 +1,168 @@
+package task
+
+import (
+	"fmt"
+	"math/rand"
+	"satomempool/model"
+	"testing"
+)
+
+// indexTx 花费parents各自第0个输出的tx
+func indexTx(txid string, vsize uint32, fee uint64, parents ...string) *model.Tx {
+	tx := &model.Tx{HashHex: txid, VSize: vsize, Fee: fee}
+	for _, parent := range parents {
+		tx.TxIns = append(tx.TxIns, &model.TxIn{
+			InputHashHex:     parent,
+			InputOutpointKey: parent + ":0",
+		})
+	}
+	if len(parents) == 0 {
+		tx.TxIns = append(tx.TxIns, &model.TxIn{
+			InputHashHex:     "confirmed-" + txid,
+			InputOutpointKey: "confirmed-" + txid + ":0",
+		})
+	}
+	return tx
+}
+
+// walkPackage 按依赖关系重新统计，与增量维护的结果对比
+func walkPackage(idx *TxIndex, txid string) model.TxPackage {
+	tx := idx.Entries[txid].Tx
+	pkg := model.TxPackage{
+		AncestorCount:   1,
+		AncestorSize:    uint64(tx.VSize),
+		AncestorFee:     tx.Fee,
+		DescendantCount: 1,
+		DescendantSize:  uint64(tx.VSize),
+		DescendantFee:   tx.Fee,
+	}
+	for ancestor := range idx.Ancestors(txid) {
+		tx := idx.Entries[ancestor].Tx
+		pkg.AncestorCount++
+		pkg.AncestorSize += uint64(tx.VSize)
+		pkg.AncestorFee += tx.Fee
+	}
+	for descendant := range idx.Descendants(txid) {
+		tx := idx.Entries[descendant].Tx
+		pkg.DescendantCount++
+		pkg.DescendantSize += uint64(tx.VSize)
+		pkg.DescendantFee += tx.Fee
+	}
+	return pkg
+}
+
+func checkPackages(t *testing.T, idx *TxIndex) {
+	t.Helper()
+	for txid := range idx.Entries {
+		if got, want := *idx.Package(txid), walkPackage(idx, txid); got != want {
+			t.Errorf("package %s = %+v, want %+v", txid, got, want)
+		}
+	}
+}
+
+// diamondIndex a -> b, c -> d -> e
+func diamondIndex() *TxIndex {
+	idx := NewTxIndex()
+	idx.Add(indexTx("a", 100, 100), 0)
+	idx.Add(indexTx("b", 200, 400, "a"), 1)
+	idx.Add(indexTx("c", 300, 300, "a"), 2)
+	idx.Add(indexTx("d", 150, 1500, "b", "c"), 3)
+	idx.Add(indexTx("e", 100, 50, "d"), 4)
+	return idx
+}
+
+func TestTxIndexPackage(t *testing.T) {
+	t.Run("add", func(t *testing.T) {
+		idx := diamondIndex()
+		checkPackages(t, idx)
+		if got := *idx.Package("d"); got.AncestorCount != 4 || got.AncestorSize != 750 || got.AncestorFee != 2300 {
+			t.Errorf("d ancestors = %+v", got)
+		}
+		if got := *idx.Package("a"); got.DescendantCount != 5 || got.DescendantSize != 850 || got.DescendantFee != 2350 {
+			t.Errorf("a descendants = %+v", got)
+		}
+	})
+
+	for _, c := range []struct {
+		name    string
+		removed []string
+	}{
+		{"confirm root", []string{"a"}},
+		{"confirm ancestors", []string{"a", "b", "c"}},
+		{"evict descendants", []string{"d", "e"}},
+		{"evict branch", []string{"e", "d", "c"}},
+		{"evict all", []string{"e", "a", "c", "d", "b"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			idx := diamondIndex()
+			idx.takeChanged()
+			idx.Remove(c.removed)
+			for _, txid := range c.removed {
+				if idx.Package(txid) != nil {
+					t.Errorf("%s not removed", txid)
+				}
+			}
+			checkPackages(t, idx)
+		})
+	}
+
+	t.Run("changed", func(t *testing.T) {
+		idx := diamondIndex()
+		idx.takeChanged()
+
+		// b不受影响，不再写入
+		idx.Add(indexTx("f", 100, 100, "c"), 5)
+		if got := idx.takeChanged(); len(got) != 3 || !got["a"] || !got["c"] || !got["f"] {
+			t.Errorf("changed after add = %v, want a, c, f", got)
+		}
+
+		idx.Remove([]string{"e"})
+		if got := idx.takeChanged(); len(got) != 4 || !got["b"] || got["e"] {
+			t.Errorf("changed after remove = %v, want a, b, c, d", got)
+		}
+		if got := idx.takeChanged(); len(got) != 0 {
+			t.Errorf("changed not reset: %v", got)
+		}
+	})
+
+	t.Run("random chains", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		idx := NewTxIndex()
+		txids := make([]string, 0)
+		for i := 0; i < 200; i++ {
+			txid := fmt.Sprintf("tx%d", i)
+			parents := make([]string, 0)
+			for _, parent := range txids {
+				if rnd.Intn(40) == 0 {
+					parents = append(parents, parent)
+				}
+			}
+			idx.Add(indexTx(txid, uint32(100+rnd.Intn(200)), uint64(rnd.Intn(1000)), parents...), uint64(i))
+			txids = append(txids, txid)
+
+			if rnd.Intn(10) == 0 {
+				removed := make([]string, 0)
+				for txid := range idx.Entries {
+					if rnd.Intn(5) == 0 {
+						removed = append(removed, txid)
+					}
+				}
+				// 驱逐时子tx一并移除
+				for _, txid := range removed {
+					for descendant := range idx.Descendants(txid) {
+						removed = append(removed, descendant)
+					}
+				}
+				idx.Remove(removed)
+				remaining := txids[:0]
+				for _, txid := range txids {
+					if _, ok := idx.Entries[txid]; ok {
+						remaining = append(remaining, txid)
+					}
+				}
+				txids = remaining
+			}
+		}
+		checkPackages(t, idx)
+	})
+}
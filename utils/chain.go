@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// ChainProfile 链参数: tx序列化格式和地址版本
+type ChainProfile struct {
+	Name          string
+	Segwit        bool // tx可能带见证数据(BIP144)
+	PubKeyHashVer byte // p2pkh地址版本
+	ScriptHashVer byte // p2sh地址版本
+}
+
+var chainProfiles = map[string]*ChainProfile{
+	"bsv-main": {Name: "bsv-main", PubKeyHashVer: 0x00, ScriptHashVer: 0x05},
+	"bsv-test": {Name: "bsv-test", PubKeyHashVer: 0x6f, ScriptHashVer: 0xc4},
+	"btc-main": {Name: "btc-main", Segwit: true, PubKeyHashVer: 0x00, ScriptHashVer: 0x05},
+	"btc-test": {Name: "btc-test", Segwit: true, PubKeyHashVer: 0x6f, ScriptHashVer: 0xc4},
+}
+
+// Chain 当前链参数，默认bsv-main
+var Chain = chainProfiles["bsv-main"]
+
+// ChainProfileNames 所有支持的链
+func ChainProfileNames() []string {
+	names := make([]string, 0, len(chainProfiles))
+	for name := range chainProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasChainProfile 是否支持该链
+func HasChainProfile(name string) bool {
+	_, ok := chainProfiles[name]
+	return ok
+}
+
+// SetChain 设置当前链，需在解析tx前调用
+func SetChain(name string) error {
+	profile, ok := chainProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown chain profile %q", name)
+	}
+	Chain = profile
+	return nil
+}
+
+// EncodeAddress 按当前链的版本将pkh编码为p2pkh地址，长度不是20字节时返回hex
+func EncodeAddress(pkh []byte) string {
+	if len(pkh) != 20 {
+		return fmt.Sprintf("%x", pkh)
+	}
+	return EncodeBase58Check(Chain.PubKeyHashVer, pkh)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// EncodeBase58Check version + payload + 4字节校验
+func EncodeBase58Check(version byte, payload []byte) string {
+	data := make([]byte, 0, 1+len(payload)+4)
+	data = append(data, version)
+	data = append(data, payload...)
+	data = append(data, GetHash256(data)[:4]...)
+
+	x := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	encoded := make([]byte, 0, len(data)*138/100+1)
+	for x.Sign() > 0 {
+		x.DivMod(x, radix, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	// 前导0字节编码为1
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestEncodeAddress(t *testing.T) {
+	pkh, _ := hex.DecodeString("010966776006953d5567439e5e39f86a0d273bee")
+	for _, c := range []struct {
+		chain   string
+		address string
+	}{
+		{"bsv-main", "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM"},
+		{"bsv-test", "mfcSEPR8EkJrpX91YkTJ9iscdAzppJrG9j"},
+		{"btc-main", "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM"},
+		{"btc-test", "mfcSEPR8EkJrpX91YkTJ9iscdAzppJrG9j"},
+	} {
+		t.Run(c.chain, func(t *testing.T) {
+			withChain(t, c.chain, func() {
+				if address := EncodeAddress(pkh); address != c.address {
+					t.Errorf("EncodeAddress = %s, want %s", address, c.address)
+				}
+			})
+		})
+	}
+
+	t.Run("leading zeros", func(t *testing.T) {
+		withChain(t, "bsv-main", func() {
+			if address := EncodeAddress(make([]byte, 20)); address != "1111111111111111111114oLvT2" {
+				t.Errorf("EncodeAddress = %s", address)
+			}
+		})
+	})
+
+	// 无法识别的地址按hex显示
+	t.Run("not pkh", func(t *testing.T) {
+		if address := EncodeAddress([]byte{0x00}); address != "00" {
+			t.Errorf("EncodeAddress = %s, want 00", address)
+		}
+	})
+}
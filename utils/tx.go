@@ -2,20 +2,100 @@ package utils
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"satomempool/model"
 )
 
-func NewTx(rawtx []byte) (tx *model.Tx, offset uint) {
-	txLen := len(rawtx)
-	if txLen < 4+1+32+4+1+1+1+8+1+1+4 {
-		return nil, 0
+// rawtx解析错误
+var (
+	ErrTruncated          = errors.New("truncated")
+	ErrNonCanonicalVarInt = errors.New("non-canonical varint")
+	ErrLengthOverflow     = errors.New("length exceeds remaining data")
+	ErrTrailingData       = errors.New("trailing data")
+	ErrBadWitness         = errors.New("bad witness")
+)
+
+// 各部分的最小长度
+const (
+	minTxLen    = 4 + 1 + 32 + 4 + 1 + 1 + 1 + 8 + 1 + 1 + 4
+	minTxInLen  = 32 + 4 + 1 + 4
+	minTxOutLen = 8 + 1
+)
+
+// ParseError rawtx解析错误，Field为出错的字段，Offset为该字段在rawtx中的位置
+type ParseError struct {
+	Field  string
+	Offset uint
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse %s at offset %d: %v", e.Field, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrorReason 解析错误的类型名称，用于metrics标签
+func ParseErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTruncated):
+		return "truncated"
+	case errors.Is(err, ErrNonCanonicalVarInt):
+		return "varint"
+	case errors.Is(err, ErrLengthOverflow):
+		return "overflow"
+	case errors.Is(err, ErrTrailingData):
+		return "trailing"
+	case errors.Is(err, ErrBadWitness):
+		return "witness"
+	}
+	return "other"
+}
+
+func parseError(field string, offset uint, err error) *ParseError {
+	return &ParseError{Field: field, Offset: offset, Err: err}
+}
+
+// shiftError 将子结构中的错误位置换算为rawtx中的位置
+func shiftError(err error, base uint) error {
+	if perr, ok := err.(*ParseError); ok {
+		perr.Offset += base
+	}
+	return err
+}
+
+// NewTx 解析rawtx，任何格式错误均返回*ParseError，不会panic。
+// 当前链支持segwit时识别BIP144格式，txid不含见证数据，wtxid为整个rawtx的hash
+func NewTx(rawtx []byte) (tx *model.Tx, offset uint, err error) {
+	txLen := uint(len(rawtx))
+	if txLen < minTxLen {
+		return nil, 0, parseError("tx", 0, ErrTruncated)
 	}
 
 	tx = new(model.Tx)
 	tx.Version = binary.LittleEndian.Uint32(rawtx[0:4])
 	offset = 4
 
-	txincnt, txincntsize := DecodeVarIntForBlock(rawtx[offset:])
+	// marker(0x00) + flag
+	hasWitness := Chain.Segwit && rawtx[offset] == 0x00
+	if hasWitness {
+		if rawtx[offset+1] != 0x01 {
+			return nil, 0, parseError("witness flag", offset+1, ErrBadWitness)
+		}
+		offset += 2
+	}
+
+	txincnt, txincntsize, err := DecodeVarIntForBlock(rawtx[offset:])
+	if err != nil {
+		return nil, 0, parseError("txin count", offset, err)
+	}
+	// 每个输入至少minTxInLen字节，避免按错误的数量分配内存
+	if txincnt > (txLen-offset-txincntsize)/minTxInLen {
+		return nil, 0, parseError("txin count", offset, ErrLengthOverflow)
+	}
 	offset += txincntsize
 
 	tx.TxInCnt = uint32(txincnt)
@@ -23,50 +103,116 @@ func NewTx(rawtx []byte) (tx *model.Tx, offset uint) {
 
 	txoffset := uint(0)
 	for i := range tx.TxIns {
-		tx.TxIns[i], txoffset = NewTxIn(rawtx[offset:])
-		// failed
-		if txoffset == 0 {
-			return nil, 0
+		tx.TxIns[i], txoffset, err = NewTxIn(rawtx[offset:])
+		if err != nil {
+			return nil, 0, shiftError(err, offset)
 		}
 		offset += txoffset
-		// invalid
-		if offset >= uint(txLen) {
-			return nil, 0
-		}
 	}
 
-	txoutcnt, txoutcntsize := DecodeVarIntForBlock(rawtx[offset:])
+	txoutcnt, txoutcntsize, err := DecodeVarIntForBlock(rawtx[offset:])
+	if err != nil {
+		return nil, 0, parseError("txout count", offset, err)
+	}
+	if txoutcnt > (txLen-offset-txoutcntsize)/minTxOutLen {
+		return nil, 0, parseError("txout count", offset, ErrLengthOverflow)
+	}
 	offset += txoutcntsize
 
 	tx.TxOutCnt = uint32(txoutcnt)
 	tx.TxOuts = make([]*model.TxOut, txoutcnt)
 	for i := range tx.TxOuts {
-		tx.TxOuts[i], txoffset = NewTxOut(rawtx[offset:])
-		// failed
-		if txoffset == 0 {
-			return nil, 0
+		tx.TxOuts[i], txoffset, err = NewTxOut(rawtx[offset:])
+		if err != nil {
+			return nil, 0, shiftError(err, offset)
 		}
 		offset += txoffset
-		// invalid
-		if offset >= uint(txLen) {
-			return nil, 0
+	}
+
+	witnessOffset := offset
+	if hasWitness {
+		empty := true
+		for _, input := range tx.TxIns {
+			input.Witness, txoffset, err = newWitness(rawtx[offset:])
+			if err != nil {
+				return nil, 0, shiftError(err, offset)
+			}
+			offset += txoffset
+			if len(input.Witness) > 0 {
+				empty = false
+			}
+		}
+		// 有marker但没有任何见证数据，节点不接受
+		if empty {
+			return nil, 0, parseError("witness", witnessOffset, ErrBadWitness)
 		}
 	}
 
-	// invalid
-	if offset+4 != uint(txLen) {
-		return nil, 0
+	if offset+4 > txLen {
+		return nil, 0, parseError("locktime", offset, ErrTruncated)
+	}
+	if offset+4 < txLen {
+		return nil, 0, parseError("tx", offset+4, ErrTrailingData)
 	}
 
 	tx.LockTime = binary.LittleEndian.Uint32(rawtx[offset : offset+4])
 	offset += 4
-	return
+
+	tx.Size = uint32(txLen)
+	tx.VSize = tx.Size
+	tx.WitnessHash = GetHash256(rawtx)
+	tx.WitnessHashHex = HashString(tx.WitnessHash)
+	if hasWitness {
+		// 去掉marker、flag和见证数据后计算txid
+		stripped := make([]byte, 0, txLen-2-(offset-4-witnessOffset))
+		stripped = append(stripped, rawtx[0:4]...)
+		stripped = append(stripped, rawtx[6:witnessOffset]...)
+		stripped = append(stripped, rawtx[offset-4:offset]...)
+		tx.Hash = GetHash256(stripped)
+		tx.HashHex = HashString(tx.Hash)
+		// weight = stripped*3 + size, vsize向上取整
+		tx.VSize = uint32((uint(len(stripped))*3 + txLen + 3) / 4)
+	} else {
+		tx.Hash = tx.WitnessHash
+		tx.HashHex = tx.WitnessHashHex
+	}
+	return tx, offset, nil
 }
 
-func NewTxIn(txinraw []byte) (txin *model.TxIn, offset uint) {
-	inLen := len(txinraw)
-	if inLen < 32+4+1+1+4 {
-		return nil, 0
+// newWitness 解析一个输入的见证数据，错误位置相对witnessraw
+func newWitness(witnessraw []byte) (witness [][]byte, offset uint, err error) {
+	rawLen := uint(len(witnessraw))
+	cnt, cntsize, err := DecodeVarIntForBlock(witnessraw)
+	if err != nil {
+		return nil, 0, parseError("witness count", 0, err)
+	}
+	// 每项至少1字节长度
+	if cnt > rawLen-cntsize {
+		return nil, 0, parseError("witness count", 0, ErrLengthOverflow)
+	}
+	offset = cntsize
+
+	witness = make([][]byte, cnt)
+	for i := range witness {
+		item, itemsize, err := DecodeVarIntForBlock(witnessraw[offset:])
+		if err != nil {
+			return nil, 0, parseError("witness item length", offset, err)
+		}
+		if item > rawLen-offset-itemsize {
+			return nil, 0, parseError("witness item length", offset, ErrLengthOverflow)
+		}
+		offset += itemsize
+		witness[i] = witnessraw[offset : offset+item]
+		offset += item
+	}
+	return witness, offset, nil
+}
+
+// NewTxIn 解析txinraw开头的一个输入，错误位置相对txinraw
+func NewTxIn(txinraw []byte) (txin *model.TxIn, offset uint, err error) {
+	inLen := uint(len(txinraw))
+	if inLen < minTxInLen {
+		return nil, 0, parseError("txin", 0, ErrTruncated)
 	}
 	txin = new(model.TxIn)
 	txin.InputHash = txinraw[0:32]
@@ -74,15 +220,21 @@ func NewTxIn(txinraw []byte) (txin *model.TxIn, offset uint) {
 	txin.InputVout = binary.LittleEndian.Uint32(txinraw[32:36])
 	offset = 36
 
-	scriptsig, scriptsigsize := DecodeVarIntForBlock(txinraw[offset:])
+	scriptsig, scriptsigsize, err := DecodeVarIntForBlock(txinraw[offset:])
+	if err != nil {
+		return nil, 0, parseError("scriptsig length", offset, err)
+	}
+	// 比较剩余长度，避免offset+scriptsig溢出
+	if scriptsig > inLen-offset-scriptsigsize {
+		return nil, 0, parseError("scriptsig length", offset, ErrLengthOverflow)
+	}
 	offset += scriptsigsize
 
 	txin.ScriptSig = txinraw[offset : offset+scriptsig]
 	offset += scriptsig
 
-	// invalid
-	if offset+4 > uint(inLen) {
-		return nil, 0
+	if offset+4 > inLen {
+		return nil, 0, parseError("sequence", offset, ErrTruncated)
 	}
 	txin.Sequence = binary.LittleEndian.Uint32(txinraw[offset : offset+4])
 	offset += 4
@@ -90,30 +242,32 @@ func NewTxIn(txinraw []byte) (txin *model.TxIn, offset uint) {
 	// process Parallel
 	txin.InputOutpointKey = string(txinraw[0:36])
 	txin.InputOutpoint = txinraw[0:36]
-	return
+	return txin, offset, nil
 }
 
-func NewTxOut(txoutraw []byte) (txout *model.TxOut, offset uint) {
-	outLen := len(txoutraw)
-	if outLen < 8+1+1 {
-		return nil, 0
+// NewTxOut 解析txoutraw开头的一个输出，错误位置相对txoutraw
+func NewTxOut(txoutraw []byte) (txout *model.TxOut, offset uint, err error) {
+	outLen := uint(len(txoutraw))
+	if outLen < minTxOutLen {
+		return nil, 0, parseError("txout", 0, ErrTruncated)
 	}
 	txout = new(model.TxOut)
 	txout.Satoshi = binary.LittleEndian.Uint64(txoutraw[0:8])
 	offset = 8
 
-	pkscript, pkscriptsize := DecodeVarIntForBlock(txoutraw[offset:])
-	offset += pkscriptsize
-
-	// invalid
-	if offset+pkscript > uint(outLen) {
-		return nil, 0
+	pkscript, pkscriptsize, err := DecodeVarIntForBlock(txoutraw[offset:])
+	if err != nil {
+		return nil, 0, parseError("pkscript length", offset, err)
 	}
+	if pkscript > outLen-offset-pkscriptsize {
+		return nil, 0, parseError("pkscript length", offset, ErrLengthOverflow)
+	}
+	offset += pkscriptsize
 
 	txout.Pkscript = make([]byte, pkscript)
 	copy(txout.Pkscript, txoutraw[offset:offset+pkscript])
 	// txout.Pkscript = txoutraw[offset : offset+pkscript]
 	offset += pkscript
 
-	return
+	return txout, offset, nil
 }
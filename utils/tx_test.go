@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// withChain 按链参数执行f，结束后恢复
+func withChain(t testing.TB, name string, f func()) {
+	t.Helper()
+	profile, ok := chainProfiles[name]
+	if !ok {
+		t.Fatalf("unknown chain %s", name)
+	}
+	current := Chain
+	defer func() { Chain = current }()
+	Chain = profile
+	f()
+}
+
+func readCorpus(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "corpus", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkParseError err应为*ParseError，且包含sentinel、字段和位置一致
+func checkParseError(t *testing.T, err error, sentinel error, field string, offset uint) {
+	t.Helper()
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("err = %v, want *ParseError", err)
+	}
+	if !errors.Is(err, sentinel) {
+		t.Errorf("err = %v, want %v", err, sentinel)
+	}
+	if perr.Field != field || perr.Offset != offset {
+		t.Errorf("error at %s:%d, want %s:%d", perr.Field, perr.Offset, field, offset)
+	}
+}
+
+func TestNewTxErrors(t *testing.T) {
+	for _, c := range []struct {
+		chain  string
+		corpus string
+		err    error
+		field  string
+		offset uint
+	}{
+		{"bsv-main", "noncanonical-varint", ErrNonCanonicalVarInt, "txin count", 4},
+		{"bsv-main", "txin-count-overflow", ErrLengthOverflow, "txin count", 4},
+		{"bsv-main", "scriptsig-overflow", ErrLengthOverflow, "scriptsig length", 41},
+		{"bsv-main", "truncated-varint", ErrTruncated, "pkscript length", 56},
+		{"bsv-main", "truncated-locktime", ErrTruncated, "locktime", 116},
+		{"bsv-main", "trailing-data", ErrTrailingData, "tx", 120},
+		// 不支持segwit的链按legacy格式解析，见证数据成为多余数据
+		{"bsv-main", "segwit", ErrTrailingData, "tx", 96},
+		{"btc-main", "segwit-bad-flag", ErrBadWitness, "witness flag", 5},
+		{"btc-main", "segwit-empty-witness", ErrBadWitness, "witness", 84},
+		{"btc-main", "trailing-data", ErrTrailingData, "tx", 120},
+	} {
+		t.Run(c.chain+"/"+c.corpus, func(t *testing.T) {
+			data := readCorpus(t, c.corpus)
+			withChain(t, c.chain, func() {
+				tx, offset, err := NewTx(data)
+				if tx != nil || offset != 0 {
+					t.Errorf("partial tx returned with error")
+				}
+				checkParseError(t, err, c.err, c.field, c.offset)
+			})
+		})
+	}
+
+	t.Run("too short", func(t *testing.T) {
+		_, _, err := NewTx(readCorpus(t, "p2pkh")[:minTxLen-1])
+		checkParseError(t, err, ErrTruncated, "tx", 0)
+	})
+
+	// 逐字节截断不会panic
+	t.Run("every truncation", func(t *testing.T) {
+		for _, name := range []string{"p2pkh", "ft", "segwit"} {
+			data := readCorpus(t, name)
+			withChain(t, "btc-main", func() {
+				for n := 0; n < len(data); n++ {
+					if _, _, err := NewTx(data[:n]); err == nil {
+						t.Errorf("%s truncated to %d parsed", name, n)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestNewTxInErrors(t *testing.T) {
+	outpoint := bytes.Repeat([]byte{0xab}, 36)
+	for _, c := range []struct {
+		name   string
+		raw    []byte
+		err    error
+		field  string
+		offset uint
+	}{
+		{"too short", outpoint, ErrTruncated, "txin", 0},
+		{"truncated scriptsig varint", append(outpoint, 0xff, 0, 0, 0, 0), ErrTruncated, "scriptsig length", 36},
+		{"non-canonical scriptsig varint", append(outpoint, 0xfd, 0x10, 0, 0, 0), ErrNonCanonicalVarInt, "scriptsig length", 36},
+		{"truncated scriptsig", append(outpoint, 0x10, 1, 2, 3, 4), ErrLengthOverflow, "scriptsig length", 36},
+		{"truncated sequence", append(outpoint, 0x02, 1, 2, 3, 4), ErrTruncated, "sequence", 39},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			raw := append([]byte{}, c.raw...)
+			txin, offset, err := NewTxIn(raw)
+			if txin != nil || offset != 0 {
+				t.Errorf("partial txin returned with error")
+			}
+			checkParseError(t, err, c.err, c.field, c.offset)
+		})
+	}
+}
+
+func TestNewTxOutErrors(t *testing.T) {
+	satoshi := make([]byte, 8)
+	for _, c := range []struct {
+		name   string
+		raw    []byte
+		err    error
+		field  string
+		offset uint
+	}{
+		{"too short", satoshi, ErrTruncated, "txout", 0},
+		{"truncated pkscript varint", append(satoshi, 0xfe, 0), ErrTruncated, "pkscript length", 8},
+		{"truncated pkscript", append(satoshi, 0x05, 0x76, 0xa9), ErrLengthOverflow, "pkscript length", 8},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			raw := append([]byte{}, c.raw...)
+			txout, offset, err := NewTxOut(raw)
+			if txout != nil || offset != 0 {
+				t.Errorf("partial txout returned with error")
+			}
+			checkParseError(t, err, c.err, c.field, c.offset)
+		})
+	}
+}
+
+func TestDecodeVarIntForBlock(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		raw  []byte
+		cnt  uint
+		size uint
+		err  error
+	}{
+		{"empty", nil, 0, 0, ErrTruncated},
+		{"one byte", []byte{0xfc, 0xff}, 0xfc, 1, nil},
+		{"uint16", []byte{0xfd, 0xfd, 0x00}, 0xfd, 3, nil},
+		{"uint32", []byte{0xfe, 0x00, 0x00, 0x01, 0x00}, 0x10000, 5, nil},
+		{"uint64", []byte{0xff, 0, 0, 0, 0, 1, 0, 0, 0}, 0x100000000, 9, nil},
+		{"truncated uint16", []byte{0xfd, 0x01}, 0, 0, ErrTruncated},
+		{"truncated uint32", []byte{0xfe, 0x01, 0x00, 0x01}, 0, 0, ErrTruncated},
+		{"truncated uint64", []byte{0xff, 0, 0, 0, 0, 1, 0, 0}, 0, 0, ErrTruncated},
+		{"non-canonical uint16", []byte{0xfd, 0xfc, 0x00}, 0, 0, ErrNonCanonicalVarInt},
+		{"non-canonical uint32", []byte{0xfe, 0xff, 0xff, 0x00, 0x00}, 0, 0, ErrNonCanonicalVarInt},
+		{"non-canonical uint64", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, 0, 0, ErrNonCanonicalVarInt},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cnt, size, err := DecodeVarIntForBlock(c.raw)
+			if err != c.err || cnt != c.cnt || size != c.size {
+				t.Errorf("= %d, %d, %v, want %d, %d, %v", cnt, size, err, c.cnt, c.size, c.err)
+			}
+		})
+	}
+}
+
+func TestParseErrorReason(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		reason string
+	}{
+		{parseError("tx", 0, ErrTruncated), "truncated"},
+		{parseError("txin count", 4, ErrNonCanonicalVarInt), "varint"},
+		{parseError("scriptsig length", 41, ErrLengthOverflow), "overflow"},
+		{parseError("tx", 120, ErrTrailingData), "trailing"},
+		{parseError("witness flag", 5, ErrBadWitness), "witness"},
+		{errors.New("unknown"), "other"},
+	} {
+		if reason := ParseErrorReason(c.err); reason != c.reason {
+			t.Errorf("ParseErrorReason(%v) = %s, want %s", c.err, reason, c.reason)
+		}
+	}
+
+	err := shiftError(parseError("sequence", 39, ErrTruncated), 5)
+	if err.Error() != "parse sequence at offset 44: truncated" {
+		t.Errorf("shifted error = %v", err)
+	}
+}
+
+// FuzzNewTx 按legacy和segwit两种格式解析，任何输入都不应panic，错误均为*ParseError。
+// 种子为testdata/corpus中的rawtx:
+//
+//	go test -fuzz=FuzzNewTx ./utils
+func FuzzNewTx(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "corpus", "*"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, name := range []string{"bsv-main", "btc-main"} {
+			withChain(t, name, func() {
+				checkNewTx(t, data)
+			})
+		}
+	})
+}
+
+func checkNewTx(t *testing.T, data []byte) {
+	tx, offset, err := NewTx(data)
+	if err != nil {
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("error is not *ParseError: %v", err)
+		}
+		if perr.Offset > uint(len(data)) {
+			t.Fatalf("error offset beyond data: %v", err)
+		}
+		if tx != nil || offset != 0 {
+			t.Fatal("partial tx returned with error")
+		}
+		return
+	}
+
+	if offset != uint(len(data)) || tx.Size != uint32(len(data)) {
+		t.Fatal("offset does not cover rawtx")
+	}
+	if tx.VSize > tx.Size {
+		t.Fatal("vsize larger than size")
+	}
+	if int(tx.TxInCnt) != len(tx.TxIns) || int(tx.TxOutCnt) != len(tx.TxOuts) {
+		t.Fatal("count mismatch")
+	}
+	hasWitness := false
+	for _, input := range tx.TxIns {
+		if len(input.Witness) > 0 {
+			hasWitness = true
+		}
+	}
+	if hasWitness == (tx.HashHex == tx.WitnessHashHex) {
+		t.Fatal("txid/wtxid mismatch with witness presence")
+	}
+
+	// 解析结果只依赖输入内容
+	again, _, err := NewTx(append([]byte{}, data...))
+	if err != nil {
+		t.Fatalf("reparse failed: %v", err)
+	}
+	if again.HashHex != tx.HashHex || again.WitnessHashHex != tx.WitnessHashHex {
+		t.Fatal("reparse hash mismatch")
+	}
+	for i, input := range tx.TxIns {
+		if input.InputOutpointKey != again.TxIns[i].InputOutpointKey ||
+			!bytes.Equal(input.ScriptSig, again.TxIns[i].ScriptSig) ||
+			input.Sequence != again.TxIns[i].Sequence ||
+			len(input.Witness) != len(again.TxIns[i].Witness) {
+			t.Fatal("reparse txin mismatch")
+		}
+	}
+	for i, output := range tx.TxOuts {
+		if output.Satoshi != again.TxOuts[i].Satoshi ||
+			!bytes.Equal(output.Pkscript, again.TxOuts[i].Pkscript) {
+			t.Fatal("reparse txout mismatch")
+		}
+	}
+}
@@ -4,21 +4,46 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"math"
 	"satomempool/model"
+	"strconv"
 )
 
-func DecodeVarIntForBlock(raw []byte) (cnt uint, cnt_size uint) {
+// DecodeVarIntForBlock 解析raw开头的varint，数据不足或编码不是最短形式时返回错误
+func DecodeVarIntForBlock(raw []byte) (cnt uint, cnt_size uint, err error) {
+	if len(raw) < 1 {
+		return 0, 0, ErrTruncated
+	}
 	if raw[0] < 0xfd {
-		return uint(raw[0]), 1
+		return uint(raw[0]), 1, nil
 	}
 
+	var min uint64
 	if raw[0] == 0xfd {
-		return uint(binary.LittleEndian.Uint16(raw[1:3])), 3
+		cnt_size, min = 3, 0xfd
 	} else if raw[0] == 0xfe {
-		return uint(binary.LittleEndian.Uint32(raw[1:5])), 5
+		cnt_size, min = 5, 0x10000
+	} else {
+		cnt_size, min = 9, 0x100000000
+	}
+	if uint(len(raw)) < cnt_size {
+		return 0, 0, ErrTruncated
+	}
+
+	var value uint64
+	switch cnt_size {
+	case 3:
+		value = uint64(binary.LittleEndian.Uint16(raw[1:3]))
+	case 5:
+		value = uint64(binary.LittleEndian.Uint32(raw[1:5]))
+	default:
+		value = binary.LittleEndian.Uint64(raw[1:9])
+	}
+	if value < min {
+		return 0, 0, ErrNonCanonicalVarInt
 	}
-	return uint(binary.LittleEndian.Uint64(raw[1:9])), 9
+	return uint(value), cnt_size, nil
 }
 
 func GetHash256(data []byte) (hash []byte) {
@@ -43,29 +68,74 @@ func HashString(data []byte) (res string) {
 	return hex.EncodeToString(reverseData)
 }
 
-func isTxFinal(tx *model.Tx) bool {
+// OutpointString 将outpointKey转为txid:vout
+func OutpointString(outpointKey string) string {
+	if len(outpointKey) != 36 {
+		return hex.EncodeToString([]byte(outpointKey))
+	}
+	vout := binary.LittleEndian.Uint32([]byte(outpointKey[32:]))
+	return HashString([]byte(outpointKey[:32])) + ":" + strconv.FormatUint(uint64(vout), 10)
+}
+
+// OutpointKey 由txid(hex，显示顺序)和vout生成outpointKey
+func OutpointKey(txidHex string, vout uint32) (string, error) {
+	txid, err := hex.DecodeString(txidHex)
+	if err != nil {
+		return "", err
+	}
+	if len(txid) != 32 {
+		return "", errors.New("txid must be 32 bytes")
+	}
+	key := make([]byte, 36)
+	for i := 0; i < 32; i++ {
+		key[i] = txid[31-i]
+	}
+	binary.LittleEndian.PutUint32(key[32:], vout)
+	return string(key), nil
+}
+
+// LOCKTIME_THRESHOLD 小于该值的locktime为区块高度，否则为时间戳
+const LOCKTIME_THRESHOLD = 500000000
+
+// IsTxFinal 判断tx能否打包进高度为height、时间为blockTime的区块
+func IsTxFinal(tx *model.Tx, height, blockTime uint32) bool {
 	if tx.LockTime == 0 {
 		return true
 	}
 
-	isFinal := true
+	limit := height
+	if tx.LockTime >= LOCKTIME_THRESHOLD {
+		limit = blockTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+
 	for _, input := range tx.TxIns {
 		if input.Sequence != math.MaxUint32 {
-			isFinal = false
+			return false
 		}
 	}
-	return isFinal
+	return true
 }
 
-func IsTxNonFinal(tx *model.Tx, nonFinalTxs map[string]bool) bool {
-	if !isTxFinal(tx) {
-		return true
+// IsSequenceUpdate 判断tx是否为old的更新版本: 花费相同的输入，sequence均不减小且至少一个增大
+func IsSequenceUpdate(old, tx *model.Tx) bool {
+	if len(old.TxIns) != len(tx.TxIns) {
+		return false
 	}
-
-	for _, input := range tx.TxIns {
-		if _, ok := nonFinalTxs[input.InputHashHex]; ok {
-			return true
+	increased := false
+	for i, input := range tx.TxIns {
+		oldInput := old.TxIns[i]
+		if input.InputOutpointKey != oldInput.InputOutpointKey {
+			return false
+		}
+		if input.Sequence < oldInput.Sequence {
+			return false
+		}
+		if input.Sequence > oldInput.Sequence {
+			increased = true
 		}
 	}
-	return false
+	return increased
 }